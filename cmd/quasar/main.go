@@ -1,15 +1,21 @@
 package main
 
 import (
+	"errors"
 	"fmt"
+	"image/color"
 	"os"
 
 	tea "charm.land/bubbletea/v2"
+	"charm.land/lipgloss/v2"
+	"github.com/RNAV2019/quasar/internal/cache"
 	"github.com/RNAV2019/quasar/internal/cli"
 	"github.com/RNAV2019/quasar/internal/cli/tui"
 	"github.com/RNAV2019/quasar/internal/config"
 	"github.com/RNAV2019/quasar/internal/latex"
 	"github.com/RNAV2019/quasar/internal/notebook"
+	"github.com/RNAV2019/quasar/internal/styles"
+	"github.com/RNAV2019/quasar/internal/terminal"
 	"github.com/RNAV2019/quasar/internal/ui"
 )
 
@@ -20,19 +26,42 @@ func main() {
 		os.Exit(1)
 	}
 
-	if cfg.NeedsLatexSetup() {
-		if err := tui.RunSetup(cfg.InitLatexFormats); err != nil {
-			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
-			os.Exit(1)
-		}
+	preamble, err := cfg.Preamble("")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	setupLatex(cfg, preamble)
+
+	latex.SetRenderTimeout(cfg.Settings.RenderTimeoutDuration())
+
+	cacheManager, err := cache.Open(cfg.CacheDir, cfg.Settings.CacheMaxBytes())
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	} else {
+		latex.SetCacheManager(cacheManager)
 	}
 
 	cli.OpenNotebookFunc = func(name string) {
 		latex.DeleteAllImages()
 
 		notebookPath := notebook.Path(cfg.NotesDir, name)
+		preamble, err := cfg.Preamble(notebookPath)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+		}
+		setupLatex(cfg, preamble)
+		setupGraphics(cfg)
+
 		p := tea.NewProgram(ui.InitialModelWithNotebook(cfg, notebookPath, name))
-		if _, err := p.Run(); err != nil {
+		graphics := ui.NewGraphicsQueue(p.Send)
+		latex.SetGraphicsOutput(graphics)
+		_, err = p.Run()
+		graphics.Close()
+		latex.SetGraphicsOutput(nil)
+		if cacheManager != nil {
+			cacheManager.Save()
+		}
+		if err != nil {
 			fmt.Printf("Alas, there's been an error: %v", err)
 			os.Exit(1)
 		}
@@ -45,3 +74,75 @@ func main() {
 		os.Exit(1)
 	}
 }
+
+// setupLatex builds the format files for preamble if they are missing or
+// stale, then makes it the active preamble.
+func setupLatex(cfg *config.Config, preamble string) {
+	if latex.ToolchainAvailable() && cfg.NeedsLatexSetup(preamble) {
+		if err := tui.RunSetup(func() error { return cfg.InitLatexFormats(preamble) }); err != nil {
+			fmt.Fprintf(os.Stderr, "Error: %v\n", err)
+			os.Exit(1)
+		}
+	}
+	latex.SetPreamble(preamble)
+}
+
+// setupGraphics picks how images reach the terminal and the colours and
+// size math is rendered at. Only the notebook view draws images, so other
+// subcommands never query the terminal or touch tmux.
+func setupGraphics(cfg *config.Config) {
+	if cfg.Settings.TmuxPassthrough && terminal.InTmux() {
+		if err := terminal.EnableTmuxPassthrough(); err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: could not enable tmux passthrough: %v\n", err)
+		} else {
+			fmt.Fprintln(os.Stderr, "Turned on tmux allow-passthrough for this pane")
+		}
+	}
+	protocol, err := latex.ResolveProtocol(cfg.Settings.GraphicsProtocol)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v, using %s\n", err, protocol)
+	}
+	latex.SetProtocol(protocol)
+	if protocol == latex.ProtocolKitty {
+		transfer, err := latex.ResolveKittyTransfer(cfg.Settings.KittyTransfer, cfg.CacheDir)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "Warning: %v, using %s\n", err, transfer)
+		}
+		latex.SetKittyTransfer(transfer)
+	}
+
+	theme, err := mathTheme(cfg.Settings)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Warning: %v\n", err)
+	}
+	latex.SetTheme(theme)
+	latex.SetMetrics(latex.MetricsFor(terminal.GetCellSize().HeightPx, cfg.Settings.MathScale))
+}
+
+// mathTheme returns the colours math is rendered in: the palette's text
+// colour for the terminal background, overridden by math_colors.
+func mathTheme(settings config.Settings) (latex.Theme, error) {
+	var errs []error
+	theme := latex.Theme{Environments: make(map[string]color.NRGBA)}
+	for key, value := range settings.MathColors {
+		c, err := latex.ParseColor(value)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("math_colors.%s: %w", key, err))
+			continue
+		}
+		if key == "foreground" {
+			theme.Foreground = c
+		} else {
+			theme.Environments[key] = c
+		}
+	}
+
+	if theme.Foreground.A == 0 {
+		fg := styles.ColorMathDark
+		if !lipgloss.HasDarkBackground(os.Stdin, os.Stdout) {
+			fg = styles.ColorMathLight
+		}
+		theme.Foreground = color.NRGBAModel.Convert(fg).(color.NRGBA)
+	}
+	return theme, errors.Join(errs...)
+}
@@ -0,0 +1,340 @@
+// Package cache tracks rendered images in the cache directory, evicting the
+// least recently used ones when the total size exceeds a configured cap.
+package cache
+
+import (
+	"encoding/json"
+	"fmt"
+	"image/png"
+	"os"
+	"path/filepath"
+	"regexp"
+	"slices"
+	"sync"
+	"time"
+)
+
+const indexFile = "index.json"
+
+// entryNameRe matches the files the manager owns: content-addressed PNGs.
+// Format files, stamps, and temporary directories are left alone.
+var entryNameRe = regexp.MustCompile(`^[0-9a-f]{64}\.png$`)
+
+// Entry describes one cached image.
+type Entry struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	LastUsed time.Time `json:"last_used"`
+	// Origin identifies the source the image was rendered from, whatever
+	// the theme or font size it was rendered at. It is empty for entries
+	// found on disk that have not been used since.
+	Origin string `json:"origin,omitempty"`
+}
+
+// Stats summarises the contents of the cache.
+type Stats struct {
+	Entries  int
+	Bytes    int64
+	MaxBytes int64
+	Oldest   time.Time
+	Newest   time.Time
+}
+
+// Problem is an inconsistency found by Verify.
+type Problem struct {
+	Name   string
+	Reason string
+}
+
+// Manager keeps an index of cached images with their sizes and last use.
+// The index is reconciled with the directory when opened, so a stale or
+// missing index file is harmless.
+type Manager struct {
+	dir      string
+	maxBytes int64
+
+	mu      sync.Mutex
+	entries map[string]*Entry
+	total   int64
+	dirty   bool
+}
+
+// Open loads the index in dir and reconciles it with the files on disk.
+// A maxBytes of zero or less disables eviction.
+func Open(dir string, maxBytes int64) (*Manager, error) {
+	m := &Manager{dir: dir, maxBytes: maxBytes, entries: make(map[string]*Entry)}
+
+	if data, err := os.ReadFile(filepath.Join(dir, indexFile)); err == nil {
+		var saved []Entry
+		if err := json.Unmarshal(data, &saved); err == nil {
+			for _, e := range saved {
+				m.entries[e.Name] = &e
+			}
+		}
+	}
+
+	files, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read cache directory: %w", err)
+	}
+	onDisk := make(map[string]bool)
+	for _, f := range files {
+		if f.IsDir() || !entryNameRe.MatchString(f.Name()) {
+			continue
+		}
+		info, err := f.Info()
+		if err != nil {
+			continue
+		}
+		onDisk[f.Name()] = true
+		if e, ok := m.entries[f.Name()]; ok {
+			e.Size = info.Size()
+			continue
+		}
+		m.entries[f.Name()] = &Entry{Name: f.Name(), Size: info.Size(), LastUsed: info.ModTime()}
+		m.dirty = true
+	}
+	for name := range m.entries {
+		if !onDisk[name] {
+			delete(m.entries, name)
+			m.dirty = true
+		}
+	}
+	for _, e := range m.entries {
+		m.total += e.Size
+	}
+	return m, nil
+}
+
+// Dir returns the cache directory.
+func (m *Manager) Dir() string {
+	return m.dir
+}
+
+// Touch records that the named entry, rendered from origin, was used.
+func (m *Manager) Touch(name, origin string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.entries[name]; ok {
+		e.LastUsed = time.Now()
+		if origin != "" {
+			e.Origin = origin
+		}
+		m.dirty = true
+	}
+}
+
+// Add records a newly written entry rendered from origin and evicts old
+// entries if the cache is now over its cap.
+func (m *Manager) Add(name, origin string) error {
+	info, err := os.Stat(filepath.Join(m.dir, name))
+	if err != nil {
+		return err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if e, ok := m.entries[name]; ok {
+		m.total -= e.Size
+	}
+	m.entries[name] = &Entry{Name: name, Size: info.Size(), LastUsed: time.Now(), Origin: origin}
+	m.total += info.Size()
+	m.dirty = true
+
+	if m.maxBytes > 0 && m.total > m.maxBytes {
+		evicted, _ := m.leastRecentlyUsedLocked(m.total, nil)
+		if err := m.removeAllLocked(evicted); err != nil {
+			return err
+		}
+		return m.saveLocked()
+	}
+	return nil
+}
+
+// Prune removes every entry for which keep returns false, then the least
+// recently used of the rest until the cache fits its cap. A nil keep only
+// evicts. With dryRun set nothing is deleted. It returns the removed names
+// and the bytes freed, counting each entry once.
+func (m *Manager) Prune(keep func(Entry) bool, dryRun bool) ([]string, int64, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var removed []string
+	var freed int64
+	pruned := make(map[string]bool)
+	if keep != nil {
+		for _, name := range m.namesLocked() {
+			e := m.entries[name]
+			if keep(*e) {
+				continue
+			}
+			pruned[name] = true
+			removed = append(removed, name)
+			freed += e.Size
+		}
+	}
+	evicted, evictedBytes := m.leastRecentlyUsedLocked(m.total-freed, pruned)
+	removed = append(removed, evicted...)
+	freed += evictedBytes
+
+	if dryRun {
+		return removed, freed, nil
+	}
+	return removed, freed, m.removeAllLocked(removed)
+}
+
+// leastRecentlyUsedLocked returns the oldest entries, skipping those in
+// skip, whose removal brings a cache of total bytes within the cap, and the
+// bytes they hold.
+func (m *Manager) leastRecentlyUsedLocked(total int64, skip map[string]bool) ([]string, int64) {
+	if m.maxBytes <= 0 || total <= m.maxBytes {
+		return nil, 0
+	}
+	byAge := make([]*Entry, 0, len(m.entries))
+	for _, e := range m.entries {
+		if !skip[e.Name] {
+			byAge = append(byAge, e)
+		}
+	}
+	slices.SortFunc(byAge, func(a, b *Entry) int {
+		return a.LastUsed.Compare(b.LastUsed)
+	})
+
+	var names []string
+	var freed int64
+	for _, e := range byAge {
+		if total <= m.maxBytes {
+			break
+		}
+		names = append(names, e.Name)
+		freed += e.Size
+		total -= e.Size
+	}
+	return names, freed
+}
+
+// Clear removes every entry and the index.
+func (m *Manager) Clear() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, name := range m.namesLocked() {
+		if err := m.removeLocked(name); err != nil {
+			return err
+		}
+	}
+	m.dirty = false
+	if err := os.Remove(filepath.Join(m.dir, indexFile)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// Verify decodes every entry and reports those that are not valid PNGs.
+// With fix set, broken entries are removed.
+func (m *Manager) Verify(fix bool) ([]Problem, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var problems []Problem
+	for _, name := range m.namesLocked() {
+		if reason := checkPNG(filepath.Join(m.dir, name)); reason != "" {
+			problems = append(problems, Problem{Name: name, Reason: reason})
+			if fix {
+				if err := m.removeLocked(name); err != nil {
+					return problems, err
+				}
+			}
+		}
+	}
+	return problems, nil
+}
+
+func checkPNG(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return err.Error()
+	}
+	defer f.Close()
+	if _, err := png.Decode(f); err != nil {
+		return fmt.Sprintf("invalid PNG: %v", err)
+	}
+	return ""
+}
+
+// Stats returns the number and total size of entries and their use range.
+func (m *Manager) Stats() Stats {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	s := Stats{Entries: len(m.entries), Bytes: m.total, MaxBytes: m.maxBytes}
+	for _, e := range m.entries {
+		if s.Oldest.IsZero() || e.LastUsed.Before(s.Oldest) {
+			s.Oldest = e.LastUsed
+		}
+		if e.LastUsed.After(s.Newest) {
+			s.Newest = e.LastUsed
+		}
+	}
+	return s
+}
+
+// Save writes the index if it has changed since it was loaded or saved.
+func (m *Manager) Save() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.saveLocked()
+}
+
+func (m *Manager) saveLocked() error {
+	if !m.dirty {
+		return nil
+	}
+	entries := make([]Entry, 0, len(m.entries))
+	for _, name := range m.namesLocked() {
+		entries = append(entries, *m.entries[name])
+	}
+	data, err := json.Marshal(entries)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a torn index.
+	tmpPath := filepath.Join(m.dir, indexFile+".tmp")
+	if err := os.WriteFile(tmpPath, data, 0644); err != nil {
+		return fmt.Errorf("failed to write cache index: %w", err)
+	}
+	if err := os.Rename(tmpPath, filepath.Join(m.dir, indexFile)); err != nil {
+		return fmt.Errorf("failed to write cache index: %w", err)
+	}
+	m.dirty = false
+	return nil
+}
+
+func (m *Manager) removeAllLocked(names []string) error {
+	for _, name := range names {
+		if err := m.removeLocked(name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Manager) removeLocked(name string) error {
+	if err := os.Remove(filepath.Join(m.dir, name)); err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("failed to remove %s: %w", name, err)
+	}
+	if e, ok := m.entries[name]; ok {
+		m.total -= e.Size
+		delete(m.entries, name)
+	}
+	m.dirty = true
+	return nil
+}
+
+func (m *Manager) namesLocked() []string {
+	names := make([]string, 0, len(m.entries))
+	for name := range m.entries {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+	return names
+}
@@ -0,0 +1,256 @@
+package cli
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+
+	"github.com/RNAV2019/quasar/internal/cache"
+	"github.com/RNAV2019/quasar/internal/config"
+	"github.com/RNAV2019/quasar/internal/editor"
+	"github.com/RNAV2019/quasar/internal/latex"
+	"github.com/RNAV2019/quasar/internal/styles"
+	"github.com/spf13/cobra"
+)
+
+// NewCacheCmd builds the "cache" subcommand and its children.
+func NewCacheCmd(config *config.Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Inspect and prune the render cache",
+		Long:  "Show statistics for, prune, and verify the rendered math images cached in ~/.cache/quasar.",
+		Run: func(cmd *cobra.Command, args []string) {
+			cmd.Help()
+		},
+	}
+
+	cmd.AddCommand(newCacheStatsCmd(config))
+	cmd.AddCommand(newCachePruneCmd(config))
+	cmd.AddCommand(newCacheVerifyCmd(config))
+
+	return cmd
+}
+
+func newCacheStatsCmd(config *config.Config) *cobra.Command {
+	return &cobra.Command{
+		Use:   "stats",
+		Short: "Show cache size and usage",
+		Run: func(cmd *cobra.Command, args []string) {
+			m, err := openCache(config)
+			if err != nil {
+				PrintError(err.Error())
+				return
+			}
+			defer m.Save()
+
+			stats := m.Stats()
+			fmt.Println()
+			fmt.Printf("  %s %s\n", styles.BoldStyle.Render("Directory:"), config.CacheDir)
+			fmt.Printf("  %s %d\n", styles.BoldStyle.Render("Entries:  "), stats.Entries)
+			if stats.MaxBytes > 0 {
+				fmt.Printf("  %s %s of %s\n", styles.BoldStyle.Render("Size:     "), formatBytes(stats.Bytes), formatBytes(stats.MaxBytes))
+			} else {
+				fmt.Printf("  %s %s (no limit)\n", styles.BoldStyle.Render("Size:     "), formatBytes(stats.Bytes))
+			}
+			if stats.Entries > 0 {
+				fmt.Printf("  %s %s\n", styles.BoldStyle.Render("Oldest:   "), stats.Oldest.Format("2006-01-02 15:04"))
+				fmt.Printf("  %s %s\n", styles.BoldStyle.Render("Newest:   "), stats.Newest.Format("2006-01-02 15:04"))
+			}
+			fmt.Println()
+		},
+	}
+}
+
+func newCachePruneCmd(config *config.Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove unreferenced and least recently used images",
+		Long: "Remove images that no note in any notebook references, then evict the least " +
+			"recently used images until the cache fits within cache_max_mb.",
+		Run: func(cmd *cobra.Command, args []string) {
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+			keepUnreferenced, _ := cmd.Flags().GetBool("keep-unreferenced")
+
+			m, err := openCache(config)
+			if err != nil {
+				PrintError(err.Error())
+				return
+			}
+			defer m.Save()
+
+			var keep func(cache.Entry) bool
+			if !keepUnreferenced {
+				referenced, err := referencedOrigins(config)
+				if err != nil {
+					PrintError(fmt.Sprintf("Failed to scan notes: %v", err))
+					return
+				}
+				// Entries whose origin is unknown are left to eviction.
+				keep = func(e cache.Entry) bool { return e.Origin == "" || referenced[e.Origin] }
+			}
+
+			names, freed, err := m.Prune(keep, dryRun)
+			if err != nil {
+				PrintError(fmt.Sprintf("Failed to prune cache: %v", err))
+				return
+			}
+
+			if dryRun {
+				PrintInfo(fmt.Sprintf("Would remove %d images (%s).", len(names), formatBytes(freed)))
+				return
+			}
+			PrintSuccess(fmt.Sprintf("Removed %d images (%s).", len(names), formatBytes(freed)))
+		},
+	}
+
+	cmd.Flags().Bool("dry-run", false, "Show what would be removed without deleting anything")
+	cmd.Flags().Bool("keep-unreferenced", false, "Only evict to the size cap")
+
+	return cmd
+}
+
+func newCacheVerifyCmd(config *config.Config) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "verify",
+		Short: "Check that every cached image is a valid PNG",
+		Run: func(cmd *cobra.Command, args []string) {
+			fix, _ := cmd.Flags().GetBool("fix")
+
+			m, err := openCache(config)
+			if err != nil {
+				PrintError(err.Error())
+				return
+			}
+			defer m.Save()
+
+			problems, err := m.Verify(fix)
+			if err != nil {
+				PrintError(fmt.Sprintf("Failed to verify cache: %v", err))
+				return
+			}
+			if len(problems) == 0 {
+				PrintSuccess(fmt.Sprintf("All %d images are valid.", m.Stats().Entries))
+				return
+			}
+
+			var hints []string
+			for _, p := range problems {
+				hints = append(hints, fmt.Sprintf("%s: %s", p.Name, p.Reason))
+			}
+			if fix {
+				PrintErrorWithHints(fmt.Sprintf("Removed %d broken images:", len(problems)), hints)
+			} else {
+				hints = append(hints, "", "Run 'quasar cache verify --fix' to remove them.")
+				PrintErrorWithHints(fmt.Sprintf("Found %d broken images:", len(problems)), hints)
+			}
+		},
+	}
+
+	cmd.Flags().Bool("fix", false, "Remove broken images")
+
+	return cmd
+}
+
+// openCache opens the cache manager with the configured size cap.
+func openCache(config *config.Config) (*cache.Manager, error) {
+	m, err := cache.Open(config.CacheDir, config.Settings.CacheMaxBytes())
+	if err != nil {
+		return nil, fmt.Errorf("Failed to open cache: %w", err)
+	}
+	return m, nil
+}
+
+// notebookTeX is the LaTeX a notebook adds to every expression.
+type notebookTeX struct {
+	preamble string
+	macros   string
+}
+
+// referencedOrigins returns the cache origins of every math expression,
+// diagram, and picture in every note. Math is rendered with the preamble and
+// macros of the note's notebook; any theme or font size matches.
+func referencedOrigins(cfg *config.Config) (map[string]bool, error) {
+	notesDir := cfg.NotesDir
+	referenced := make(map[string]bool)
+	notebooks := make(map[string]notebookTeX)
+	texFor := func(path string) (notebookTeX, error) {
+		// Notes directly in the notes directory belong to no notebook.
+		notebookPath := ""
+		if rel, err := filepath.Rel(notesDir, path); err == nil {
+			if first, _, ok := strings.Cut(rel, string(filepath.Separator)); ok {
+				notebookPath = filepath.Join(notesDir, first)
+			}
+		}
+		if tex, ok := notebooks[notebookPath]; ok {
+			return tex, nil
+		}
+		var tex notebookTeX
+		var err error
+		if tex.preamble, err = cfg.Preamble(notebookPath); err != nil {
+			return tex, err
+		}
+		if notebookPath != "" {
+			if tex.macros, err = config.LoadMacros(notebookPath); err != nil {
+				return tex, err
+			}
+		}
+		notebooks[notebookPath] = tex
+		return tex, nil
+	}
+
+	err := filepath.WalkDir(notesDir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if path != notesDir && strings.HasPrefix(d.Name(), ".") {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if filepath.Ext(path) != ".md" {
+			return nil
+		}
+		model, err := editor.LoadFromFile(path)
+		if err != nil {
+			return err
+		}
+		tex, err := texFor(path)
+		if err != nil {
+			return err
+		}
+		macros := editor.NoteMacros(model.Blocks, tex.macros)
+		doc := editor.ParseDocument(model.Blocks)
+		for _, src := range editor.ExtractMath(model.Blocks) {
+			referenced[latex.MathOrigin(doc.MathSource(src.Content), src.Inline, tex.preamble, macros)] = true
+		}
+		for _, src := range editor.ExtractDiagrams(model.Blocks) {
+			referenced[latex.GraphvizOrigin(src)] = true
+		}
+		for _, link := range editor.ExtractPictures(model.Blocks) {
+			if !filepath.IsAbs(link) {
+				link = filepath.Join(filepath.Dir(path), link)
+			}
+			if resolved, err := filepath.EvalSymlinks(link); err == nil {
+				referenced[latex.PictureOrigin(resolved)] = true
+			}
+		}
+		return nil
+	})
+	return referenced, err
+}
+
+// formatBytes renders a byte count in human-readable units.
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -55,12 +55,13 @@ func NewRootCmd(config *config.Config) *cobra.Command {
 		},
 	}
 
-	cmd.Flags().BoolP("clear-cache", "", false, "Clear the cache directory")
+	cmd.Flags().BoolP("clear-cache", "", false, "Remove all rendered images from the cache")
 
 	cmd.AddCommand(NewNotebookCmd(config))
 	cmd.AddCommand(newCompletionCmd())
 	cmd.AddCommand(newBackupCmd(config))
 	cmd.AddCommand(newSyncCmd(config))
+	cmd.AddCommand(NewCacheCmd(config))
 
 	return cmd
 }
@@ -71,9 +72,14 @@ func openNotebook(name string) {
 	}
 }
 
-// clearCacheDir recursively removes all files and directories from the cache directory.
+// clearCacheDir removes every rendered image from the cache directory. The
+// LaTeX format files are kept so they do not need rebuilding.
 func clearCacheDir(cfg *config.Config) error {
-	return os.RemoveAll(cfg.CacheDir)
+	m, err := openCache(cfg)
+	if err != nil {
+		return err
+	}
+	return m.Clear()
 }
 
 // newCompletionCmd returns the completion command for shell autocompletion.
@@ -0,0 +1,60 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+const (
+	// PreambleFile is the name of the LaTeX preamble file read from the
+	// config directory and from the root of each notebook.
+	PreambleFile = "preamble.tex"
+	// MacrosFile is the name of the file of LaTeX macro definitions shared
+	// by every note in a notebook, read from the notebook's root.
+	MacrosFile = "macros.tex"
+)
+
+// LoadPreamble reads preamble.tex from dir. A missing file yields an empty
+// preamble.
+func LoadPreamble(dir string) (string, error) {
+	return loadTeXFile(dir, PreambleFile)
+}
+
+// LoadMacros reads macros.tex from a notebook directory. A missing file
+// yields no macros.
+func LoadMacros(notebookPath string) (string, error) {
+	return loadTeXFile(notebookPath, MacrosFile)
+}
+
+func loadTeXFile(dir, name string) (string, error) {
+	data, err := os.ReadFile(filepath.Join(dir, name))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return "", nil
+		}
+		return "", fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	return string(data), nil
+}
+
+// Preamble returns the user preamble followed by the preamble of the
+// notebook at notebookPath, if any. An empty notebookPath returns only the
+// user preamble.
+func (c *Config) Preamble(notebookPath string) (string, error) {
+	preamble, err := LoadPreamble(c.ConfigDir)
+	if err != nil {
+		return "", err
+	}
+	if notebookPath == "" {
+		return preamble, nil
+	}
+	notebookPreamble, err := LoadPreamble(notebookPath)
+	if err != nil {
+		return "", err
+	}
+	if preamble != "" && notebookPreamble != "" {
+		preamble += "\n"
+	}
+	return preamble + notebookPreamble, nil
+}
@@ -0,0 +1,119 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"time"
+
+	"gopkg.in/yaml.v2"
+)
+
+// Settings holds user preferences read from ~/.config/quasar/config.yaml.
+type Settings struct {
+	// GraphicsProtocol selects how rendered images reach the terminal:
+	// "auto", "kitty", "sixel", "iterm2", or "text".
+	GraphicsProtocol string `yaml:"graphics_protocol"`
+	// KittyTransfer selects how images reach a Kitty terminal: "auto",
+	// "direct", "file", or "temp".
+	KittyTransfer string `yaml:"kitty_transfer"`
+	// TmuxPassthrough turns on tmux's allow-passthrough option for quasar's
+	// pane, which graphics inside tmux need. Off by default, since it
+	// changes tmux state that outlives quasar.
+	TmuxPassthrough bool `yaml:"tmux_passthrough"`
+	// Renderer selects the LaTeX pipeline: "auto", "dvi", "pdf",
+	// "tectonic", or "lualatex".
+	Renderer string `yaml:"renderer"`
+	// RenderWorkers limits how many LaTeX compiles run at once. Zero uses
+	// the number of CPUs.
+	RenderWorkers int `yaml:"render_workers"`
+	// CacheMaxMB caps the size of rendered images kept in the cache
+	// directory. Zero disables the cap.
+	CacheMaxMB int `yaml:"cache_max_mb"`
+	// MathColors overrides the colours of rendered math. The "foreground"
+	// key sets the default colour; any other key names a LaTeX environment,
+	// such as "tikzpicture", drawn in its own colour. Values are "#rrggbb".
+	MathColors map[string]string `yaml:"math_colors"`
+	// MathScale enlarges rendered math relative to the terminal font. At 1,
+	// one line of math is one terminal row.
+	MathScale float64 `yaml:"math_scale"`
+	// RenderTimeout is how many seconds a single TeX, dvipng, or pdftoppm
+	// run may take before it is killed. Zero disables the limit.
+	RenderTimeout int `yaml:"render_timeout"`
+}
+
+const defaultSettingsYAML = `# Settings for quasar
+#
+# Image protocol used to display rendered math: auto, kitty, sixel, iterm2, text
+# graphics_protocol: auto
+
+# How Kitty receives images: auto, direct (compressed, works over SSH),
+# file (reads the cache), temp (reads a temporary copy)
+# kitty_transfer: auto
+
+# Turn on tmux's allow-passthrough for quasar's pane so images show inside tmux
+# tmux_passthrough: false
+
+# LaTeX pipeline used to render math: auto, dvi, pdf, tectonic, lualatex
+# renderer: auto
+
+# Maximum number of LaTeX compiles run at once (0 uses the number of CPUs)
+# render_workers: 0
+
+# Maximum size of the render cache in megabytes (0 for no limit)
+# cache_max_mb: 500
+
+# Colours of rendered math, by default taken from the theme for the terminal
+# background. Keys other than foreground name LaTeX environments.
+# math_colors:
+#   foreground: "#CDD6F4"
+#   tikzpicture: "#89B4FA"
+
+# Size of rendered math relative to the terminal font
+# math_scale: 1.0
+
+# Seconds a single LaTeX compile may run before it is killed (0 for no limit)
+# render_timeout: 10
+`
+
+// DefaultSettings returns the settings used when no config file is present.
+func DefaultSettings() Settings {
+	return Settings{
+		GraphicsProtocol: "auto",
+		KittyTransfer:    "auto",
+		Renderer:         "auto",
+		CacheMaxMB:       500,
+		MathScale:        1,
+		RenderTimeout:    10,
+	}
+}
+
+// CacheMaxBytes returns the cache size cap in bytes.
+func (s Settings) CacheMaxBytes() int64 {
+	return int64(s.CacheMaxMB) << 20
+}
+
+// RenderTimeoutDuration returns the render timeout as a duration.
+func (s Settings) RenderTimeoutDuration() time.Duration {
+	return time.Duration(s.RenderTimeout) * time.Second
+}
+
+// LoadSettings reads and parses config.yaml from the config directory.
+// Fields missing from the file keep their default values.
+func LoadSettings(configDir string) (Settings, error) {
+	settings := DefaultSettings()
+	path := filepath.Join(configDir, "config.yaml")
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return settings, nil
+		}
+		return settings, err
+	}
+
+	if err := yaml.Unmarshal(data, &settings); err != nil {
+		return settings, err
+	}
+
+	return settings, nil
+}
@@ -4,14 +4,18 @@ package config
 
 import (
 	"bufio"
+	"context"
 	"crypto/sha256"
+	"errors"
 	"fmt"
 	"os"
 	"os/exec"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/RNAV2019/quasar/internal/git"
+	"github.com/RNAV2019/quasar/internal/latex"
 )
 
 // Config holds the resolved directory paths for the application.
@@ -19,6 +23,7 @@ type Config struct {
 	CacheDir  string
 	NotesDir  string
 	ConfigDir string
+	Settings  Settings
 }
 
 // SetupEnvironment creates the cache and notes directories and returns the resolved Config.
@@ -50,6 +55,19 @@ func SetupEnvironment() (*Config, error) {
 		}
 	}
 
+	// Create default config.yaml if it doesn't exist
+	settingsPath := filepath.Join(configPath, "config.yaml")
+	if _, err := os.Stat(settingsPath); os.IsNotExist(err) {
+		if err := os.WriteFile(settingsPath, []byte(defaultSettingsYAML), 0644); err != nil {
+			return nil, fmt.Errorf("Failed to create config.yaml: %w", err)
+		}
+	}
+
+	settings, err := LoadSettings(configPath)
+	if err != nil {
+		return nil, fmt.Errorf("Failed to load config.yaml: %w", err)
+	}
+
 	// Check if notes directory exists - if not, this is first run
 	isFirstRun := false
 	if _, err := os.Stat(notesPath); os.IsNotExist(err) {
@@ -65,6 +83,7 @@ func SetupEnvironment() (*Config, error) {
 		CacheDir:  cachePath,
 		NotesDir:  notesPath,
 		ConfigDir: configPath,
+		Settings:  settings,
 	}
 
 	// Initialize Git on first run
@@ -139,13 +158,14 @@ func readInputLine() string {
 	return strings.TrimSuffix(line, "\n")
 }
 
-// NeedsLatexSetup reports whether the LaTeX format files need to be rebuilt.
-func (c *Config) NeedsLatexSetup() bool {
-	for _, name := range []string{"quasar-math-multi", "quasar-math-inline"} {
+// NeedsLatexSetup reports whether the LaTeX format files for preamble need
+// to be rebuilt.
+func (c *Config) NeedsLatexSetup(preamble string) bool {
+	for name, content := range latexPreambles(preamble) {
 		fmtPath := filepath.Join(c.CacheDir, name+".fmt")
 		stampPath := filepath.Join(c.CacheDir, name+".sha256")
 
-		sum := fmt.Sprintf("%x", sha256.Sum256([]byte(latexPreambles()[name])))
+		sum := fmt.Sprintf("%x", sha256.Sum256([]byte(content)))
 		if existing, err := os.ReadFile(stampPath); err != nil || string(existing) != sum {
 			return true
 		}
@@ -156,12 +176,20 @@ func (c *Config) NeedsLatexSetup() bool {
 	return false
 }
 
-// InitLatexFormats builds and caches the LaTeX format files used for math compilation.
-func (c *Config) InitLatexFormats() error {
-	return initLatexFormat(c.CacheDir)
+// InitLatexFormats builds and caches the LaTeX format files used for math
+// compilation, with preamble added after the built-in packages.
+func (c *Config) InitLatexFormats(preamble string) error {
+	return initLatexFormat(c.CacheDir, preamble)
 }
 
-func latexPreambles() map[string]string {
+// latexPreambles returns the format sources keyed by job name. The user
+// preamble is spliced in before \dump so its packages are precompiled too.
+func latexPreambles(preamble string) map[string]string {
+	userPreamble := strings.TrimSpace(preamble)
+	if userPreamble != "" {
+		userPreamble += "\n"
+	}
+
 	basePreambleTop := `\let\originaldump\dump
 \let\dump\relax
 \input latex.ltx
@@ -178,7 +206,7 @@ func latexPreambles() map[string]string {
 \usetikzlibrary{automata,positioning,arrows,calc,shapes,decorations.pathmorphing}
 \usepackage{pgfplots}
 \pgfplotsset{compat=1.18}
-\pagestyle{empty}
+` + userPreamble + `\pagestyle{empty}
 \setlength{\abovedisplayskip}{0pt}
 \setlength{\belowdisplayskip}{0pt}
 \setlength{\abovedisplayshortskip}{0pt}
@@ -186,7 +214,10 @@ func latexPreambles() map[string]string {
 \dump
 `
 
-	inlinePreamble := basePreambleTop + `\documentclass[preview,border=1pt]{standalone}
+	// Inline math is typeset in preview environments, each cropped to its
+	// own page with its baseline recorded, so an expression comes out the
+	// same whether it is compiled alone or in a batch.
+	inlinePreamble := basePreambleTop + `\documentclass{article}
 \usepackage[T1]{fontenc}
 \usepackage{lmodern}
 \usepackage{amsmath}
@@ -195,17 +226,39 @@ func latexPreambles() map[string]string {
 \usetikzlibrary{automata,positioning,arrows,calc,shapes,decorations.pathmorphing}
 \usepackage{pgfplots}
 \pgfplotsset{compat=1.18}
+` + userPreamble + `\usepackage[active,tightpage]{preview}
+\pagestyle{empty}
 \dump
+`
+
+	// PDF output must be selected before tikz loads so pgf picks its pdftex
+	// driver; the document matches the one the PDF pipeline writes.
+	tikzPreamble := basePreambleTop + `\pdfoutput=1
+\documentclass[border=2pt]{standalone}
+\usepackage[T1]{fontenc}
+\usepackage{lmodern}
+\usepackage{amsmath}
+\usepackage{amssymb}
+\usepackage{tikz}
+\usetikzlibrary{automata,positioning,arrows,calc,shapes,decorations.pathmorphing}
+\usepackage{pgfplots}
+\pgfplotsset{compat=1.18}
+` + userPreamble + `\dump
 `
 
 	return map[string]string{
-		"quasar-math-multi":  multiPreamble,
-		"quasar-math-inline": inlinePreamble,
+		latex.FormatName(latex.MultiFormat, preamble):  multiPreamble,
+		latex.FormatName(latex.InlineFormat, preamble): inlinePreamble,
+		latex.FormatName(latex.TikZFormat, preamble):   tikzPreamble,
 	}
 }
 
-func initLatexFormat(cacheDir string) error {
-	formats := latexPreambles()
+// formatTimeout is how long building one format file may take. Loading
+// tikz and pgfplots is slow, so it is far longer than the render timeout.
+const formatTimeout = 2 * time.Minute
+
+func initLatexFormat(cacheDir, preamble string) error {
+	formats := latexPreambles(preamble)
 
 	tmpDir, err := os.MkdirTemp(cacheDir, "fmt-*")
 	if err != nil {
@@ -230,13 +283,8 @@ func initLatexFormat(cacheDir string) error {
 			return fmt.Errorf("failed to write preamble for %s: %w", jobName, err)
 		}
 
-		cmd := exec.Command("pdftex", "-ini", "-etex", "-interaction=nonstopmode",
-			fmt.Sprintf("-output-directory=%s", tmpDir),
-			fmt.Sprintf("-jobname=%s", jobName),
-			texPath)
-
-		if output, err := cmd.CombinedOutput(); err != nil {
-			return fmt.Errorf("failed to create format %s: %w\nOutput: %s", jobName, err, string(output))
+		if err := buildFormat(tmpDir, jobName, texPath); err != nil {
+			return err
 		}
 
 		generatedFmt := filepath.Join(tmpDir, jobName+".fmt")
@@ -254,3 +302,24 @@ func initLatexFormat(cacheDir string) error {
 
 	return nil
 }
+
+// buildFormat runs pdftex in ini mode on texPath, writing jobName.fmt to
+// tmpDir. The run is killed after formatTimeout.
+func buildFormat(tmpDir, jobName, texPath string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), formatTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, "pdftex", "-ini", "-etex", "-interaction=nonstopmode", "-no-shell-escape",
+		fmt.Sprintf("-output-directory=%s", tmpDir),
+		fmt.Sprintf("-jobname=%s", jobName),
+		texPath)
+	cmd.Env = append(os.Environ(), "shell_escape=f", "openout_any=p")
+
+	output, err := cmd.CombinedOutput()
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("failed to create format %s: timed out after %s", jobName, formatTimeout)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to create format %s: %w\nOutput: %s", jobName, err, string(output))
+	}
+	return nil
+}
@@ -160,18 +160,20 @@ func (m *Model) GoToLine(lineNum int) {
 		lineNum = totalLines
 	}
 
-	// Walk through blocks to find the right BlockIdx/LineIdx
-	remaining := lineNum
-	for blockIdx, block := range m.Blocks {
-		if remaining <= len(block.Lines) {
-			m.Cursor.BlockIdx = blockIdx
-			m.Cursor.LineIdx = remaining - 1
-			m.Cursor.Col = 0
-			m.ensureCursorInView()
-			return
-		}
-		remaining -= len(block.Lines)
+	m.Cursor = m.PositionAt(lineNum - 1)
+	m.ensureCursorInView()
+}
+
+// MoveTo moves the cursor to a position and scrolls it into view.
+func (m *Model) MoveTo(pos Position) {
+	if pos.BlockIdx < 0 || pos.BlockIdx >= len(m.Blocks) || len(m.Blocks[pos.BlockIdx].Lines) == 0 {
+		return
 	}
+	lines := m.Blocks[pos.BlockIdx].Lines
+	pos.LineIdx = max(0, min(pos.LineIdx, len(lines)-1))
+	pos.Col = max(0, min(pos.Col, len(lines[pos.LineIdx])))
+	m.Cursor = pos
+	m.ensureCursorInView()
 }
 
 // MoveToStartOfLine moves cursor to the beginning of the line.
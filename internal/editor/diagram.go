@@ -0,0 +1,56 @@
+package editor
+
+import (
+	"regexp"
+	"strings"
+)
+
+// DiagramFenceClose is the line that ends a diagram block.
+const DiagramFenceClose = "```"
+
+// diagramFenceRe matches the fence that opens a Graphviz block.
+var diagramFenceRe = regexp.MustCompile("^```\\s*(dot|graphviz)\\s*$")
+
+// IsDiagramFence reports whether line opens a Graphviz diagram block.
+func IsDiagramFence(line string) bool {
+	return diagramFenceRe.MatchString(strings.TrimSpace(line))
+}
+
+// isValidDiagramBlock checks that a diagram block is enclosed by its fences.
+func isValidDiagramBlock(block Block) bool {
+	return len(block.Lines) >= 2 && IsDiagramFence(block.Lines[0]) &&
+		block.Lines[len(block.Lines)-1] == DiagramFenceClose
+}
+
+// DiagramContentBounds returns the range of a diagram block's lines passed
+// to Graphviz: the fences are excluded.
+func DiagramContentBounds(lines []string) (int, int) {
+	start, end := 0, len(lines)
+	if len(lines) > 0 && IsDiagramFence(lines[0]) {
+		start = 1
+	}
+	if end > start && lines[end-1] == DiagramFenceClose {
+		end--
+	}
+	return start, end
+}
+
+// DiagramBlockContent returns the DOT source of a diagram block.
+func DiagramBlockContent(lines []string) string {
+	start, end := DiagramContentBounds(lines)
+	return strings.Join(lines[start:end], "\n")
+}
+
+// ExtractDiagrams returns the source of every non-empty diagram block.
+func ExtractDiagrams(blocks []Block) []string {
+	var sources []string
+	for _, block := range blocks {
+		if block.Type != DiagramBlock {
+			continue
+		}
+		if content := DiagramBlockContent(block.Lines); strings.TrimSpace(content) != "" {
+			sources = append(sources, content)
+		}
+	}
+	return sources
+}
@@ -15,8 +15,8 @@ func isValidMathBlock(block Block) bool {
 
 // canMergeBlocks checks if two blocks can be safely merged without corrupting math blocks
 func canMergeBlocks(prevBlock, currentBlock Block) bool {
-	// Never merge with or into a math block - math blocks must maintain their $$ boundaries
-	if prevBlock.Type == MathBlock || currentBlock.Type == MathBlock {
+	// Never merge with or into a math or diagram block - they must maintain their delimiters
+	if prevBlock.Type != TextBlock || currentBlock.Type != TextBlock {
 		return false
 	}
 	return true
@@ -39,6 +39,10 @@ func ValidateBlocks(blocks []Block) ([]Block, bool) {
 				break
 			}
 		}
+		if blocks[i].Type == DiagramBlock && !isValidDiagramBlock(blocks[i]) {
+			needsRepair = true
+			break
+		}
 	}
 	
 	if !needsRepair {
@@ -77,6 +81,7 @@ func (m *Model) InsertChar(r rune) {
 	m.Cursor.Col++
 
 	block.IsDirty = true
+	m.edited(m.Cursor.BlockIdx)
 }
 
 // Backspace deletes the character before the cursor.
@@ -107,6 +112,7 @@ func (m *Model) Backspace() {
 			m.Cursor.LineIdx = 0
 			m.Cursor.Col = 0
 		}
+		m.restructured()
 		return
 	}
 
@@ -116,6 +122,7 @@ func (m *Model) Backspace() {
 		runes = append(runes[:m.Cursor.Col-1], runes[m.Cursor.Col:]...)
 		*line = string(runes)
 		block.IsDirty = true
+		m.edited(m.Cursor.BlockIdx)
 		m.Cursor.Col--
 	} else if m.Cursor.LineIdx > 0 {
 		currentLine := block.Lines[m.Cursor.LineIdx]
@@ -125,6 +132,7 @@ func (m *Model) Backspace() {
 		*prevLine += currentLine
 		block.Lines = append(block.Lines[:m.Cursor.LineIdx], block.Lines[m.Cursor.LineIdx+1:]...)
 		block.IsDirty = true
+		m.edited(m.Cursor.BlockIdx)
 		m.Cursor.LineIdx--
 		m.Cursor.Col = newCol
 	} else if m.Cursor.BlockIdx > 0 {
@@ -138,6 +146,7 @@ func (m *Model) Backspace() {
 		if block.Type == TextBlock && len(currentBlock.Lines) > 1 && block.Lines[0] == "" {
 			block.Lines = block.Lines[1:]
 			block.IsDirty = true
+			m.edited(m.Cursor.BlockIdx)
 			// Cursor stays at line 0, col 0
 			return
 		}
@@ -169,7 +178,9 @@ func (m *Model) Backspace() {
 			prevBlock.Lines = append(prevBlock.Lines, currentBlock.Lines...)
 		}
 		prevBlock.IsDirty = true
+		m.edited(prevBlockIndex)
 		m.Blocks = append(m.Blocks[:m.Cursor.BlockIdx], m.Blocks[m.Cursor.BlockIdx+1:]...)
+		m.restructured()
 
 		m.Cursor.BlockIdx = newCursorBlockIdx
 		m.Cursor.LineIdx = newCursorLineIdx
@@ -200,6 +211,7 @@ func (m *Model) DeleteChar() {
 		// Remove the line
 		block.Lines = append(block.Lines[:m.Cursor.LineIdx], block.Lines[m.Cursor.LineIdx+1:]...)
 		block.IsDirty = true
+		m.edited(m.Cursor.BlockIdx)
 
 		// Move cursor appropriately
 		if isLastLine {
@@ -220,6 +232,7 @@ func (m *Model) DeleteChar() {
 		runes = append(runes[:m.Cursor.Col], runes[m.Cursor.Col+1:]...)
 		*line = string(runes)
 		block.IsDirty = true
+		m.edited(m.Cursor.BlockIdx)
 	}
 }
 
@@ -227,12 +240,16 @@ func (m *Model) DeleteChar() {
 func (m *Model) InsertNewLine() {
 	block := &m.Blocks[m.Cursor.BlockIdx]
 
-	if block.Type == MathBlock {
+	if block.Type != TextBlock {
 		lineContent := block.Lines[m.Cursor.LineIdx]
 		isFirstLine := m.Cursor.LineIdx == 0
 		isLastLine := m.Cursor.LineIdx == len(block.Lines)-1
+		closing := "$$"
+		if block.Type == DiagramBlock {
+			closing = DiagramFenceClose
+		}
 
-		if isLastLine && lineContent == "$$" {
+		if isLastLine && lineContent == closing {
 			newTextBlock := Block{Type: TextBlock, Lines: []string{""}}
 
 			insertIndex := m.Cursor.BlockIdx + 1
@@ -242,16 +259,18 @@ func (m *Model) InsertNewLine() {
 				m.Blocks = append(m.Blocks, newTextBlock)
 			}
 
+			m.restructured()
 			m.Cursor.BlockIdx = insertIndex
 			m.Cursor.LineIdx = 0
 			m.Cursor.Col = 0
 			return
 		}
 
-		if isFirstLine && lineContent == "$$" {
+		if isFirstLine && block.Type == MathBlock && lineContent == "$$" {
 			block.Lines = append(block.Lines[:1], append([]string{""}, block.Lines[1:]...)...)
 			block.IsDirty = true
 			block.HasError = false
+			m.edited(m.Cursor.BlockIdx)
 			m.Cursor.LineIdx = 1
 			m.Cursor.Col = 0
 			return
@@ -270,12 +289,19 @@ func (m *Model) InsertNewLine() {
 
 	nextLineIdx := m.Cursor.LineIdx + 1
 	block.Lines = append(block.Lines[:nextLineIdx], append([]string{right}, block.Lines[nextLineIdx:]...)...)
+	m.edited(m.Cursor.BlockIdx)
 
 	m.Cursor.LineIdx++
 	m.Cursor.Col = 0
 	m.ensureCursorInView()
 }
 
+// SetLine replaces the text of a line.
+func (m *Model) SetLine(blockIdx, lineIdx int, line string) {
+	m.Blocks[blockIdx].Lines[lineIdx] = line
+	m.edited(blockIdx)
+}
+
 // PasteLine inserts a line below the current line with the given content.
 func (m *Model) PasteLine(content string) {
 	if m.Cursor.BlockIdx >= len(m.Blocks) {
@@ -288,6 +314,7 @@ func (m *Model) PasteLine(content string) {
 
 	block.Lines = append(block.Lines[:lineIdx], append([]string{content}, block.Lines[lineIdx:]...)...)
 	block.IsDirty = true
+	m.edited(m.Cursor.BlockIdx)
 	m.Cursor.LineIdx = lineIdx
 	m.Cursor.Col = 0
 	m.ensureCursorInView()
@@ -329,5 +356,6 @@ func (m *Model) PasteText(text string) {
 	}
 
 	block.IsDirty = true
+	m.edited(m.Cursor.BlockIdx)
 	m.ensureCursorInView()
 }
@@ -48,10 +48,7 @@ func (m *Model) ensureCursorInView() {
 		return
 	}
 
-	totalLines := 0
-	for _, block := range m.Blocks {
-		totalLines += len(block.Lines)
-	}
+	totalLines := m.GetLineCount()
 
 	m.Offset.Col = 0
 
@@ -68,17 +65,8 @@ func (m *Model) ensureCursorInView() {
 		return
 	}
 
-	cursorAbsLine := 0
-	for i := 0; i < m.Cursor.BlockIdx && i < len(m.Blocks); i++ {
-		cursorAbsLine += len(m.Blocks[i].Lines)
-	}
-	cursorAbsLine += m.Cursor.LineIdx
-
-	offsetAbsLine := 0
-	for i := 0; i < m.Offset.BlockIdx && i < len(m.Blocks); i++ {
-		offsetAbsLine += len(m.Blocks[i].Lines)
-	}
-	offsetAbsLine += m.Offset.LineIdx
+	cursorAbsLine := m.AbsLine(m.Cursor)
+	offsetAbsLine := m.AbsLine(m.Offset)
 
 	if cursorAbsLine < offsetAbsLine {
 		m.Offset.BlockIdx = m.Cursor.BlockIdx
@@ -97,22 +85,7 @@ func (m *Model) ensureCursorInView() {
 		if targetAbsLine > maxScroll {
 			targetAbsLine = maxScroll
 		}
-		m.Offset.BlockIdx = 0
-		m.Offset.LineIdx = 0
-		currentLine := 0
-		for i := range m.Blocks {
-			for j := range m.Blocks[i].Lines {
-				if currentLine >= targetAbsLine {
-					m.Offset.BlockIdx = i
-					m.Offset.LineIdx = j
-					break
-				}
-				currentLine++
-			}
-			if currentLine >= targetAbsLine {
-				break
-			}
-		}
+		m.Offset = m.PositionAt(targetAbsLine)
 	}
 }
 
@@ -127,20 +100,13 @@ func (m *Model) ViewLines() []string {
 
 // MaxLineLength returns the maximum allowed line length based on viewport width.
 func (m *Model) MaxLineLength() int {
-	totalLines := 0
-	for _, block := range m.Blocks {
-		totalLines += len(block.Lines)
-	}
-	gutterWidth := len(strconv.Itoa(totalLines))
+	gutterWidth := len(strconv.Itoa(m.GetLineCount()))
 	maxLen := m.Width - 5 - gutterWidth - 2
 	return max(maxLen, 20)
 }
 
 // GetLineCount returns the total number of lines across all blocks.
 func (m *Model) GetLineCount() int {
-	count := 0
-	for _, block := range m.Blocks {
-		count += len(block.Lines)
-	}
-	return count
+	m.lines.sync(m.Blocks)
+	return m.lines.total()
 }
@@ -0,0 +1,132 @@
+package editor
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+)
+
+// longNote returns a note of about n lines mixing paragraphs, inline math
+// and numbered display math, like a long set of lecture notes.
+func longNote(n int) []string {
+	var lines []string
+	for i := 0; len(lines) < n; i++ {
+		lines = append(lines,
+			fmt.Sprintf("## Section %d", i),
+			"",
+			fmt.Sprintf("The map $f_%d: X \\to Y$ is continuous when $f^{-1}(U)$ is open for every open $U$.", i),
+			"Proofs follow the definitions closely, see @eq:a and \\eqref{eq:b}.",
+			"",
+			"$$",
+			"\\begin{align}",
+			fmt.Sprintf("a_%d &= \\int_0^1 x^2 \\, dx \\label{eq:s%d} \\\\", i, i),
+			"b &= \\sum_{k=1}^n k",
+			"\\end{align}",
+			"$$",
+			"",
+		)
+	}
+	return lines
+}
+
+// benchModel opens a 5,000-line note with the cursor on a line of text in
+// the middle, scrolled as far down as it would be while typing there.
+func benchModel(b *testing.B) *Model {
+	b.Helper()
+	m := CreateModelFromLines(longNote(5000))
+	m.SetSize(120, 40)
+	for i := len(m.Blocks) / 2; i < len(m.Blocks); i++ {
+		if m.Blocks[i].Type == TextBlock && len(m.Blocks[i].Lines) > 3 {
+			m.Cursor = Position{BlockIdx: i, LineIdx: 3}
+			break
+		}
+	}
+	m.ensureCursorInView()
+	return m
+}
+
+// typeChar inserts a character at the cursor, restoring the line after a
+// few words so it never reaches the maximum line length.
+func typeChar(m *Model, line string) {
+	if m.Cursor.Col > len(line)+32 {
+		m.Blocks[m.Cursor.BlockIdx].Lines[m.Cursor.LineIdx] = line
+		m.Cursor.Col = len(line)
+	}
+	m.InsertChar('x')
+}
+
+// BenchmarkKeystroke measures the editor's work for one character typed
+// into a 5,000-line note: the edit, scrolling the cursor into view and
+// reparsing the document.
+//
+// "full" repeats that work the way it was done before the line index and
+// revisions: line positions by summing the blocks above them and a parse of
+// every block. "incremental" is the current path.
+func BenchmarkKeystroke(b *testing.B) {
+	b.Run("full", func(b *testing.B) {
+		m := benchModel(b)
+		line := m.Blocks[m.Cursor.BlockIdx].Lines[m.Cursor.LineIdx]
+		m.Cursor.Col = len(line)
+		for b.Loop() {
+			typeChar(m, line)
+			// MaxLineLength and ensureCursorInView each counted every line,
+			// then ensureCursorInView summed the blocks above the cursor
+			// and the viewport.
+			_ = sumLines(m.Blocks, len(m.Blocks))
+			_ = sumLines(m.Blocks, len(m.Blocks))
+			_ = sumLines(m.Blocks, m.Cursor.BlockIdx) + m.Cursor.LineIdx
+			_ = sumLines(m.Blocks, m.Offset.BlockIdx) + m.Offset.LineIdx
+			_ = ParseDocument(m.Blocks)
+		}
+	})
+
+	b.Run("incremental", func(b *testing.B) {
+		m := benchModel(b)
+		line := m.Blocks[m.Cursor.BlockIdx].Lines[m.Cursor.LineIdx]
+		m.Cursor.Col = len(line)
+		doc := ParseDocument(m.Blocks)
+		for b.Loop() {
+			typeChar(m, line)
+			m.ensureCursorInView()
+			doc = ReparseDocument(doc, m.Blocks)
+		}
+	})
+}
+
+// sumLines counts the lines of the first n blocks.
+func sumLines(blocks []Block, n int) int {
+	count := 0
+	for _, block := range blocks[:n] {
+		count += len(block.Lines)
+	}
+	return count
+}
+
+func TestReparseDocumentMatchesParse(t *testing.T) {
+	m := CreateModelFromLines(longNote(200))
+	m.SetSize(120, 40)
+	doc := ParseDocument(m.Blocks)
+
+	m.Cursor = Position{BlockIdx: len(m.Blocks) / 2}
+	for _, r := range "$x$ and @eq:s3 " {
+		m.InsertChar(r)
+		doc = ReparseDocument(doc, m.Blocks)
+	}
+
+	want := ParseDocument(m.Blocks)
+	if len(doc.Blocks) != len(want.Blocks) || len(doc.Equations) != len(want.Equations) {
+		t.Fatalf("reparse has %d blocks and %d equations, want %d and %d",
+			len(doc.Blocks), len(doc.Equations), len(want.Blocks), len(want.Equations))
+	}
+	for i := range want.Blocks {
+		if got, want := doc.Blocks[i].RawLines, want.Blocks[i].RawLines; !slices.Equal(got, want) {
+			t.Errorf("block %d lines = %q, want %q", i, got, want)
+		}
+		if got, want := len(doc.Blocks[i].InlineMath), len(want.Blocks[i].InlineMath); got != want {
+			t.Errorf("block %d has %d inline math regions, want %d", i, got, want)
+		}
+	}
+	if got, want := m.GetLineCount(), sumLines(m.Blocks, len(m.Blocks)); got != want {
+		t.Errorf("GetLineCount() = %d, want %d", got, want)
+	}
+}
@@ -22,7 +22,9 @@ func LoadFromFile(path string) (*Model, error) {
 // CreateModelFromLines creates a new Model from a slice of lines, parsing them into blocks.
 func CreateModelFromLines(lines []string) *Model {
 	if len(lines) == 0 {
-		return &Model{Blocks: []Block{{Type: TextBlock, Lines: []string{""}}}}
+		m := &Model{Blocks: []Block{{Type: TextBlock, Lines: []string{""}}}}
+		m.restructured()
+		return m
 	}
 
 	blocks := []Block{}
@@ -43,6 +45,19 @@ func CreateModelFromLines(lines []string) *Model {
 			blocks = append(blocks, currentBlock)
 			currentBlock = Block{Type: TextBlock, Lines: []string{}}
 			skipLeadingEmpty = true
+		} else if IsDiagramFence(line) && currentBlock.Type == TextBlock {
+			for len(currentBlock.Lines) > 0 && currentBlock.Lines[len(currentBlock.Lines)-1] == "" {
+				currentBlock.Lines = currentBlock.Lines[:len(currentBlock.Lines)-1]
+			}
+			if len(currentBlock.Lines) > 0 {
+				blocks = append(blocks, currentBlock)
+			}
+			currentBlock = Block{Type: DiagramBlock, Lines: []string{line}}
+		} else if line == DiagramFenceClose && currentBlock.Type == DiagramBlock {
+			currentBlock.Lines = append(currentBlock.Lines, line)
+			blocks = append(blocks, currentBlock)
+			currentBlock = Block{Type: TextBlock, Lines: []string{}}
+			skipLeadingEmpty = true
 		} else {
 			if skipLeadingEmpty && line == "" {
 				continue
@@ -63,5 +78,7 @@ func CreateModelFromLines(lines []string) *Model {
 		blocks = []Block{{Type: TextBlock, Lines: []string{""}}}
 	}
 
-	return &Model{Blocks: blocks}
+	m := &Model{Blocks: blocks}
+	m.restructured()
+	return m
 }
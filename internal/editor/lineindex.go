@@ -0,0 +1,120 @@
+package editor
+
+// lineIndex maps between absolute line numbers and block positions in
+// O(log n) time with a Fenwick tree over the line counts of the blocks.
+// Edits usually change the line count of one block, which is an O(log n)
+// update; only changes to the blocks themselves rebuild it.
+type lineIndex struct {
+	tree   []int // Fenwick tree of block line counts, 1-based
+	counts []int // Line count of each block as indexed, nil when invalid
+	base   *Block
+	marked []int // Blocks edited since the last sync
+}
+
+// sync brings the index up to date with blocks. An invalidated index, or
+// blocks replaced without invalidating it, cause a rebuild; otherwise the
+// blocks marked as edited since the last call are updated.
+func (x *lineIndex) sync(blocks []Block) {
+	if x.counts == nil || len(blocks) != len(x.counts) || len(blocks) > 0 && &blocks[0] != x.base {
+		x.build(blocks)
+		return
+	}
+	for _, i := range x.marked {
+		if i < len(blocks) && x.counts[i] != len(blocks[i].Lines) {
+			x.add(i, len(blocks[i].Lines)-x.counts[i])
+		}
+	}
+	x.marked = x.marked[:0]
+}
+
+// mark records that the line count of block i may have changed.
+func (x *lineIndex) mark(i int) {
+	x.marked = append(x.marked, i)
+}
+
+// invalidate forces the next sync to rebuild the index.
+func (x *lineIndex) invalidate() {
+	x.counts = nil
+}
+
+func (x *lineIndex) build(blocks []Block) {
+	x.tree = make([]int, len(blocks)+1)
+	x.counts = make([]int, len(blocks))
+	x.base, x.marked = nil, x.marked[:0]
+	if len(blocks) > 0 {
+		x.base = &blocks[0]
+	}
+	for i, block := range blocks {
+		x.counts[i] = len(block.Lines)
+		x.tree[i+1] += x.counts[i]
+		if parent := (i + 1) + (i+1)&-(i+1); parent < len(x.tree) {
+			x.tree[parent] += x.tree[i+1]
+		}
+	}
+}
+
+// add changes the line count of block i by delta.
+func (x *lineIndex) add(i, delta int) {
+	x.counts[i] += delta
+	for j := i + 1; j < len(x.tree); j += j & -j {
+		x.tree[j] += delta
+	}
+}
+
+// start returns the absolute line of the first line of block i.
+func (x *lineIndex) start(i int) int {
+	sum := 0
+	for j := min(i, len(x.counts)); j > 0; j -= j & -j {
+		sum += x.tree[j]
+	}
+	return sum
+}
+
+// total returns the number of lines in all blocks.
+func (x *lineIndex) total() int {
+	return x.start(len(x.counts))
+}
+
+// locate returns the block containing an absolute line and the line within
+// it, clamped to the document.
+func (x *lineIndex) locate(abs int) (int, int) {
+	n := len(x.counts)
+	if n == 0 {
+		return 0, 0
+	}
+	if abs >= x.total() {
+		last := n - 1
+		for last > 0 && x.counts[last] == 0 {
+			last--
+		}
+		return last, max(x.counts[last]-1, 0)
+	}
+	abs = max(abs, 0)
+	// Find the last block whose start is at or before abs.
+	pos := 0
+	step := 1
+	for step*2 <= n {
+		step *= 2
+	}
+	for ; step > 0; step /= 2 {
+		if next := pos + step; next <= n && x.tree[next] <= abs {
+			pos = next
+			abs -= x.tree[next]
+		}
+	}
+	return pos, abs
+}
+
+// AbsLine returns the absolute, 0-based line number of a position.
+func (m *Model) AbsLine(pos Position) int {
+	m.lines.sync(m.Blocks)
+	return m.lines.start(pos.BlockIdx) + pos.LineIdx
+}
+
+// PositionAt returns the start of the line with the given absolute, 0-based
+// line number, clamped to the document.
+func (m *Model) PositionAt(abs int) Position {
+	m.lines.sync(m.Blocks)
+	blockIdx, lineIdx := m.lines.locate(abs)
+	return Position{BlockIdx: blockIdx, LineIdx: lineIdx}
+}
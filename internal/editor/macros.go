@@ -0,0 +1,73 @@
+package editor
+
+import (
+	"fmt"
+	"regexp"
+	"slices"
+	"strings"
+)
+
+// MacroBlockMarker is the first line of a math block that holds macro
+// definitions for the note instead of math to display.
+const MacroBlockMarker = "% macros"
+
+var macroArgRe = regexp.MustCompile(`#([1-9])`)
+
+// IsMacroBlock reports whether a math block's content starts with
+// MacroBlockMarker.
+func IsMacroBlock(lines []string) bool {
+	start, end := MathContentBounds(lines)
+	return start < end && strings.TrimSpace(lines[start]) == MacroBlockMarker
+}
+
+// MacroDefinitions converts a front matter macros map into LaTeX. The number
+// of arguments is taken from the highest #n in each body, and existing
+// commands are redefined rather than reported as errors.
+func MacroDefinitions(macros map[string]string) string {
+	names := make([]string, 0, len(macros))
+	for name := range macros {
+		names = append(names, name)
+	}
+	slices.Sort(names)
+
+	var b strings.Builder
+	for _, name := range names {
+		body := macros[name]
+		cmd := "\\" + strings.TrimPrefix(strings.TrimSpace(name), "\\")
+		args := 0
+		for _, m := range macroArgRe.FindAllStringSubmatch(body, -1) {
+			args = max(args, int(m[1][0]-'0'))
+		}
+		fmt.Fprintf(&b, "\\providecommand{%s}{}\\renewcommand{%s}", cmd, cmd)
+		if args > 0 {
+			fmt.Fprintf(&b, "[%d]", args)
+		}
+		fmt.Fprintf(&b, "{%s}\n", body)
+	}
+	return b.String()
+}
+
+// NoteMacros returns the macros every expression in a note is compiled with:
+// shared, typically the notebook's macros.tex, followed by the front matter
+// macros and the content of every macro block, so later definitions win.
+func NoteMacros(blocks []Block, shared string) string {
+	parts := []string{strings.TrimSpace(shared)}
+	if len(blocks) > 0 && blocks[0].Type == TextBlock {
+		if metadata, _, err := ExtractFrontMatter(blocks[0].Lines); err == nil {
+			parts = append(parts, strings.TrimSpace(MacroDefinitions(metadata.Macros)))
+		}
+	}
+	for _, block := range blocks {
+		if block.Type == MathBlock && IsMacroBlock(block.Lines) {
+			parts = append(parts, strings.TrimSpace(MathBlockContent(block.Lines)))
+		}
+	}
+
+	var nonEmpty []string
+	for _, part := range parts {
+		if part != "" {
+			nonEmpty = append(nonEmpty, part)
+		}
+	}
+	return strings.Join(nonEmpty, "\n")
+}
@@ -0,0 +1,55 @@
+package editor
+
+import (
+	"regexp"
+	"strings"
+)
+
+// MathSpanRe matches inline math spans exactly as the UI renders them.
+var MathSpanRe = regexp.MustCompile(`\$[^\$]*\$`)
+
+// MathSource is a math expression found in a document.
+type MathSource struct {
+	Content string
+	Inline  bool
+}
+
+// MathContentBounds returns the range of a math block's lines passed to the
+// renderer: the $$ delimiters and leading blank lines are excluded.
+func MathContentBounds(lines []string) (int, int) {
+	start, end := 0, len(lines)
+	if len(lines) >= 2 && lines[0] == "$$" && lines[len(lines)-1] == "$$" {
+		start, end = 1, len(lines)-1
+	}
+	for start < end && strings.TrimSpace(lines[start]) == "" {
+		start++
+	}
+	return start, end
+}
+
+// MathBlockContent returns the LaTeX source of a math block.
+func MathBlockContent(lines []string) string {
+	start, end := MathContentBounds(lines)
+	return strings.Join(lines[start:end], "\n")
+}
+
+// ExtractMath returns every non-empty math expression in blocks, in
+// document order. Macro blocks are skipped as they are never rendered.
+func ExtractMath(blocks []Block) []MathSource {
+	var sources []MathSource
+	for _, block := range blocks {
+		switch block.Type {
+		case MathBlock:
+			if content := MathBlockContent(block.Lines); strings.TrimSpace(content) != "" && !IsMacroBlock(block.Lines) {
+				sources = append(sources, MathSource{Content: content})
+			}
+		case TextBlock:
+			for _, line := range block.Lines {
+				for _, match := range MathSpanRe.FindAllStringIndex(line, -1) {
+					sources = append(sources, MathSource{Content: line[match[0]+1 : match[1]-1], Inline: true})
+				}
+			}
+		}
+	}
+	return sources
+}
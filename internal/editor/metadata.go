@@ -10,9 +10,32 @@ import (
 
 // Metadata represents the YAML front matter.
 type Metadata struct {
-	Title  string `yaml:"title"`
-	Date   string `yaml:"date,omitempty"`
+	Title string `yaml:"title"`
+	Date  string `yaml:"date,omitempty"`
 	Tag   string `yaml:"tag,omitempty"`
+	// Macros maps command names to LaTeX bodies, e.g. R: \mathbb{R}.
+	Macros map[string]string `yaml:"macros,omitempty"`
+}
+
+// Lines returns the metadata as a front matter block, including the
+// delimiters.
+func (md *Metadata) Lines() []string {
+	lines := []string{"---"}
+	if md.Title != "" {
+		lines = append(lines, fmt.Sprintf("title: %s", md.Title))
+	}
+	if md.Date != "" {
+		lines = append(lines, fmt.Sprintf("date: %s", md.Date))
+	}
+	if md.Tag != "" {
+		lines = append(lines, fmt.Sprintf("tag: %s", md.Tag))
+	}
+	if len(md.Macros) > 0 {
+		if data, err := yaml.Marshal(map[string]map[string]string{"macros": md.Macros}); err == nil {
+			lines = append(lines, strings.Split(strings.TrimSuffix(string(data), "\n"), "\n")...)
+		}
+	}
+	return append(lines, "---")
 }
 
 // ExtractFrontMatter parses YAML front matter from markdown content.
@@ -83,8 +106,8 @@ func (m *Model) ToMarkdownContent(preserveFrontMatter []string) ([]string, error
 			}
 		}
 
-		// Add blank line before math block if previous content exists
-		if block.Type == MathBlock && len(lines) > 0 {
+		// Add blank line before math and diagram blocks if previous content exists
+		if block.Type != TextBlock && len(lines) > 0 {
 			lastLine := lines[len(lines)-1]
 			if lastLine != "" {
 				lines = append(lines, "")
@@ -93,8 +116,8 @@ func (m *Model) ToMarkdownContent(preserveFrontMatter []string) ([]string, error
 
 		lines = append(lines, content...)
 
-		// Add blank line after math block only if next block doesn't start with empty lines
-		if block.Type == MathBlock && blockIdx < len(m.Blocks)-1 {
+		// Add blank line after math and diagram blocks only if next block doesn't start with empty lines
+		if block.Type != TextBlock && blockIdx < len(m.Blocks)-1 {
 			nextBlock := m.Blocks[blockIdx+1]
 			if len(nextBlock.Lines) > 0 && nextBlock.Lines[0] != "" {
 				lines = append(lines, "")
@@ -143,27 +166,26 @@ func SanitizeFilename(title string) string {
 	// Remove or replace problematic characters
 	reg := regexp.MustCompile(`[^a-zA-Z0-9\s\-_]`)
 	clean := reg.ReplaceAllString(title, "")
-	
+
 	// Replace spaces with hyphens
 	clean = regexp.MustCompile(`\s+`).ReplaceAllString(clean, "-")
-	
+
 	// Remove multiple consecutive hyphens
 	clean = regexp.MustCompile(`-+`).ReplaceAllString(clean, "-")
-	
+
 	// Trim hyphens from start and end
 	clean = strings.Trim(clean, "-")
-	
+
 	// Ensure it's not empty
 	if clean == "" {
 		return "untitled"
 	}
-	
+
 	// Limit length
 	if len(clean) > 90 {
 		clean = clean[:90]
 		clean = strings.Trim(clean, "-")
 	}
-	
+
 	return clean
 }
-
@@ -10,6 +10,9 @@ const (
 	TextBlock BlockType = iota
 	// MathBlock indicates a block of LaTeX math delimited by $$.
 	MathBlock
+	// DiagramBlock indicates a Graphviz diagram in a ```dot or ```graphviz
+	// fenced block.
+	DiagramBlock
 )
 
 // Block represents a section of content in the editor.
@@ -19,10 +22,14 @@ type Block struct {
 	ImageID      uint32
 	ImageCols    int
 	ImageHeight  int
+	TextLines    []string // Unicode rendering used when images are unavailable
 	IsDirty      bool
 	IsLoading    bool
 	HasError     bool
 	ErrorMessage string
+	ErrorLine    int // Line within Lines that caused the error, or -1
+
+	rev uint64 // Revision of Lines, or 0 before one is assigned
 }
 
 // Position represents a cursor position in the document.
@@ -49,11 +56,13 @@ type Model struct {
 	Width     int
 	Height    int
 	Selection Selection // Current selection
+
+	lines lineIndex // Absolute line numbers of blocks
 }
 
 // NewModel initializes the editor with default values and front matter.
 func NewModel() Model {
-	return Model{
+	m := Model{
 		Blocks: []Block{
 			{
 				Type: TextBlock,
@@ -72,6 +81,8 @@ func NewModel() Model {
 		Cursor: Position{BlockIdx: 0, LineIdx: 0, Col: 0},
 		Offset: Position{BlockIdx: 0, LineIdx: 0, Col: 0},
 	}
+	m.restructured()
+	return m
 }
 
 // SetSize updates the viewport dimensions.
@@ -0,0 +1,299 @@
+package editor
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Equation is a numbered row of a display math environment.
+type Equation struct {
+	Tag      string // Number, or the text of an explicit \tag
+	Label    string // Argument of the row's \label, if any
+	BlockIdx int
+	LineIdx  int // Line of the block holding the label, or the row's first line
+}
+
+var (
+	numberedEnvRe = regexp.MustCompile(`\\(begin|end)\{(equation|align|gather|multline|flalign|alignat|eqnarray)\}`)
+	labelRe       = regexp.MustCompile(`\\label\{([^}]*)\}`)
+	tagRe         = regexp.MustCompile(`\\tag\*?\{([^}]*)\}`)
+	noNumberRe    = regexp.MustCompile(`\\(nonumber|notag)\b`)
+	texRefRe      = regexp.MustCompile(`\\(eq)?ref\{([^}]*)\}`)
+	atRefRe       = regexp.MustCompile(`(^|[^\w@])@([A-Za-z][\w:.-]*\w)`)
+)
+
+// numberedRow is a row of a numbered environment in a math block, found
+// when the block is parsed and numbered with the rest of the document.
+type numberedRow struct {
+	tag     string // Text of an explicit \tag
+	tagged  bool   // Whether the row has a \tag rather than the next number
+	label   string // Argument of the row's \label, if any
+	lineIdx int    // Line of the block holding the label, or the row's first line
+}
+
+// numberEquations assigns sequential numbers to the rows of numbered
+// environments across all math blocks, the way LaTeX would if the note were
+// a single document.
+func numberEquations(blocks []ParsedBlock) []Equation {
+	var equations []Equation
+	next := 1
+	for blockIdx, block := range blocks {
+		for _, row := range block.rows {
+			eq := Equation{Tag: row.tag, Label: row.label, BlockIdx: blockIdx, LineIdx: row.lineIdx}
+			if !row.tagged {
+				eq.Tag = strconv.Itoa(next)
+				next++
+			}
+			equations = append(equations, eq)
+		}
+	}
+	return equations
+}
+
+// numberedRows finds the rows of the numbered environments in the lines of
+// a math block.
+func numberedRows(lines []string) []numberedRow {
+	if IsMacroBlock(lines) {
+		return nil
+	}
+	start, _ := MathContentBounds(lines)
+	content := MathBlockContent(lines)
+	lineOf := func(pos int) int {
+		return start + strings.Count(content[:pos], "\n")
+	}
+
+	var numbered []numberedRow
+	for _, env := range numberedEnvs(content) {
+		rows := [][2]int{{env[0], env[1]}}
+		if name := content[env[2]:env[3]]; name != "equation" && name != "multline" {
+			rows = splitRows(content, env[0], env[1])
+		}
+		for i, row := range rows {
+			text := content[row[0]:row[1]]
+			if i == len(rows)-1 && len(rows) > 1 && strings.TrimSpace(text) == "" {
+				break // trailing \\ does not start a row
+			}
+			r := numberedRow{lineIdx: lineOf(row[0] + len(text) - len(strings.TrimLeft(text, " \t\n")))}
+			switch m := tagRe.FindStringSubmatch(text); {
+			case m != nil:
+				r.tag, r.tagged = m[1], true
+			case noNumberRe.MatchString(text):
+				continue
+			}
+			if m := labelRe.FindStringSubmatchIndex(text); m != nil {
+				r.label = text[m[2]:m[3]]
+				r.lineIdx = lineOf(row[0] + m[0])
+			}
+			numbered = append(numbered, r)
+		}
+	}
+	return numbered
+}
+
+// numberedEnvs returns the body range and name range of every numbered
+// environment in content as {bodyStart, bodyEnd, nameStart, nameEnd}.
+func numberedEnvs(content string) [][4]int {
+	var envs [][4]int
+	matches := numberedEnvRe.FindAllStringSubmatchIndex(content, -1)
+	for i := 0; i < len(matches); i++ {
+		m := matches[i]
+		if content[m[2]:m[3]] != "begin" {
+			continue
+		}
+		name := content[m[4]:m[5]]
+		for j := i + 1; j < len(matches); j++ {
+			e := matches[j]
+			if content[e[2]:e[3]] == "end" && content[e[4]:e[5]] == name {
+				envs = append(envs, [4]int{m[1], e[0], m[4], m[5]})
+				i = j
+				break
+			}
+		}
+	}
+	return envs
+}
+
+// splitRows splits content[start:end] at the \\ row separators that are not
+// nested inside braces or inner environments such as matrices.
+func splitRows(content string, start, end int) [][2]int {
+	var rows [][2]int
+	depth, rowStart := 0, start
+	for i := start; i < end; i++ {
+		switch {
+		case strings.HasPrefix(content[i:end], `\\`):
+			if depth == 0 {
+				rows = append(rows, [2]int{rowStart, i})
+				rowStart = i + 2
+			}
+			i++
+		case strings.HasPrefix(content[i:end], `\begin{`):
+			depth++
+			i += len(`\begin`)
+			i += max(strings.IndexByte(content[i:end], '}'), 0)
+		case strings.HasPrefix(content[i:end], `\end{`):
+			depth--
+			i += len(`\end`)
+			i += max(strings.IndexByte(content[i:end], '}'), 0)
+		case content[i] == '\\':
+			i++ // escaped character such as \{
+		case content[i] == '{':
+			depth++
+		case content[i] == '}':
+			depth--
+		}
+	}
+	return append(rows, [2]int{rowStart, end})
+}
+
+// Equation returns the equation with the given label.
+func (d *Document) Equation(label string) (Equation, bool) {
+	if d == nil {
+		return Equation{}, false
+	}
+	for _, eq := range d.Equations {
+		if eq.Label != "" && eq.Label == label {
+			return eq, true
+		}
+	}
+	return Equation{}, false
+}
+
+// EquationTag returns the tag displayed beside a math block: "(n)" for a
+// single number and "(n)–(m)" for a block with several numbered rows. The
+// block is one image with no record of where its rows fall, so the rows of
+// an align share the range rather than each showing its own number.
+func (d *Document) EquationTag(blockIdx int) string {
+	if d == nil {
+		return ""
+	}
+	var tags []string
+	for _, eq := range d.Equations {
+		if eq.BlockIdx == blockIdx {
+			tags = append(tags, eq.Tag)
+		}
+	}
+	switch len(tags) {
+	case 0:
+		return ""
+	case 1:
+		return "(" + tags[0] + ")"
+	default:
+		return fmt.Sprintf("(%s)–(%s)", tags[0], tags[len(tags)-1])
+	}
+}
+
+// SameNumbering reports whether every label resolves to the same tag in
+// both documents, so that references need not be rendered again.
+func (d *Document) SameNumbering(other *Document) bool {
+	labels := func(doc *Document) map[string]string {
+		tags := make(map[string]string)
+		if doc != nil {
+			for _, eq := range doc.Equations {
+				if eq.Label != "" {
+					tags[eq.Label] = eq.Tag
+				}
+			}
+		}
+		return tags
+	}
+	a, b := labels(d), labels(other)
+	if len(a) != len(b) {
+		return false
+	}
+	for label, tag := range a {
+		if b[label] != tag {
+			return false
+		}
+	}
+	return true
+}
+
+// MathSource returns the LaTeX rendered for a math expression. Numbered
+// environments are typeset unnumbered and without their \tag, as each
+// expression is compiled on its own and the numbers are drawn by the editor,
+// and references to labels in the note are replaced by their numbers.
+func (d *Document) MathSource(content string) string {
+	content = stripTags(content)
+	content = numberedEnvRe.ReplaceAllString(content, `\$1{$2*}`)
+	content = labelRe.ReplaceAllString(content, "")
+	return texRefRe.ReplaceAllStringFunc(content, func(ref string) string {
+		m := texRefRe.FindStringSubmatch(ref)
+		eq, ok := d.Equation(m[2])
+		if !ok {
+			return ref
+		}
+		if m[1] != "" {
+			return `\text{(` + eq.Tag + `)}`
+		}
+		return `\text{` + eq.Tag + `}`
+	})
+}
+
+// stripTags removes the \tag commands inside numbered environments, whose
+// tags the editor draws. Tags in starred environments are left to LaTeX.
+func stripTags(content string) string {
+	var b strings.Builder
+	last := 0
+	for _, env := range numberedEnvs(content) {
+		b.WriteString(content[last:env[0]])
+		b.WriteString(tagRe.ReplaceAllString(content[env[0]:env[1]], ""))
+		last = env[1]
+	}
+	b.WriteString(content[last:])
+	return b.String()
+}
+
+// ResolveRefs replaces the references in a line of text with equation
+// numbers: \ref{x} and @x become the number and \eqref{x} the number in
+// parentheses. Unknown \ref labels read "??" as in LaTeX; @ text that names
+// no label, such as an email address, is left alone.
+func (d *Document) ResolveRefs(text string) string {
+	if !strings.ContainsAny(text, `\@`) {
+		return text
+	}
+	text = texRefRe.ReplaceAllStringFunc(text, func(ref string) string {
+		m := texRefRe.FindStringSubmatch(ref)
+		tag := "??"
+		if eq, ok := d.Equation(m[2]); ok {
+			tag = eq.Tag
+		}
+		if m[1] != "" {
+			return "(" + tag + ")"
+		}
+		return tag
+	})
+	return atRefRe.ReplaceAllStringFunc(text, func(ref string) string {
+		m := atRefRe.FindStringSubmatch(ref)
+		if eq, ok := d.Equation(m[2]); ok {
+			return m[1] + eq.Tag
+		}
+		return ref
+	})
+}
+
+// HasRefs reports whether any line contains an equation reference.
+func HasRefs(lines []string) bool {
+	for _, line := range lines {
+		if texRefRe.MatchString(line) || atRefRe.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// RefAt returns the label of the reference at column col of line.
+func RefAt(line string, col int) (string, bool) {
+	for _, m := range texRefRe.FindAllStringSubmatchIndex(line, -1) {
+		if col >= m[0] && col < m[1] {
+			return line[m[4]:m[5]], true
+		}
+	}
+	for _, m := range atRefRe.FindAllStringSubmatchIndex(line, -1) {
+		if col >= m[3] && col < m[1] {
+			return line[m[4]:m[5]], true
+		}
+	}
+	return "", false
+}
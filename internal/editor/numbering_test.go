@@ -0,0 +1,54 @@
+package editor
+
+import "testing"
+
+func TestMathSource(t *testing.T) {
+	doc := ParseDocument([]Block{
+		{Type: MathBlock, Lines: []string{"$$", `\begin{equation}\label{eq:a} a = b\end{equation}`, "$$"}},
+	})
+	tests := []struct {
+		name, content, want string
+	}{
+		{
+			name:    "numbered",
+			content: `\begin{equation}\label{eq:x} x = 1\end{equation}`,
+			want:    `\begin{equation*} x = 1\end{equation*}`,
+		},
+		{
+			name:    "tagged rows",
+			content: `\begin{align} x &= 1 \tag{A}\\ y &= 2 \tag*{B}\end{align}`,
+			want:    `\begin{align*} x &= 1 \\ y &= 2 \end{align*}`,
+		},
+		{
+			name:    "starred tag kept",
+			content: `\begin{equation*} x = 1 \tag{A}\end{equation*}`,
+			want:    `\begin{equation*} x = 1 \tag{A}\end{equation*}`,
+		},
+		{
+			name:    "references",
+			content: `\ref{eq:a} + \eqref{eq:a} + \ref{eq:none}`,
+			want:    `\text{1} + \text{(1)} + \ref{eq:none}`,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := doc.MathSource(tt.content); got != tt.want {
+				t.Errorf("MathSource(%q) = %q, want %q", tt.content, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEquationTagRange(t *testing.T) {
+	doc := ParseDocument([]Block{
+		{Type: MathBlock, Lines: []string{"$$", `\begin{equation} a \end{equation}`, "$$"}},
+		{Type: TextBlock, Lines: []string{"text"}},
+		{Type: MathBlock, Lines: []string{"$$", `\begin{align}`, `x &= 1 \\`, `y &= 2 \nonumber \\`, `z &= 3 \tag{T}`, `\end{align}`, "$$"}},
+	})
+	if got := doc.EquationTag(0); got != "(1)" {
+		t.Errorf("EquationTag(0) = %q, want (1)", got)
+	}
+	if got := doc.EquationTag(2); got != "(2)–(T)" {
+		t.Errorf("EquationTag(2) = %q, want (2)–(T)", got)
+	}
+}
@@ -20,12 +20,16 @@ type ParsedBlock struct {
 	FrontMatterEnd  int             // Line index where content starts (after ---)
 	InlineMath      []InlineMathRegion // Inline math regions in content lines
 	GlamourContent  string          // Content ready for glamour (stripped front matter, cleaned)
+
+	rev  uint64        // Revision of the block lines parsed
+	rows []numberedRow // Numbered rows of a math block
 }
 
 // Document represents a fully parsed document.
 type Document struct {
 	Blocks         []ParsedBlock
 	GlobalMetadata *Metadata // YAML front matter (if present)
+	Equations      []Equation // Numbered equations in document order
 }
 
 // inline math regex - matches $...$ but not $$ (which is block math)
@@ -42,10 +46,54 @@ func ParseDocument(blocks []Block) *Document {
 	for i, block := range blocks {
 		doc.Blocks[i] = ParseBlock(block)
 	}
+	doc.Equations = numberEquations(doc.Blocks)
 
 	return doc
 }
 
+// ReparseDocument parses blocks into a Document, reusing the parsed blocks
+// of prev with the same revision so that only edited blocks are parsed
+// again. Blocks inserted or removed before an edit are matched by shifting
+// prev's blocks by the difference in block count. A nil prev parses every
+// block. Equations are numbered from the rows found when blocks were
+// parsed, so numbering does not rescan the math.
+func ReparseDocument(prev *Document, blocks []Block) *Document {
+	if prev == nil {
+		return ParseDocument(blocks)
+	}
+	doc := &Document{
+		Blocks:         make([]ParsedBlock, len(blocks)),
+		GlobalMetadata: nil,
+	}
+
+	shift := len(prev.Blocks) - len(blocks)
+	for i, block := range blocks {
+		if pb, ok := prev.unchangedBlock(i, block); ok {
+			doc.Blocks[i] = pb
+		} else if pb, ok := prev.unchangedBlock(i+shift, block); ok {
+			doc.Blocks[i] = pb
+		} else {
+			doc.Blocks[i] = ParseBlock(block)
+		}
+	}
+	doc.Equations = numberEquations(doc.Blocks)
+
+	return doc
+}
+
+// unchangedBlock returns the parsed block at index i when it was parsed
+// from the same revision of block. Blocks without a revision are parsed.
+func (d *Document) unchangedBlock(i int, block Block) (ParsedBlock, bool) {
+	if i < 0 || i >= len(d.Blocks) || block.rev == 0 {
+		return ParsedBlock{}, false
+	}
+	pb := d.Blocks[i]
+	if pb.rev != block.rev || pb.Type != block.Type {
+		return ParsedBlock{}, false
+	}
+	return pb, true
+}
+
 // ParseBlock parses a single block into a ParsedBlock.
 func ParseBlock(block Block) ParsedBlock {
 	pb := ParsedBlock{
@@ -57,7 +105,11 @@ func ParseBlock(block Block) ParsedBlock {
 		GlamourContent: "",
 	}
 	copy(pb.RawLines, block.Lines)
+	pb.rev = block.rev
 
+	if block.Type == MathBlock {
+		pb.rows = numberedRows(block.Lines)
+	}
 	if block.Type != TextBlock {
 		return pb
 	}
@@ -0,0 +1,69 @@
+package editor
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// ImageLink is a markdown image, ![alt](path "title"), on a line of its own.
+// Its display size may be set in the title or in a trailing attribute
+// block, as in ![plot](plot.png){width=50%}.
+type ImageLink struct {
+	Alt   string
+	Path  string
+	Title string
+	// Width is the display width in columns, or in percent of the editor
+	// width when WidthPercent is set. Zero means the full width.
+	Width        int
+	WidthPercent bool
+	// Height is the maximum display height in rows, or zero for no limit.
+	Height int
+}
+
+var (
+	imageLinkRe = regexp.MustCompile(`^\s*!\[([^\]]*)\]\(\s*(?:<([^>]+)>|([^)\s]+))(?:\s+"([^"]*)")?\s*\)\s*(?:\{([^}]*)\})?\s*$`)
+	imageSizeRe = regexp.MustCompile(`\b(width|height)\s*=\s*"?(\d+)(%?)"?`)
+)
+
+// ParseImageLink returns the image link that makes up line, if any.
+func ParseImageLink(line string) (ImageLink, bool) {
+	m := imageLinkRe.FindStringSubmatch(line)
+	if m == nil {
+		return ImageLink{}, false
+	}
+	link := ImageLink{Alt: m[1], Path: m[2] + m[3], Title: m[4]}
+	// The attribute block wins over the title when both set a size.
+	for _, attrs := range []string{m[4], m[5]} {
+		for _, size := range imageSizeRe.FindAllStringSubmatch(attrs, -1) {
+			n, _ := strconv.Atoi(size[2])
+			if size[1] == "width" {
+				link.Width, link.WidthPercent = n, size[3] == "%"
+			} else {
+				link.Height = n
+			}
+		}
+	}
+	return link, true
+}
+
+// IsLocal reports whether the link refers to a file rather than a URL.
+func (l ImageLink) IsLocal() bool {
+	return !strings.Contains(l.Path, "://") && !strings.HasPrefix(l.Path, "data:")
+}
+
+// ExtractPictures returns the path of every local image link, as written.
+func ExtractPictures(blocks []Block) []string {
+	var paths []string
+	for _, block := range blocks {
+		if block.Type != TextBlock {
+			continue
+		}
+		for _, line := range block.Lines {
+			if link, ok := ParseImageLink(line); ok && link.IsLocal() {
+				paths = append(paths, link.Path)
+			}
+		}
+	}
+	return paths
+}
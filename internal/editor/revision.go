@@ -0,0 +1,36 @@
+package editor
+
+import "sync/atomic"
+
+// lastRevision numbers the edits to block lines across every model, so a
+// revision identifies one state of the lines it was given to.
+var lastRevision atomic.Uint64
+
+// edited records that the lines of block i have changed. The block gets a
+// new revision, so its parse is redone, and its line count is reindexed.
+func (m *Model) edited(i int) {
+	m.Blocks[i].rev = lastRevision.Add(1)
+	m.lines.mark(i)
+}
+
+// restructured records that blocks have been added, removed or replaced.
+// Blocks new to the document get a revision and the line index is rebuilt.
+func (m *Model) restructured() {
+	assignRevisions(m.Blocks)
+	m.lines.invalidate()
+}
+
+// SetBlocks replaces the blocks of the document.
+func (m *Model) SetBlocks(blocks []Block) {
+	m.Blocks = blocks
+	m.restructured()
+}
+
+// assignRevisions gives a revision to the blocks that have none.
+func assignRevisions(blocks []Block) {
+	for i := range blocks {
+		if blocks[i].rev == 0 {
+			blocks[i].rev = lastRevision.Add(1)
+		}
+	}
+}
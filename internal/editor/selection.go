@@ -236,6 +236,7 @@ func (m *Model) DeleteSelection() (string, bool) {
 			m.Cursor.LineIdx = start.LineIdx
 		}
 		block.IsDirty = true
+		m.edited(start.BlockIdx)
 	}
 
 	m.ClearSelection()
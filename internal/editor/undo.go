@@ -24,6 +24,7 @@ func cloneBlocks(blocks []Block) []Block {
 	for i, b := range blocks {
 		clone[i] = Block{
 			Type: b.Type,
+			rev:  b.rev,
 		}
 		clone[i].Lines = make([]string, len(b.Lines))
 		copy(clone[i].Lines, b.Lines)
@@ -58,6 +59,7 @@ func (u *UndoManager) Undo(m *Model) bool {
 	u.undoStack = u.undoStack[:len(u.undoStack)-1]
 	m.Blocks = snap.Blocks
 	m.Cursor = snap.Cursor
+	m.restructured()
 	// Mark all blocks dirty so images recompile
 	for i := range m.Blocks {
 		m.Blocks[i].IsDirty = true
@@ -80,6 +82,7 @@ func (u *UndoManager) Redo(m *Model) bool {
 	u.redoStack = u.redoStack[:len(u.redoStack)-1]
 	m.Blocks = snap.Blocks
 	m.Cursor = snap.Cursor
+	m.restructured()
 	for i := range m.Blocks {
 		m.Blocks[i].IsDirty = true
 	}
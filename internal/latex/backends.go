@@ -0,0 +1,269 @@
+package latex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// NewDefaultRenderer returns the standard pipeline: the fast DVI path for
+// regular math and a precompiled PDF-mode format for TikZ and pgfplots
+// content. It implements BatchRenderer for the DVI path.
+func NewDefaultRenderer(cacheDir string) Renderer {
+	return &dviRenderer{&texRenderer{
+		name:     defaultRendererName,
+		cacheDir: cacheDir,
+		binaries: []string{"pdftex", "dvipng"},
+		rasterize: func(ctx context.Context, processedMath string, isInline bool, dpi int, tmpDir, base string) (raster, error) {
+			if NeedsPDFPipeline(processedMath) {
+				return rasterizeTikZ(ctx, cacheDir, processedMath, dpi, tmpDir, base)
+			}
+			return rasterizeDVI(ctx, cacheDir, processedMath, isInline, dpi, tmpDir, base)
+		},
+	}}
+}
+
+// NewDVIRenderer returns a renderer that always uses pdftex in DVI mode with
+// the precompiled format files, followed by dvipng. It implements BatchRenderer.
+func NewDVIRenderer(cacheDir string) Renderer {
+	return &dviRenderer{&texRenderer{
+		name:     "dvi",
+		cacheDir: cacheDir,
+		binaries: []string{"pdftex", "dvipng"},
+		rasterize: func(ctx context.Context, processedMath string, isInline bool, dpi int, tmpDir, base string) (raster, error) {
+			return rasterizeDVI(ctx, cacheDir, processedMath, isInline, dpi, tmpDir, base)
+		},
+	}}
+}
+
+// NewPDFRenderer returns a renderer that always uses pdflatex on a standalone
+// document, followed by pdftoppm.
+func NewPDFRenderer(cacheDir string) Renderer {
+	return &texRenderer{
+		name:     "pdf",
+		cacheDir: cacheDir,
+		binaries: []string{"pdflatex", "pdftoppm"},
+		rasterize: func(ctx context.Context, processedMath string, isInline bool, dpi int, tmpDir, base string) (raster, error) {
+			return rasterizePDFLaTeX(ctx, processedMath, dpi, tmpDir, base)
+		},
+	}
+}
+
+// NewTectonicRenderer returns a renderer that compiles with tectonic, which
+// fetches missing packages on demand, followed by pdftoppm.
+func NewTectonicRenderer(cacheDir string) Renderer {
+	return &texRenderer{
+		name:     "tectonic",
+		cacheDir: cacheDir,
+		binaries: []string{"tectonic", "pdftoppm"},
+		rasterize: func(ctx context.Context, processedMath string, isInline bool, dpi int, tmpDir, base string) (raster, error) {
+			texPath, mathStart, err := writeStandaloneDocument(processedMath, macrosFrom(ctx), tmpDir, base, true)
+			if err != nil {
+				return raster{}, err
+			}
+			return compileAndRasterizePDF(ctx, dpi, tmpDir, base, mathStart,
+				"tectonic", "--outdir", tmpDir, "--keep-logs", texPath)
+		},
+	}
+}
+
+// NewLuaLaTeXRenderer returns a renderer that compiles with lualatex, which
+// supports OpenType fonts and Lua code, followed by pdftoppm.
+func NewLuaLaTeXRenderer(cacheDir string) Renderer {
+	return &texRenderer{
+		name:     "lualatex",
+		cacheDir: cacheDir,
+		binaries: []string{"lualatex", "pdftoppm"},
+		rasterize: func(ctx context.Context, processedMath string, isInline bool, dpi int, tmpDir, base string) (raster, error) {
+			texPath, mathStart, err := writeStandaloneDocument(processedMath, macrosFrom(ctx), tmpDir, base, false)
+			if err != nil {
+				return raster{}, err
+			}
+			return compileAndRasterizePDF(ctx, dpi, tmpDir, base, mathStart,
+				"lualatex", "-interaction=nonstopmode",
+				fmt.Sprintf("-output-directory=%s", tmpDir),
+				texPath)
+		},
+	}
+}
+
+// rasterizeDVI runs pdftex in DVI mode with the precompiled format and
+// converts the result with dvipng.
+func rasterizeDVI(ctx context.Context, cacheDir, processedMath string, isInline bool, dpi int, tmpDir, base string) (raster, error) {
+	formatName := MultiFormat
+	if isInline {
+		formatName = InlineFormat
+	}
+
+	fmtPath := filepath.Join(cacheDir, FormatName(formatName, ActivePreamble())+".fmt")
+	if _, err := os.Stat(fmtPath); os.IsNotExist(err) {
+		return raster{}, fmt.Errorf("LaTeX format file not found - please restart quasar")
+	}
+
+	macros := macrosFrom(ctx)
+	body := processedMath
+	if isInline {
+		body = inlinePage(processedMath)
+	}
+	texContent := fmt.Sprintf(`%s\begin{document}
+%s
+\end{document}
+`, macros, body)
+
+	texPath := filepath.Join(tmpDir, base+".tex")
+	if err := os.WriteFile(texPath, []byte(texContent), 0644); err != nil {
+		return raster{}, err
+	}
+
+	dviPath := filepath.Join(tmpDir, base+".dvi")
+	output, err := runTool(ctx, "pdftex", "-output-mode=dvi", "-interaction=nonstopmode",
+		fmt.Sprintf("-output-directory=%s", tmpDir),
+		fmt.Sprintf("-fmt=%s", fmtPath),
+		texPath)
+	if errors.Is(err, ErrTimeout) {
+		return raster{}, err
+	}
+	if err != nil {
+		logData := readLog(filepath.Join(tmpDir, base+".log"))
+		// The math starts after the macros and \begin{document}.
+		return raster{}, newCompileError(err, output, logData, strings.Count(macros, "\n")+2)
+	}
+
+	if _, err := os.Stat(dviPath); os.IsNotExist(err) {
+		return raster{}, fmt.Errorf("DVI file not found after compilation")
+	}
+	if err := checkOutputSize(dviPath); err != nil {
+		return raster{}, fmt.Errorf("DVI file too large: %w", err)
+	}
+
+	pngPath := filepath.Join(tmpDir, base+".png")
+	output, err = runTool(ctx, "dvipng",
+		"-D", strconv.Itoa(dpi),
+		"-T", "tight",
+		"-bg", "Transparent",
+		"-fg", "rgb 0.0 0.0 0.0",
+		"--depth",
+		"-o", pngPath,
+		dviPath)
+	if err != nil {
+		return raster{}, fmt.Errorf("dvipng failed: %w\nOutput: %s", err, output)
+	}
+	result := raster{path: pngPath}
+	if depths := pageDepths(output); len(depths) > 0 {
+		result.depth, result.hasDepth = depths[0], true
+	}
+	return result, nil
+}
+
+// inlinePage wraps inline math in the preview environment that makes it a
+// page of its own in the inline format.
+func inlinePage(processedMath string) string {
+	return "\\begin{preview}" + processedMath + "\\end{preview}"
+}
+
+// rasterizeTikZ runs pdftex in PDF mode with the precompiled TikZ format,
+// which already has tikz and pgfplots loaded, and converts the result with
+// pdftoppm. Without the format it falls back to a full pdflatex run.
+func rasterizeTikZ(ctx context.Context, cacheDir, processedMath string, dpi int, tmpDir, base string) (raster, error) {
+	fmtPath := filepath.Join(cacheDir, FormatName(TikZFormat, ActivePreamble())+".fmt")
+	if _, err := os.Stat(fmtPath); err != nil {
+		return rasterizePDFLaTeX(ctx, processedMath, dpi, tmpDir, base)
+	}
+
+	macros := macrosFrom(ctx)
+	texContent := fmt.Sprintf(`%s\begin{document}
+%s
+\end{document}
+`, macros, processedMath)
+
+	texPath := filepath.Join(tmpDir, base+".tex")
+	if err := os.WriteFile(texPath, []byte(texContent), 0644); err != nil {
+		return raster{}, err
+	}
+
+	// The math starts after the macros and \begin{document}.
+	return compileAndRasterizePDF(ctx, dpi, tmpDir, base, strings.Count(macros, "\n")+2,
+		"pdftex", "-output-format=pdf", "-interaction=nonstopmode",
+		fmt.Sprintf("-output-directory=%s", tmpDir),
+		fmt.Sprintf("-fmt=%s", fmtPath),
+		texPath)
+}
+
+// rasterizePDFLaTeX compiles a standalone document with pdflatex. The format
+// files are DVI-mode, so a full document is used instead.
+func rasterizePDFLaTeX(ctx context.Context, processedMath string, dpi int, tmpDir, base string) (raster, error) {
+	texPath, mathStart, err := writeStandaloneDocument(processedMath, macrosFrom(ctx), tmpDir, base, true)
+	if err != nil {
+		return raster{}, err
+	}
+	return compileAndRasterizePDF(ctx, dpi, tmpDir, base, mathStart,
+		"pdflatex", "-interaction=nonstopmode",
+		fmt.Sprintf("-output-directory=%s", tmpDir),
+		texPath)
+}
+
+// writeStandaloneDocument wraps processedMath in a standalone document and
+// returns its path and the file line the math starts on. The active
+// preamble follows the built-in packages, then the macros.
+// Engines with native Unicode fonts skip the T1/lmodern font setup.
+func writeStandaloneDocument(processedMath, macros, tmpDir, base string, t1Fonts bool) (string, int, error) {
+	fontSetup := ""
+	if t1Fonts {
+		fontSetup = "\\usepackage[T1]{fontenc}\n\\usepackage{lmodern}\n"
+	}
+	preamble := fmt.Sprintf(`\documentclass[border=2pt]{standalone}
+%s\usepackage{amsmath}
+\usepackage{amssymb}
+\usepackage{tikz}
+\usetikzlibrary{automata,positioning,arrows,calc,shapes,decorations.pathmorphing}
+\usepackage{pgfplots}
+\pgfplotsset{compat=1.18}
+%s%s\begin{document}
+`, fontSetup, ActivePreamble(), macros)
+	texContent := preamble + processedMath + "\n\\end{document}\n"
+
+	texPath := filepath.Join(tmpDir, base+".tex")
+	if err := os.WriteFile(texPath, []byte(texContent), 0644); err != nil {
+		return "", 0, err
+	}
+	return texPath, strings.Count(preamble, "\n") + 1, nil
+}
+
+// compileAndRasterizePDF runs a TeX engine that writes base.pdf into tmpDir
+// and converts the first page to PNG with pdftoppm.
+func compileAndRasterizePDF(ctx context.Context, dpi int, tmpDir, base string, mathStart int, engine string, args ...string) (raster, error) {
+	output, err := runTool(ctx, engine, args...)
+	if errors.Is(err, ErrTimeout) {
+		return raster{}, err
+	}
+	if err != nil {
+		logData := readLog(filepath.Join(tmpDir, base+".log"))
+		return raster{}, newCompileError(err, output, logData, mathStart)
+	}
+
+	pdfPath := filepath.Join(tmpDir, base+".pdf")
+	if _, err := os.Stat(pdfPath); os.IsNotExist(err) {
+		return raster{}, fmt.Errorf("PDF file not found after compilation")
+	}
+	if err := checkOutputSize(pdfPath); err != nil {
+		return raster{}, fmt.Errorf("PDF file too large: %w", err)
+	}
+
+	pdftoppmPrefix := filepath.Join(tmpDir, base+"-out")
+	if output, err := runTool(ctx, "pdftoppm",
+		"-png", "-r", strconv.Itoa(dpi),
+		"-singlefile",
+		pdfPath, pdftoppmPrefix); err != nil {
+		return raster{}, fmt.Errorf("pdftoppm failed: %w\nOutput: %s", err, output)
+	}
+
+	pngPath := pdftoppmPrefix + ".png"
+	if _, err := os.Stat(pngPath); os.IsNotExist(err) {
+		return raster{}, fmt.Errorf("PNG file was not created by pdftoppm")
+	}
+	return raster{path: pngPath, blackOnWhite: true}, nil
+}
@@ -0,0 +1,113 @@
+package latex
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/png"
+	"io"
+	"regexp"
+	"strconv"
+)
+
+// raster is an unpadded image produced by an engine.
+type raster struct {
+	path string
+	// blackOnWhite reports whether the image is on an opaque white
+	// background rather than the transparent one produced by dvipng.
+	blackOnWhite bool
+	// depth is how far the bottom of the image lies below the baseline, in
+	// pixels, when hasDepth is set. Only dvipng reports it.
+	depth    int
+	hasDepth bool
+}
+
+// inlinePad is the transparent padding around inline images.
+const inlinePad = 4
+
+// baselineKey is the PNG text keyword under which the baseline of an inline
+// image is stored, so cache hits can be placed without recompiling.
+const baselineKey = "quasar-baseline"
+
+var dvipngDepthRe = regexp.MustCompile(`depth=(-?\d+)`)
+
+// pageDepths returns the depth dvipng --depth reported for each page.
+func pageDepths(output string) []int {
+	var depths []int
+	for _, m := range dvipngDepthRe.FindAllStringSubmatch(output, -1) {
+		d, _ := strconv.Atoi(m[1])
+		depths = append(depths, d)
+	}
+	return depths
+}
+
+// encodePNG writes img as a PNG with a text chunk holding the baseline,
+// when it is known.
+func encodePNG(w io.Writer, img image.Image, baseline int) error {
+	if baseline <= 0 {
+		return png.Encode(w, img)
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		return err
+	}
+	// The signature and IHDR chunk come first; text may follow them.
+	const headerLen = 8 + 8 + 13 + 4
+	data := buf.Bytes()
+	if _, err := w.Write(data[:headerLen]); err != nil {
+		return err
+	}
+	if err := writeTextChunk(w, baselineKey, strconv.Itoa(baseline)); err != nil {
+		return err
+	}
+	_, err := w.Write(data[headerLen:])
+	return err
+}
+
+func writeTextChunk(w io.Writer, key, value string) error {
+	body := append([]byte("tEXt"+key+"\x00"), value...)
+	var length, sum [4]byte
+	binary.BigEndian.PutUint32(length[:], uint32(len(body)-4))
+	binary.BigEndian.PutUint32(sum[:], crc32.ChecksumIEEE(body))
+	for _, b := range [][]byte{length[:], body, sum[:]} {
+		if _, err := w.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// readBaseline returns the baseline stored in a PNG by encodePNG, or 0.
+// Only the chunks before the image data are read.
+func readBaseline(r io.Reader) int {
+	br := bufio.NewReader(r)
+	if _, err := br.Discard(8); err != nil {
+		return 0
+	}
+	var header [8]byte
+	for {
+		if _, err := io.ReadFull(br, header[:]); err != nil {
+			return 0
+		}
+		length := binary.BigEndian.Uint32(header[:4])
+		switch string(header[4:]) {
+		case "IDAT", "IEND":
+			return 0
+		case "tEXt":
+			body := make([]byte, length)
+			if _, err := io.ReadFull(br, body); err != nil {
+				return 0
+			}
+			if key, value, ok := bytes.Cut(body, []byte{0}); ok && string(key) == baselineKey {
+				n, _ := strconv.Atoi(string(value))
+				return n
+			}
+			length = 0
+		}
+		if _, err := br.Discard(int(length) + 4); err != nil {
+			return 0
+		}
+	}
+}
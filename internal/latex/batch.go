@@ -0,0 +1,267 @@
+package latex
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Request is one expression in a batch render.
+type Request struct {
+	Math     string
+	IsInline bool
+}
+
+// Result is the outcome of one Request in a batch render.
+type Result struct {
+	Image Image
+	Err   error
+}
+
+// ErrNotBatched is reported for requests a batch run did not produce, such
+// as TikZ content or expressions whose page failed to compile. Callers should
+// render them individually, which also yields a specific error message.
+var ErrNotBatched = errors.New("expression not rendered in batch")
+
+// BatchRenderer is implemented by renderers that can compile many
+// expressions in a single TeX run.
+type BatchRenderer interface {
+	Renderer
+	// RenderBatch renders every uncached request it can in one run, caching
+	// each page separately. Results are index-aligned with reqs.
+	RenderBatch(ctx context.Context, reqs []Request) []Result
+}
+
+// dviRenderer is a texRenderer whose DVI pipeline can also batch.
+type dviRenderer struct {
+	*texRenderer
+}
+
+var batchPageRe = regexp.MustCompile(`\[quasar-page:(\d+)\]`)
+
+type batchItem struct {
+	processedMath string
+	hash          string
+	params        renderParams
+	indices       []int
+}
+
+// RenderBatch writes every uncached expression on its own page of a single
+// document, compiles it once with pdftex, rasterises all pages with one
+// dvipng run, and stores each page under its expression's cache key.
+func (r *dviRenderer) RenderBatch(ctx context.Context, reqs []Request) []Result {
+	results := make([]Result, len(reqs))
+	groups := make(map[bool][]*batchItem)
+	seen := make(map[string]*batchItem)
+	base := newRenderParams(ctx)
+
+	for i, req := range reqs {
+		processedMath := sanitizeMath(req.Math, req.IsInline)
+		params := base
+		params.ink = base.theme.inkFor(processedMath)
+		hash := r.cacheKey(processedMath, req.IsInline, params)
+		if img, err := imageFromFile(filepath.Join(r.cacheDir, hash+".png"), req.IsInline, params.metrics); err == nil {
+			touchCacheEntry(hash, mathOrigin(processedMath, req.IsInline, params))
+			results[i] = Result{Image: img}
+			continue
+		}
+		if NeedsPDFPipeline(processedMath) || !batchable(processedMath) || lintError(req.Math, req.IsInline, params) != nil {
+			results[i].Err = ErrNotBatched
+			continue
+		}
+		if item, ok := seen[hash]; ok {
+			item.indices = append(item.indices, i)
+			continue
+		}
+		item := &batchItem{processedMath: processedMath, hash: hash, params: params, indices: []int{i}}
+		seen[hash] = item
+		groups[req.IsInline] = append(groups[req.IsInline], item)
+	}
+
+	for isInline, items := range groups {
+		errs := r.renderPages(ctx, items, isInline, base.metrics.DPI)
+		for k, item := range items {
+			for _, i := range item.indices {
+				if errs[k] != nil {
+					results[i].Err = errs[k]
+					continue
+				}
+				results[i].Image, results[i].Err = imageFromFile(filepath.Join(r.cacheDir, item.hash+".png"), isInline, base.metrics)
+			}
+		}
+	}
+	return results
+}
+
+// renderPages compiles items as consecutive pages, rasterises them at dpi,
+// and caches each page that compiled cleanly. The returned errors are index-aligned with items.
+func (r *dviRenderer) renderPages(ctx context.Context, items []*batchItem, isInline bool, dpi int) []error {
+	errs := make([]error, len(items))
+	fail := func(err error) []error {
+		for k := range errs {
+			errs[k] = err
+		}
+		return errs
+	}
+
+	// Pages are typeset with the same format as a single render, so the
+	// cached image does not depend on which path produced it.
+	formatName := MultiFormat
+	if isInline {
+		formatName = InlineFormat
+	}
+	fmtPath := filepath.Join(r.cacheDir, FormatName(formatName, ActivePreamble())+".fmt")
+	if _, err := os.Stat(fmtPath); os.IsNotExist(err) {
+		return fail(fmt.Errorf("LaTeX format file not found - please restart quasar"))
+	}
+
+	tmpDir, err := os.MkdirTemp(r.cacheDir, "batch-*")
+	if err != nil {
+		return fail(fmt.Errorf("failed to create temp directory: %w", err))
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var tex strings.Builder
+	tex.WriteString(macrosFrom(ctx))
+	tex.WriteString("\\begin{document}\n")
+	for k, item := range items {
+		if isInline {
+			fmt.Fprintf(&tex, "\\message{[quasar-page:%d]}\n%s\n", k, inlinePage(item.processedMath))
+			continue
+		}
+		fmt.Fprintf(&tex, "\\message{[quasar-page:%d]}\n%s\n\\clearpage\n", k, item.processedMath)
+	}
+	tex.WriteString("\\end{document}\n")
+
+	texPath := filepath.Join(tmpDir, "batch.tex")
+	if err := os.WriteFile(texPath, []byte(tex.String()), 0644); err != nil {
+		return fail(err)
+	}
+
+	// A non-zero exit only means some page had an error; the log tells which.
+	// After a timeout each expression is rendered on its own, so only the
+	// one at fault times out again.
+	_, err = runTool(ctx, "pdftex", "-output-mode=dvi", "-interaction=nonstopmode",
+		fmt.Sprintf("-output-directory=%s", tmpDir),
+		fmt.Sprintf("-fmt=%s", fmtPath),
+		texPath)
+	if err := ctx.Err(); err != nil {
+		return fail(err)
+	}
+	if errors.Is(err, ErrTimeout) {
+		return fail(ErrNotBatched)
+	}
+
+	dviPath := filepath.Join(tmpDir, "batch.dvi")
+	if _, err := os.Stat(dviPath); os.IsNotExist(err) {
+		return fail(ErrNotBatched)
+	}
+
+	failed := failedBatchPages(readLog(filepath.Join(tmpDir, "batch.log")))
+
+	output, err := runTool(ctx, "dvipng",
+		"-D", strconv.Itoa(dpi),
+		"-T", "tight",
+		"-bg", "Transparent",
+		"-fg", "rgb 0.0 0.0 0.0",
+		"--depth",
+		"-o", filepath.Join(tmpDir, "page%d.png"),
+		dviPath)
+	if errors.Is(err, ErrTimeout) {
+		return fail(ErrNotBatched)
+	}
+	if err != nil {
+		return fail(fmt.Errorf("dvipng failed: %w\nOutput: %s", err, output))
+	}
+
+	// An error can swallow a page break, leaving pages out of step with
+	// items; only trust the output when every page is accounted for.
+	pages, _ := filepath.Glob(filepath.Join(tmpDir, "page*.png"))
+	if len(pages) != len(items) {
+		return fail(ErrNotBatched)
+	}
+	depths := pageDepths(output)
+
+	for k, item := range items {
+		if failed[k] {
+			errs[k] = ErrNotBatched
+			continue
+		}
+		page := raster{path: filepath.Join(tmpDir, fmt.Sprintf("page%d.png", k+1))}
+		if isInline && len(depths) == len(items) {
+			page.depth, page.hasDepth = depths[k], true
+		}
+		errs[k] = r.cachePage(page, item, isInline)
+	}
+	return errs
+}
+
+// cachePage stores one rasterised page under the item's hash unless a
+// concurrent render already produced it.
+func (r *dviRenderer) cachePage(page raster, item *batchItem, isInline bool) error {
+	hash := item.hash
+	lock := getCompileLock(hash)
+	lock.Lock()
+	defer lock.Unlock()
+
+	pngPath := filepath.Join(r.cacheDir, hash+".png")
+	if _, err := os.Stat(pngPath); err == nil {
+		return nil
+	}
+	if _, err := finishImage(page, pngPath, isInline, item.params); err != nil {
+		return err
+	}
+	addCacheEntry(hash, mathOrigin(item.processedMath, isInline, item.params))
+	return nil
+}
+
+// failedBatchPages returns the pages whose section of the TeX log, delimited
+// by the markers written before each expression, contains an error.
+func failedBatchPages(log string) map[int]bool {
+	failed := make(map[int]bool)
+	markers := batchPageRe.FindAllStringSubmatchIndex(log, -1)
+	for i, m := range markers {
+		page, _ := strconv.Atoi(log[m[2]:m[3]])
+		end := len(log)
+		if i+1 < len(markers) {
+			end = markers[i+1][0]
+		}
+		if strings.Contains(log[m[1]:end], "\n! ") {
+			failed[page] = true
+		}
+	}
+	return failed
+}
+
+// batchable reports whether math can share a document with other
+// expressions. Unbalanced braces or environments would swallow the pages
+// that follow, so such expressions are rendered on their own.
+func batchable(processedMath string) bool {
+	depth := 0
+	escaped := false
+	for _, r := range processedMath {
+		switch {
+		case escaped:
+			escaped = false
+		case r == '\\':
+			escaped = true
+		case r == '{':
+			depth++
+		case r == '}':
+			depth--
+			if depth < 0 {
+				return false
+			}
+		}
+	}
+	if depth != 0 {
+		return false
+	}
+	return strings.Count(processedMath, "\\begin{") == strings.Count(processedMath, "\\end{") &&
+		!strings.Contains(processedMath, "\\end{document}")
+}
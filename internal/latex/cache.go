@@ -0,0 +1,67 @@
+package latex
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"sync"
+
+	"github.com/RNAV2019/quasar/internal/cache"
+)
+
+var (
+	cacheManager   *cache.Manager
+	cacheManagerMu sync.RWMutex
+)
+
+// SetCacheManager sets the manager told about cache hits and new images so
+// it can evict the least recently used ones. A nil manager disables tracking.
+func SetCacheManager(m *cache.Manager) {
+	cacheManagerMu.Lock()
+	defer cacheManagerMu.Unlock()
+	cacheManager = m
+}
+
+func touchCacheEntry(hash, origin string) {
+	cacheManagerMu.RLock()
+	defer cacheManagerMu.RUnlock()
+	if cacheManager != nil {
+		cacheManager.Touch(hash+".png", origin)
+	}
+}
+
+func addCacheEntry(hash, origin string) {
+	cacheManagerMu.RLock()
+	defer cacheManagerMu.RUnlock()
+	if cacheManager != nil {
+		cacheManager.Add(hash+".png", origin)
+	}
+}
+
+// MathOrigin returns the origin recorded with the cache entries of math
+// rendered with the given preamble and macros. It leaves out the renderer,
+// theme, and metrics, so every image of the expression shares it.
+func MathOrigin(math string, isInline bool, preamble, macros string) string {
+	return mathOrigin(sanitizeMath(math, isInline), isInline, renderParams{
+		preamble: normalizeTeX(preamble),
+		macros:   normalizeTeX(macros),
+	})
+}
+
+func mathOrigin(processedMath string, isInline bool, params renderParams) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%s\n%v\n%s\n%%macros\n%s", processedMath, isInline, params.preamble, params.macros)))
+	return "math:" + hex.EncodeToString(sum[:])
+}
+
+// GraphvizOrigin returns the origin recorded with the cache entries of a
+// diagram.
+func GraphvizOrigin(source string) string {
+	sum := sha256.Sum256([]byte(source))
+	return "graphviz:" + hex.EncodeToString(sum[:])
+}
+
+// PictureOrigin returns the origin recorded with the cache entries of the
+// picture at path, which should have its symlinks resolved.
+func PictureOrigin(path string) string {
+	return "picture:" + path
+}
@@ -1,15 +1,18 @@
 // Package latex compiles LaTeX math expressions to PNG images and transmits
-// them to the terminal via the Kitty graphics protocol.
+// them to the terminal via the Kitty, Sixel, or iTerm2 graphics protocols.
 package latex
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"image"
 	"image/color"
 	"image/draw"
 	"image/png"
+	"io"
 	"os"
 	"os/exec"
 	"path/filepath"
@@ -18,20 +21,11 @@ import (
 )
 
 const (
-	// RenderDPI is the DPI used for LaTeX rendering.
-	RenderDPI = 2500
+	// blockVPadPt is the vertical padding (each side) for block math images.
+	blockVPadPt = 4
 
-	// BaselinePx is the pixel height of one standard LaTeX baseline skip (12pt)
-	// at the render DPI. Used to map rendered image height to terminal rows.
-	BaselinePx = 12 * RenderDPI / 72 // ~417px
-
-	// BlockVPad is the fixed vertical padding (each side) for block math images,
-	// equivalent to ~4pt at the render DPI.
-	BlockVPad = 4 * RenderDPI / 72 // ~139px
-
-	// BlockHPad is the fixed horizontal padding (each side) for block math images,
-	// equivalent to ~3pt at the render DPI.
-	BlockHPad = 3 * RenderDPI / 72 // ~104px
+	// blockHPadPt is the horizontal padding (each side) for block math images.
+	blockHPadPt = 3
 
 	// cacheVersion is incremented when rendering parameters change to invalidate
 	// old cached images.
@@ -94,22 +88,6 @@ func NeedsPDFPipeline(s string) bool {
 		strings.Contains(s, "\\tikz")
 }
 
-// invertToWhiteOnTransparent converts a black-on-white image to white-on-transparent.
-func invertToWhiteOnTransparent(src image.Image) *image.NRGBA {
-	bounds := src.Bounds()
-	dst := image.NewNRGBA(bounds)
-	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
-		for x := bounds.Min.X; x < bounds.Max.X; x++ {
-			r, g, b, _ := src.At(x, y).RGBA()
-			// Luminance as alpha (white background → transparent, black content → opaque white)
-			lum := (r*299 + g*587 + b*114) / 1000
-			alpha := uint8(255 - lum>>8)
-			dst.SetNRGBA(x, y, color.NRGBA{R: 255, G: 255, B: 255, A: alpha})
-		}
-	}
-	return dst
-}
-
 func addTransparentPadding(src image.Image, top, right, bottom, left int) image.Image {
 	bounds := src.Bounds()
 	newW := bounds.Dx() + left + right
@@ -120,193 +98,245 @@ func addTransparentPadding(src image.Image, top, right, bottom, left int) image.
 	return dst
 }
 
-// CompileToPNG compiles a LaTeX math expression to a cached PNG file and returns its path.
-func CompileToPNG(math string, cacheDir string, isInline bool) (string, error) {
-	processedMath := sanitizeMath(math, isInline)
+// texRenderer is the Renderer shared by every TeX engine. It owns caching,
+// locking, colour conversion, and padding; the engine-specific rasterize
+// function only has to turn sanitized math into an unpadded PNG.
+type texRenderer struct {
+	name     string
+	cacheDir string
+	binaries []string
+
+	// rasterize writes a PNG for processedMath at dpi inside tmpDir and
+	// describes it.
+	rasterize func(ctx context.Context, processedMath string, isInline bool, dpi int, tmpDir, base string) (raster, error)
+}
+
+func (r *texRenderer) Name() string {
+	return r.name
+}
 
-	hash := sha256.Sum256([]byte(processedMath + fmt.Sprintf("%v", isInline) + cacheVersion))
-	hashStr := hex.EncodeToString(hash[:])
-	pngPath := filepath.Join(cacheDir, hashStr+".png")
+func (r *texRenderer) Available() bool {
+	return binariesAvailable(r.binaries...)
+}
+
+func (r *texRenderer) Render(ctx context.Context, math string, isInline bool) (Image, error) {
+	processedMath := sanitizeMath(math, isInline)
+	params := newRenderParams(ctx)
+	params.ink = params.theme.inkFor(processedMath)
+	hashStr := r.cacheKey(processedMath, isInline, params)
+	pngPath := filepath.Join(r.cacheDir, hashStr+".png")
+
+	if img, err := imageFromFile(pngPath, isInline, params.metrics); err == nil {
+		touchCacheEntry(hashStr, mathOrigin(processedMath, isInline, params))
+		return img, nil
+	}
 
-	if _, err := os.Stat(pngPath); err == nil {
-		return pngPath, nil
+	// Errors that are certain are reported without waiting for TeX.
+	if err := lintError(math, isInline, params); err != nil {
+		return Image{}, err
 	}
 
 	lock := getCompileLock(hashStr)
 	lock.Lock()
 	defer lock.Unlock()
 
-	if _, err := os.Stat(pngPath); err == nil {
-		return pngPath, nil
+	if img, err := imageFromFile(pngPath, isInline, params.metrics); err == nil {
+		return img, nil
 	}
 
-	formatName := "quasar-math-multi"
-	if isInline {
-		formatName = "quasar-math-inline"
-	}
-
-	fmtPath := filepath.Join(cacheDir, formatName+".fmt")
-	if _, err := os.Stat(fmtPath); os.IsNotExist(err) {
-		return "", fmt.Errorf("LaTeX format file not found - please restart quasar")
+	if err := ctx.Err(); err != nil {
+		return Image{}, err
 	}
 
-	tmpDir, err := os.MkdirTemp(cacheDir, "compile-*")
+	tmpDir, err := os.MkdirTemp(r.cacheDir, "compile-*")
 	if err != nil {
-		return "", fmt.Errorf("failed to create temp directory: %w", err)
+		return Image{}, fmt.Errorf("failed to create temp directory: %w", err)
 	}
 	defer os.RemoveAll(tmpDir)
 
-	tmpPngPath := filepath.Join(tmpDir, hashStr+".png")
-	usedPDFPipeline := false
-
-	if NeedsPDFPipeline(processedMath) {
-		usedPDFPipeline = true
-		// PDF pipeline for tikz/pgf content — dvipng can't handle PostScript specials,
-		// and format files are DVI-mode, so use pdflatex with a full document.
-		texContent := fmt.Sprintf(`\documentclass[border=2pt]{standalone}
-\usepackage[T1]{fontenc}
-\usepackage{lmodern}
-\usepackage{amsmath}
-\usepackage{amssymb}
-\usepackage{tikz}
-\usetikzlibrary{automata,positioning,arrows,calc,shapes,decorations.pathmorphing}
-\usepackage{pgfplots}
-\pgfplotsset{compat=1.18}
-\begin{document}
-%s
-\end{document}
-`, processedMath)
-
-		texPath := filepath.Join(tmpDir, hashStr+".tex")
-		if err := os.WriteFile(texPath, []byte(texContent), 0644); err != nil {
-			return "", err
-		}
-
-		pdfPath := filepath.Join(tmpDir, hashStr+".pdf")
-		latexCmd := exec.Command("pdflatex", "-interaction=nonstopmode",
-			fmt.Sprintf("-output-directory=%s", tmpDir),
-			texPath)
-		output, err := latexCmd.CombinedOutput()
-		if err != nil {
-			logPath := filepath.Join(tmpDir, hashStr+".log")
-			logData, _ := os.ReadFile(logPath)
-			return "", fmt.Errorf("latex compilation failed: %w\nOutput: %s\nLog: %s", err, string(output), string(logData))
-		}
-
-		if _, err := os.Stat(pdfPath); os.IsNotExist(err) {
-			return "", fmt.Errorf("PDF file not found after compilation")
+	raw, err := r.rasterize(ctx, processedMath, isInline, params.metrics.DPI, tmpDir, hashStr)
+	if err != nil {
+		var compileErr *CompileError
+		if errors.As(err, &compileErr) {
+			compileErr.remapLines(math)
 		}
+		return Image{}, err
+	}
 
-		pdftoppmPrefix := filepath.Join(tmpDir, hashStr+"-out")
-		pdftoppmCmd := exec.Command("pdftoppm",
-			"-png", "-r", "2500",
-			"-singlefile",
-			pdfPath, pdftoppmPrefix)
-		if output, err := pdftoppmCmd.CombinedOutput(); err != nil {
-			return "", fmt.Errorf("pdftoppm failed: %w\nOutput: %s", err, string(output))
-		}
+	img, err := finishImage(raw, pngPath, isInline, params)
+	if err == nil {
+		addCacheEntry(hashStr, mathOrigin(processedMath, isInline, params))
+	}
+	return img, err
+}
 
-		pdftoppmOut := pdftoppmPrefix + ".png"
-		if _, err := os.Stat(pdftoppmOut); os.IsNotExist(err) {
-			return "", fmt.Errorf("PNG file was not created by pdftoppm")
-		}
-		if err := os.Rename(pdftoppmOut, tmpPngPath); err != nil {
-			return "", fmt.Errorf("failed to rename pdftoppm output: %w", err)
-		}
-	} else {
-		texContent := fmt.Sprintf(`\begin{document}
-%s
-\end{document}
-`, processedMath)
-
-		texPath := filepath.Join(tmpDir, hashStr+".tex")
-		if err := os.WriteFile(texPath, []byte(texContent), 0644); err != nil {
-			return "", err
-		}
+// renderParams is everything besides the math that affects a rendered image.
+type renderParams struct {
+	preamble string
+	macros   string
+	theme    Theme
+	ink      color.NRGBA
+	metrics  Metrics
+}
 
-		// DVI pipeline for regular math (faster)
-		dviPath := filepath.Join(tmpDir, hashStr+".dvi")
-		latexCmd := exec.Command("pdftex", "-output-mode=dvi", "-interaction=nonstopmode",
-			fmt.Sprintf("-output-directory=%s", tmpDir),
-			fmt.Sprintf("-fmt=%s", fmtPath),
-			texPath)
-		output, err := latexCmd.CombinedOutput()
-		if err != nil {
-			logPath := filepath.Join(tmpDir, hashStr+".log")
-			logData, _ := os.ReadFile(logPath)
-			return "", fmt.Errorf("latex compilation failed: %w\nOutput: %s\nLog: %s", err, string(output), string(logData))
-		}
+// newRenderParams captures the active settings and ctx's macros, so a render
+// is consistent even if they change while it runs. The ink depends on the
+// math and is set by the caller from theme.
+func newRenderParams(ctx context.Context) renderParams {
+	return renderParams{
+		preamble: ActivePreamble(),
+		macros:   macrosFrom(ctx),
+		theme:    ActiveTheme(),
+		metrics:  ActiveMetrics(),
+	}
+}
 
-		if _, err := os.Stat(dviPath); os.IsNotExist(err) {
-			return "", fmt.Errorf("DVI file not found after compilation")
-		}
+// cacheKey returns the cache file name, without extension, for sanitized
+// math rendered with params.
+func (r *texRenderer) cacheKey(processedMath string, isInline bool, params renderParams) string {
+	return cacheKeyFor(r.name, processedMath, isInline, params)
+}
 
-		dvipngCmd := exec.Command("dvipng",
-			"-D", "2500",
-			"-T", "tight",
-			"-bg", "Transparent",
-			"-fg", "rgb 1.0 1.0 1.0",
-			"-o", tmpPngPath,
-			dviPath)
-		if output, err := dvipngCmd.CombinedOutput(); err != nil {
-			return "", fmt.Errorf("dvipng failed: %w\nOutput: %s", err, string(output))
-		}
+// cacheKeyFor hashes everything that affects a rendered image. Block math
+// from the default pipeline with the original settings keeps the original
+// key so existing caches stay valid.
+func cacheKeyFor(rendererName, processedMath string, isInline bool, params renderParams) string {
+	key := processedMath + fmt.Sprintf("%v", isInline) + cacheVersion
+	if rendererName != defaultRendererName {
+		key += rendererName
+	}
+	if params.preamble != "" {
+		key += "\n" + params.preamble
 	}
+	if params.macros != "" {
+		key += "\n%macros\n" + params.macros
+	}
+	if params.ink != white {
+		key += "\n%ink " + colorHex(params.ink)
+	}
+	if isInline {
+		// Inline images record their baseline for the UI to place them by,
+		// and are typeset as preview pages since batches share their format.
+		key += "\n%depth\n%preview"
+	}
+	if params.metrics != legacyMetrics {
+		key += fmt.Sprintf("\n%%dpi %d/%d", params.metrics.DPI, params.metrics.RowPx)
+	}
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
 
-	if _, err := os.Stat(tmpPngPath); os.IsNotExist(err) {
-		return "", fmt.Errorf("PNG file was not created at %s", tmpPngPath)
+// finishImage converts a raw engine PNG into its padded cache entry at
+// pngPath, drawn in params.ink on a transparent background. Inline images
+// with a known depth record where their baseline lies.
+func finishImage(raw raster, pngPath string, isInline bool, params renderParams) (Image, error) {
+	if _, err := os.Stat(raw.path); os.IsNotExist(err) {
+		return Image{}, fmt.Errorf("PNG file was not created at %s", raw.path)
+	}
+	if err := checkImageSize(raw.path); err != nil {
+		return Image{}, fmt.Errorf("rendered image too large: %w", err)
 	}
 
-	f, err := os.Open(tmpPngPath)
+	f, err := os.Open(raw.path)
 	if err != nil {
-		return "", fmt.Errorf("failed to open temporary PNG: %w", err)
+		return Image{}, fmt.Errorf("failed to open temporary PNG: %w", err)
 	}
 	srcImg, err := png.Decode(f)
 	f.Close()
 	if err != nil {
-		return "", fmt.Errorf("failed to decode temporary PNG: %w", err)
+		return Image{}, fmt.Errorf("failed to decode temporary PNG: %w", err)
 	}
 
-	// PDF pipeline produces black-on-white; convert to white-on-transparent
-	// to match the DVI pipeline's dvipng output.
-	if usedPDFPipeline {
-		srcImg = invertToWhiteOnTransparent(srcImg)
+	// PDF pipelines produce black-on-white; make the background transparent
+	// to match the DVI pipeline's dvipng output before colouring the ink.
+	if raw.blackOnWhite {
+		srcImg = whiteToAlpha(srcImg)
 	}
+	srcImg = recolorInk(srcImg, params.ink)
 
 	var padded image.Image
+	baseline := 0
 	if isInline {
-		padded = addTransparentPadding(srcImg, 4, 4, 4, 4)
+		padded = addTransparentPadding(srcImg, inlinePad, inlinePad, inlinePad, inlinePad)
+		if raw.hasDepth {
+			baseline = inlinePad + srcImg.Bounds().Dy() - raw.depth
+		}
 	} else {
-		padded = addTransparentPadding(srcImg, BlockVPad, BlockHPad, BlockVPad, BlockHPad)
+		vPad, hPad := params.metrics.points(blockVPadPt), params.metrics.points(blockHPadPt)
+		padded = addTransparentPadding(srcImg, vPad, hPad, vPad, hPad)
 	}
 
 	outFile, err := os.Create(pngPath)
 	if err != nil {
-		return "", fmt.Errorf("failed to create PNG file: %w", err)
+		return Image{}, fmt.Errorf("failed to create PNG file: %w", err)
 	}
-	if err := png.Encode(outFile, padded); err != nil {
+	if err := encodePNG(outFile, padded, baseline); err != nil {
 		outFile.Close()
-		return "", fmt.Errorf("failed to encode padded PNG: %w", err)
+		return Image{}, fmt.Errorf("failed to encode padded PNG: %w", err)
 	}
 	outFile.Close()
 
-	return pngPath, nil
+	bounds := padded.Bounds()
+	img := newImage(pngPath, bounds.Dx(), bounds.Dy(), isInline, params.metrics)
+	img.Baseline = baseline
+	return img, nil
 }
 
-// CalculateTargetRows determines how many terminal rows a rendered math image
-// should occupy based on its actual pixel dimensions rather than source line count.
-func CalculateTargetRows(pngPath string) int {
+// imageFromFile returns the metrics of an already rendered PNG.
+func imageFromFile(pngPath string, isInline bool, metrics Metrics) (Image, error) {
 	f, err := os.Open(pngPath)
 	if err != nil {
-		return 3
+		return Image{}, err
 	}
 	defer f.Close()
 
 	cfg, err := png.DecodeConfig(f)
 	if err != nil {
-		return 3
+		return Image{}, err
 	}
+	img := newImage(pngPath, cfg.Width, cfg.Height, isInline, metrics)
+	if isInline {
+		if _, err := f.Seek(0, io.SeekStart); err == nil {
+			img.Baseline = readBaseline(f)
+		}
+	}
+	return img, nil
+}
+
+func newImage(pngPath string, width, height int, isInline bool, metrics Metrics) Image {
+	rows := 1
+	if !isInline {
+		rows = metrics.rows(height)
+	}
+	return Image{Path: pngPath, Width: width, Height: height, Rows: rows}
+}
+
+var (
+	binaryCache   = make(map[string]bool)
+	binaryCacheMu sync.Mutex
+)
+
+// binariesAvailable reports whether every named executable is on PATH.
+// Lookups are cached for the life of the process.
+func binariesAvailable(names ...string) bool {
+	binaryCacheMu.Lock()
+	defer binaryCacheMu.Unlock()
+	for _, name := range names {
+		found, ok := binaryCache[name]
+		if !ok {
+			_, err := exec.LookPath(name)
+			found = err == nil
+			binaryCache[name] = found
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
 
-	rows := (cfg.Height + BaselinePx - 1) / BaselinePx // ceiling division
-	return max(1, rows)
+// ToolchainAvailable reports whether the pdftex and dvipng binaries needed
+// by the default pipeline are on PATH.
+func ToolchainAvailable() bool {
+	return binariesAvailable("pdftex", "dvipng")
 }
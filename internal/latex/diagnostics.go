@@ -0,0 +1,163 @@
+package latex
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Diagnostic is a single error reported by TeX.
+type Diagnostic struct {
+	// Message is the error text without the leading "!" or trailing period,
+	// e.g. "Undefined control sequence".
+	Message string
+	// Line is the 0-based line of the math source the error was raised on,
+	// or -1 when TeX did not report one.
+	Line int
+	// Col is the 0-based column within Line, or -1 when unknown.
+	Col int
+	// Context is the source text TeX had read when the error occurred; its
+	// last token is usually the culprit.
+	Context string
+}
+
+// Summary returns the message, followed by the offending command for
+// undefined control sequences.
+func (d Diagnostic) Summary() string {
+	if d.Context != "" && d.Message == "Undefined control sequence" {
+		return d.Message + " " + lastToken(d.Context)
+	}
+	return d.Message
+}
+
+// String formats the diagnostic as a one-line message including its line.
+func (d Diagnostic) String() string {
+	if d.Line >= 0 {
+		return fmt.Sprintf("line %d: %s", d.Line+1, d.Summary())
+	}
+	return d.Summary()
+}
+
+// CompileError is returned when a TeX engine reports errors. It carries the
+// parsed diagnostics and the raw output for display in detail views.
+type CompileError struct {
+	Diagnostics []Diagnostic
+	Output      string
+	Err         error
+}
+
+// Error returns the first diagnostic, or a generic message when the log
+// could not be parsed.
+func (e *CompileError) Error() string {
+	if len(e.Diagnostics) > 0 {
+		return e.Diagnostics[0].String()
+	}
+	return fmt.Sprintf("latex compilation failed: %v", e.Err)
+}
+
+// Unwrap returns the underlying process error.
+func (e *CompileError) Unwrap() error {
+	return e.Err
+}
+
+// Diagnostics returns the diagnostics carried by err, if it is or wraps a
+// CompileError.
+func Diagnostics(err error) []Diagnostic {
+	var compileErr *CompileError
+	if errors.As(err, &compileErr) {
+		return compileErr.Diagnostics
+	}
+	return nil
+}
+
+var logLineRe = regexp.MustCompile(`^l\.(\d+) ?(.*)$`)
+
+// ParseLog extracts diagnostics from a TeX log. Line numbers in the log are
+// 1-based file lines; mathStart is the file line on which the math begins,
+// so the returned lines are relative to the math.
+func ParseLog(log string, mathStart int) []Diagnostic {
+	lines := strings.Split(log, "\n")
+	var diags []Diagnostic
+	for i, line := range lines {
+		msg, ok := strings.CutPrefix(line, "! ")
+		if !ok {
+			continue
+		}
+		// Fatal errors repeat the message as "==> Fatal error occurred";
+		// the useful diagnostic has already been recorded.
+		if strings.HasPrefix(msg, "==> Fatal error") || strings.HasPrefix(msg, "Emergency stop") {
+			continue
+		}
+		msg = strings.TrimSuffix(strings.TrimSpace(msg), ".")
+		// A runaway report precedes the error, separated by the argument text.
+		for _, prev := range lines[max(i-2, 0):i] {
+			if strings.HasPrefix(prev, "Runaway argument") {
+				msg = "Runaway argument: " + msg
+				break
+			}
+		}
+
+		d := Diagnostic{Message: msg, Line: -1, Col: -1}
+		for j := i + 1; j < len(lines) && j <= i+12; j++ {
+			if strings.HasPrefix(lines[j], "! ") {
+				break
+			}
+			if m := logLineRe.FindStringSubmatch(lines[j]); m != nil {
+				n, _ := strconv.Atoi(m[1])
+				d.Line = max(n-mathStart, 0)
+				d.Context = strings.TrimSpace(m[2])
+				break
+			}
+		}
+		diags = append(diags, d)
+	}
+	return diags
+}
+
+// newCompileError builds a CompileError from a failed engine run, mapping log
+// lines back to the math, which starts on file line mathStart.
+func newCompileError(err error, output, log string, mathStart int) *CompileError {
+	diags := ParseLog(log, mathStart)
+	if len(diags) == 0 {
+		diags = ParseLog(output, mathStart)
+	}
+	return &CompileError{
+		Diagnostics: diags,
+		Output:      fmt.Sprintf("Output: %s\nLog: %s", output, log),
+		Err:         err,
+	}
+}
+
+// remapLines converts diagnostic lines from sanitized math, where blank lines
+// have been dropped, to lines of the original source.
+func (e *CompileError) remapLines(source string) {
+	var kept []int
+	for i, line := range strings.Split(source, "\n") {
+		if strings.TrimSpace(line) != "" {
+			kept = append(kept, i)
+		}
+	}
+	if len(kept) == 0 {
+		return
+	}
+	for i := range e.Diagnostics {
+		d := &e.Diagnostics[i]
+		if d.Line < 0 {
+			continue
+		}
+		d.Line = kept[min(d.Line, len(kept)-1)]
+	}
+}
+
+func lastToken(context string) string {
+	if idx := strings.LastIndex(context, "\\"); idx >= 0 {
+		return context[idx:]
+	}
+	fields := strings.Fields(context)
+	if len(fields) == 0 {
+		return ""
+	}
+	return fields[len(fields)-1]
+}
@@ -0,0 +1,144 @@
+package latex
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Pixel dimensions of one source character and one row in fake images.
+const (
+	fakeCharWidth = 8
+	fakeRowHeight = 16
+)
+
+// FakeRenderer is a Renderer that needs no TeX install. It draws a solid
+// rectangle whose size and colour depend only on the source, keeps the
+// encoded PNGs in memory, and records every call, which makes it suitable
+// for tests of code that renders math.
+type FakeRenderer struct {
+	// Dir is where PNGs are written so they can be transmitted to the
+	// terminal. It defaults to the system temp directory.
+	Dir string
+	// Err, when set, is returned by every call to Render.
+	Err error
+
+	mu     sync.Mutex
+	calls  []string
+	images map[string][]byte
+}
+
+// NewFakeRenderer returns a FakeRenderer that writes images into dir.
+func NewFakeRenderer(dir string) *FakeRenderer {
+	return &FakeRenderer{Dir: dir, images: make(map[string][]byte)}
+}
+
+// Name returns "fake".
+func (f *FakeRenderer) Name() string {
+	return "fake"
+}
+
+// Available always reports true.
+func (f *FakeRenderer) Available() bool {
+	return true
+}
+
+// Render draws a deterministic image for math. Block images are one row tall
+// per non-empty source line; inline images are always one row.
+func (f *FakeRenderer) Render(ctx context.Context, math string, isInline bool) (Image, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	f.calls = append(f.calls, math)
+	if f.Err != nil {
+		return Image{}, f.Err
+	}
+	if err := ctx.Err(); err != nil {
+		return Image{}, err
+	}
+
+	rows := 1
+	width := 1
+	if !isInline {
+		rows = 0
+	}
+	for _, line := range strings.Split(strings.TrimSpace(math), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		width = max(width, len([]rune(line)))
+		if !isInline {
+			rows++
+		}
+	}
+	rows = max(1, rows)
+
+	sum := sha256.Sum256([]byte(math + fmt.Sprintf("%v", isInline)))
+	name := "fake-" + hex.EncodeToString(sum[:8]) + ".png"
+
+	w, h := width*fakeCharWidth, rows*fakeRowHeight
+	data, ok := f.images[name]
+	if !ok {
+		img := image.NewNRGBA(image.Rect(0, 0, w, h))
+		fill := color.NRGBA{R: sum[0], G: sum[1], B: sum[2], A: 255}
+		for y := range h {
+			for x := range w {
+				img.SetNRGBA(x, y, fill)
+			}
+		}
+		var buf bytes.Buffer
+		if err := png.Encode(&buf, img); err != nil {
+			return Image{}, fmt.Errorf("failed to encode fake PNG: %w", err)
+		}
+		data = buf.Bytes()
+		if f.images == nil {
+			f.images = make(map[string][]byte)
+		}
+		f.images[name] = data
+	}
+
+	dir := f.Dir
+	if dir == "" {
+		dir = os.TempDir()
+	}
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0644); err != nil {
+		return Image{}, fmt.Errorf("failed to write fake PNG: %w", err)
+	}
+
+	return Image{Path: path, Width: w, Height: h, Rows: rows}, nil
+}
+
+// RenderBatch renders each request in turn, so code using BatchRenderer can
+// be exercised without TeX.
+func (f *FakeRenderer) RenderBatch(ctx context.Context, reqs []Request) []Result {
+	results := make([]Result, len(reqs))
+	for i, req := range reqs {
+		results[i].Image, results[i].Err = f.Render(ctx, req.Math, req.IsInline)
+	}
+	return results
+}
+
+// Calls returns the math source of every Render call in order.
+func (f *FakeRenderer) Calls() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// PNG returns the encoded image previously rendered to path.
+func (f *FakeRenderer) PNG(path string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, ok := f.images[filepath.Base(path)]
+	return data, ok
+}
@@ -0,0 +1,101 @@
+package latex
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image/png"
+	"os"
+	"slices"
+	"testing"
+)
+
+func TestFakeRendererIsDeterministic(t *testing.T) {
+	ctx := context.Background()
+	a := NewFakeRenderer(t.TempDir())
+	b := NewFakeRenderer(t.TempDir())
+
+	imgA, err := a.Render(ctx, `x^2 + y^2`, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	imgB, err := b.Render(ctx, `x^2 + y^2`, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dataA, err := os.ReadFile(imgA.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dataB, err := os.ReadFile(imgB.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(dataA, dataB) {
+		t.Error("the same source rendered different PNGs")
+	}
+	if kept, ok := a.PNG(imgA.Path); !ok || !bytes.Equal(kept, dataA) {
+		t.Error("PNG does not return the image written to disk")
+	}
+
+	other, err := a.Render(ctx, `x^3`, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other.Path == imgA.Path {
+		t.Error("different sources share a PNG")
+	}
+	if got, want := a.Calls(), []string{`x^2 + y^2`, `x^3`}; !slices.Equal(got, want) {
+		t.Errorf("Calls() = %q, want %q", got, want)
+	}
+}
+
+func TestFakeRendererSize(t *testing.T) {
+	f := NewFakeRenderer(t.TempDir())
+	img, err := f.Render(context.Background(), "a = b\n\n\\int_0^1 f", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Rows != 2 {
+		t.Errorf("Rows = %d, want 2", img.Rows)
+	}
+	if img.Width != 10*fakeCharWidth || img.Height != 2*fakeRowHeight {
+		t.Errorf("size = %dx%d, want %dx%d", img.Width, img.Height, 10*fakeCharWidth, 2*fakeRowHeight)
+	}
+
+	file, err := os.Open(img.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	cfg, err := png.DecodeConfig(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Width != img.Width || cfg.Height != img.Height {
+		t.Errorf("PNG is %dx%d, Image reports %dx%d", cfg.Width, cfg.Height, img.Width, img.Height)
+	}
+}
+
+func TestFakeRendererErrors(t *testing.T) {
+	f := NewFakeRenderer(t.TempDir())
+	f.Err = errors.New("boom")
+	if _, err := f.Render(context.Background(), "x", true); err != f.Err {
+		t.Errorf("Render error = %v, want %v", err, f.Err)
+	}
+
+	f.Err = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := f.Render(ctx, "x", true); !errors.Is(err, context.Canceled) {
+		t.Errorf("Render error = %v, want context.Canceled", err)
+	}
+
+	results := f.RenderBatch(context.Background(), []Request{{Math: "a", IsInline: true}, {Math: "b"}})
+	for i, r := range results {
+		if r.Err != nil {
+			t.Errorf("batch result %d: %v", i, r.Err)
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package latex
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// graphvizEnvironment is the math_colors key that colours Graphviz diagrams.
+const graphvizEnvironment = "graphviz"
+
+var dotLineRe = regexp.MustCompile(`\bline (\d+)`)
+
+// graphvizRenderer draws Graphviz diagrams with the dot binary. It shares
+// the cache, colouring, and padding of the TeX renderers.
+type graphvizRenderer struct {
+	cacheDir string
+}
+
+// NewGraphvizRenderer returns a renderer for Graphviz DOT source, caching
+// images in cacheDir. The isInline argument of Render is ignored.
+func NewGraphvizRenderer(cacheDir string) Renderer {
+	return &graphvizRenderer{cacheDir: cacheDir}
+}
+
+func (r *graphvizRenderer) Name() string {
+	return "graphviz"
+}
+
+func (r *graphvizRenderer) Available() bool {
+	return binariesAvailable("dot")
+}
+
+func (r *graphvizRenderer) Render(ctx context.Context, source string, _ bool) (Image, error) {
+	params := graphvizParams()
+	hashStr := graphvizCacheKey(source, params)
+	pngPath := filepath.Join(r.cacheDir, hashStr+".png")
+
+	if img, err := imageFromFile(pngPath, false, params.metrics); err == nil {
+		touchCacheEntry(hashStr, GraphvizOrigin(source))
+		return img, nil
+	}
+	if !r.Available() {
+		return Image{}, errors.New("dot not found: install Graphviz to render diagrams")
+	}
+
+	lock := getCompileLock(hashStr)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if img, err := imageFromFile(pngPath, false, params.metrics); err == nil {
+		return img, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return Image{}, err
+	}
+
+	tmpDir, err := os.MkdirTemp(r.cacheDir, "graphviz-*")
+	if err != nil {
+		return Image{}, fmt.Errorf("failed to create temp directory: %w", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	dotPath := filepath.Join(tmpDir, hashStr+".dot")
+	if err := os.WriteFile(dotPath, []byte(source), 0644); err != nil {
+		return Image{}, err
+	}
+
+	// Ink is drawn black on transparent so it can be recoloured like TeX
+	// output; colours set in the source are kept.
+	rawPath := filepath.Join(tmpDir, hashStr+"-raw.png")
+	output, err := runTool(ctx, "dot", "-Tpng",
+		"-Gdpi="+strconv.Itoa(params.metrics.DPI),
+		"-Gbgcolor=transparent",
+		"-o", rawPath,
+		dotPath)
+	if errors.Is(err, ErrTimeout) {
+		return Image{}, err
+	}
+	if err != nil {
+		return Image{}, newDotError(err, output)
+	}
+
+	img, err := finishImage(raster{path: rawPath}, pngPath, false, params)
+	if err == nil {
+		addCacheEntry(hashStr, GraphvizOrigin(source))
+	}
+	return img, err
+}
+
+// graphvizParams returns the active settings that affect a diagram.
+func graphvizParams() renderParams {
+	params := renderParams{theme: ActiveTheme(), metrics: ActiveMetrics()}
+	params.ink = params.theme.Foreground
+	if c, ok := params.theme.Environments[graphvizEnvironment]; ok {
+		params.ink = c
+	}
+	return params
+}
+
+// graphvizCacheKey hashes a diagram's source with the settings it is drawn
+// with.
+func graphvizCacheKey(source string, params renderParams) string {
+	key := fmt.Sprintf("graphviz\n%s\n%%ink %s\n%%dpi %d/%d", source, colorHex(params.ink), params.metrics.DPI, params.metrics.RowPx)
+	hash := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(hash[:])
+}
+
+// newDotError builds a CompileError from dot's messages, which name the
+// 1-based line of the source they refer to.
+func newDotError(err error, output string) *CompileError {
+	var diags []Diagnostic
+	for _, line := range strings.Split(strings.TrimSpace(output), "\n") {
+		msg, ok := strings.CutPrefix(line, "Error: ")
+		if !ok {
+			continue
+		}
+		d := Diagnostic{Message: strings.TrimSpace(msg), Line: -1, Col: -1}
+		if m := dotLineRe.FindStringSubmatch(msg); m != nil {
+			n, _ := strconv.Atoi(m[1])
+			d.Line = max(n-1, 0)
+		}
+		// dot prefixes messages with the input file, which is meaningless here.
+		if _, rest, ok := strings.Cut(d.Message, ".dot: "); ok {
+			d.Message = rest
+		}
+		diags = append(diags, d)
+	}
+	return &CompileError{Diagnostics: diags, Output: "Output: " + output, Err: err}
+}
@@ -0,0 +1,136 @@
+package latex
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// ImageManager transmits each rendered image to the terminal once and
+// counts the placements that display it. Images are keyed by their cache
+// file, which is named after the hash of everything that affects it, so the
+// same expression appearing many times in a note shares one terminal image.
+type ImageManager struct {
+	mu    sync.Mutex
+	byKey map[string]*managedImage
+	byID  map[uint32]*managedImage
+}
+
+type managedImage struct {
+	key  string
+	info ImageInfo
+	refs int
+	// ready is closed once the image has been transmitted or has failed.
+	ready chan struct{}
+	err   error
+}
+
+// NewImageManager returns an empty ImageManager.
+func NewImageManager() *ImageManager {
+	return &ImageManager{
+		byKey: make(map[string]*managedImage),
+		byID:  make(map[uint32]*managedImage),
+	}
+}
+
+// Acquire returns the terminal image for a PNG at the given size, adding a
+// reference to it. The image is transmitted by the first call for a given
+// file and size; later calls reuse it. Every successful Acquire must be
+// matched by a Release of the returned ID.
+func (m *ImageManager) Acquire(pngPath string, targetRows, targetCols int) (ImageInfo, error) {
+	key := fmt.Sprintf("%s@%dx%d", strings.TrimSuffix(filepath.Base(pngPath), ".png"), targetRows, targetCols)
+	return m.acquire(key, func() (ImageInfo, error) {
+		return TransmitImage(pngPath, targetRows, targetCols)
+	})
+}
+
+// AcquirePlaced is Acquire for an image placed over the given cells by
+// UpdatePlacements; see TransmitPlacedImage.
+func (m *ImageManager) AcquirePlaced(pngPath string, rows, cols int) (ImageInfo, error) {
+	key := fmt.Sprintf("%s@placed:%dx%d", strings.TrimSuffix(filepath.Base(pngPath), ".png"), rows, cols)
+	return m.acquire(key, func() (ImageInfo, error) {
+		return TransmitPlacedImage(pngPath, rows, cols)
+	})
+}
+
+func (m *ImageManager) acquire(key string, transmit func() (ImageInfo, error)) (ImageInfo, error) {
+	m.mu.Lock()
+	img, ok := m.byKey[key]
+	if ok {
+		img.refs++
+		m.mu.Unlock()
+		<-img.ready
+		if img.err != nil {
+			m.drop(img)
+			return ImageInfo{}, img.err
+		}
+		return img.info, nil
+	}
+	img = &managedImage{key: key, refs: 1, ready: make(chan struct{})}
+	m.byKey[key] = img
+	m.mu.Unlock()
+
+	// Transmit outside the lock so other images are not held up; callers
+	// wanting this image wait on ready.
+	info, err := transmit()
+
+	m.mu.Lock()
+	img.info, img.err = info, err
+	if err == nil {
+		m.byID[info.ImageID] = img
+	}
+	close(img.ready)
+	m.mu.Unlock()
+
+	if err != nil {
+		m.drop(img)
+		return ImageInfo{}, err
+	}
+	return info, nil
+}
+
+// drop removes a reference to an image that failed to transmit.
+func (m *ImageManager) drop(img *managedImage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	img.refs--
+	if img.refs == 0 && m.byKey[img.key] == img {
+		delete(m.byKey, img.key)
+	}
+}
+
+// Release removes a reference to the image with the given ID and deletes it
+// from the terminal once nothing refers to it. A zero ID is ignored.
+func (m *ImageManager) Release(id uint32) {
+	if id == 0 {
+		return
+	}
+	m.mu.Lock()
+	img, ok := m.byID[id]
+	if !ok {
+		m.mu.Unlock()
+		return
+	}
+	img.refs--
+	if img.refs > 0 {
+		m.mu.Unlock()
+		return
+	}
+	delete(m.byID, id)
+	delete(m.byKey, img.key)
+	m.mu.Unlock()
+
+	DeleteImage(id)
+}
+
+// Live returns the number of images currently held in the terminal and the
+// total number of references to them.
+func (m *ImageManager) Live() (images, refs int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, img := range m.byID {
+		refs += img.refs
+	}
+	return len(m.byID), refs
+}
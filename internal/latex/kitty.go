@@ -1,14 +1,21 @@
 package latex
 
 import (
+	"bytes"
+	"compress/zlib"
+	"encoding/base64"
 	"fmt"
+	"image"
+	"image/draw"
+	"image/png"
 	"os"
+	"path/filepath"
 	"regexp"
-	"strconv"
 	"strings"
-	"sync"
+	"sync/atomic"
+	"time"
 
-	"github.com/blacktop/go-termimg"
+	"github.com/RNAV2019/quasar/internal/terminal"
 )
 
 const placeholderChar = "\U0010EEEE"
@@ -25,10 +32,6 @@ var kittyDiacritics = []rune{
 	0x06E1, 0x06E2, 0x06E4, 0x06E7, 0x06E8, 0x06EB, 0x06EC,
 }
 
-var virtualPlacementRe = regexp.MustCompile(`a=p,U=1,i=\d+,c=(\d+),r=(\d+)`)
-
-var stdoutMu sync.Mutex
-
 func diacritic(pos uint16) rune {
 	if int(pos) >= len(kittyDiacritics) {
 		return kittyDiacritics[0]
@@ -59,74 +62,218 @@ type ImageInfo struct {
 	Cols    int
 }
 
-// TransmitImageForKitty sends a PNG image to the terminal using the Kitty graphics protocol.
-func TransmitImageForKitty(pngPath string, targetRows, targetCols int) (ImageInfo, error) {
-	image, err := termimg.Open(pngPath)
-	if err != nil {
-		return ImageInfo{}, err
-	}
+// kittyQueryTimeout bounds a graphics query. Outside tmux the terminal's
+// answer to a device attributes request marks the end of its replies, so
+// the full timeout only passes when tmux or a terminal ignores both.
+const kittyQueryTimeout = time.Second
 
-	image.Protocol(termimg.Kitty)
-	image.UseUnicode(true)
+// kittyProbeID is the image ID used by queries. Queries never store an
+// image, so it cannot clash with displayed images.
+const kittyProbeID = 31
 
-	if targetRows > 0 {
-		image.Height(targetRows)
+var da1ReplyRe = regexp.MustCompile(`\x1b\[\?[\d;]*c`)
+
+// QueryKittyGraphics asks the terminal whether it supports the Kitty
+// graphics protocol.
+func QueryKittyGraphics() bool {
+	return kittyQuery("a=q,i=%d,s=1,v=1,t=d,f=24", "AAAA")
+}
+
+// kittyQuery sends a query command with the given keys and payload, where
+// %d in keys stands for the probe image ID, and reports whether the
+// terminal accepted it.
+func kittyQuery(keys, payload string) bool {
+	query := terminal.Passthrough(fmt.Sprintf("\x1b_G"+keys+";%s\x1b\\", kittyProbeID, payload))
+	ok := fmt.Sprintf("\x1b_Gi=%d;OK", kittyProbeID)
+	answered := fmt.Sprintf("\x1b_Gi=%d;", kittyProbeID)
+	complete := func(reply string) bool {
+		return strings.Contains(reply, answered) && strings.HasSuffix(reply, "\x1b\\")
+	}
+	if !terminal.InTmux() {
+		// tmux answers device attributes itself, before the terminal's
+		// reply to the query could arrive.
+		query += "\x1b[c"
+		complete = da1ReplyRe.MatchString
 	}
+	reply, _ := terminal.Query(query, kittyQueryTimeout, complete)
+	return strings.Contains(reply, ok)
+}
+
+// kittyChunkSize is the most base64 data sent in one graphics command.
+const kittyChunkSize = 4096
 
-	image.Scale(termimg.ScaleFit)
+var nextKittyID atomic.Uint32
 
-	rendered, err := image.Render()
+// TransmitImageForKitty sends a PNG image to the terminal using the Kitty
+// graphics protocol and creates a virtual placement of the given size for
+// Unicode placeholders to display. A zero targetCols keeps the aspect ratio.
+// The data is sent with the active KittyTransfer mode.
+func TransmitImageForKitty(pngPath string, targetRows, targetCols int) (ImageInfo, error) {
+	cfg, rows, cols, err := imageGrid(pngPath, targetRows, targetCols)
 	if err != nil {
 		return ImageInfo{}, err
 	}
+	imageID := allocKittyID()
+	control := fmt.Sprintf("a=T,U=1,i=%d,c=%d,r=%d,q=2", imageID, cols, rows)
+	if err := transmitKitty(pngPath, cfg, control); err != nil {
+		return ImageInfo{}, err
+	}
+	return ImageInfo{ImageID: imageID, Rows: rows, Cols: cols}, nil
+}
 
-	renderer, err := image.GetRenderer()
+// TransmitPlacedImageForKitty sends a PNG image to the terminal without
+// displaying it, for UpdatePlacements to place over the given cells.
+func TransmitPlacedImageForKitty(pngPath string, rows, cols int) (ImageInfo, error) {
+	cfg, _, _, err := imageGrid(pngPath, rows, cols)
 	if err != nil {
 		return ImageInfo{}, err
 	}
+	imageID := allocKittyID()
+	if err := transmitKitty(pngPath, cfg, fmt.Sprintf("a=t,i=%d,q=2", imageID)); err != nil {
+		return ImageInfo{}, err
+	}
+	return ImageInfo{ImageID: imageID, Rows: rows, Cols: cols}, nil
+}
 
-	type idGetter interface {
-		GetLastImageID() uint32
+func allocKittyID() uint32 {
+	imageID := nextKittyID.Add(1) & 0xFFFFFF
+	if imageID == 0 {
+		imageID = nextKittyID.Add(1) & 0xFFFFFF
 	}
-	kr, ok := renderer.(idGetter)
-	if !ok {
-		return ImageInfo{}, fmt.Errorf("renderer does not support GetLastImageID")
+	return imageID
+}
+
+// transmitKitty sends the PNG with the given control keys using the active
+// KittyTransfer mode.
+func transmitKitty(pngPath string, cfg image.Config, control string) error {
+	var seq string
+	switch ActiveKittyTransfer() {
+	case KittyTransferFile:
+		path, err := filepath.Abs(pngPath)
+		if err != nil {
+			return err
+		}
+		seq = kittyFileCommand(control, "f", path)
+	case KittyTransferTemp:
+		path, err := copyToKittyTemp(pngPath)
+		if err != nil {
+			return err
+		}
+		seq = kittyFileCommand(control, "t", path)
+	default:
+		format, data, err := directPayload(pngPath, cfg)
+		if err != nil {
+			return err
+		}
+		seq = kittyChunks(control+","+format, base64.StdEncoding.EncodeToString(data))
 	}
-	imageID := kr.GetLastImageID()
 
-	cols, rows := extractPlacementDimensions(rendered, targetRows)
+	writeGraphics(seq)
+	flushGraphics()
+	return nil
+}
 
-	transmitEnd := strings.Index(rendered, placeholderChar)
+// kittyPlacementID identifies the placement of an image at a screen cell.
+// An image shown in several places has a placement for each.
+func kittyPlacementID(p Placement) uint32 {
+	return uint32(p.Y+1)<<16 | uint32(p.X)
+}
 
-	stdoutMu.Lock()
-	if transmitEnd > 0 {
-		colorStartIdx := strings.LastIndex(rendered[:transmitEnd], "\x1b[38;2;")
-		if colorStartIdx > 0 {
-			os.Stdout.WriteString(rendered[:colorStartIdx])
-		} else {
-			os.Stdout.WriteString(rendered[:transmitEnd])
-		}
-	} else {
-		os.Stdout.WriteString(rendered)
+// imageGrid reads the size of a PNG and returns the cells it is displayed
+// in: targetRows rows, at least one, and targetCols columns, or as many as
+// keep its aspect ratio when targetCols is zero.
+func imageGrid(pngPath string, targetRows, targetCols int) (image.Config, int, int, error) {
+	f, err := os.Open(pngPath)
+	if err != nil {
+		return image.Config{}, 0, 0, err
+	}
+	cfg, err := png.DecodeConfig(f)
+	f.Close()
+	if err != nil {
+		return image.Config{}, 0, 0, fmt.Errorf("failed to read PNG header: %w", err)
 	}
-	stdoutMu.Unlock()
 
-	return ImageInfo{ImageID: imageID, Rows: rows, Cols: cols}, nil
+	cell := terminal.GetCellSize()
+	rows := max(targetRows, 1)
+	cols := targetCols
+	if cols <= 0 {
+		// Preserve aspect ratio at the requested height.
+		cols = (cfg.Width*rows*cell.HeightPx + cfg.Height*cell.WidthPx - 1) / (cfg.Height * cell.WidthPx)
+		cols = max(cols, 1)
+	}
+	return cfg, rows, cols, nil
+}
+
+// kittyFileCommand is a transmission of the PNG at path by the terminal
+// reading it from disk with the given medium.
+func kittyFileCommand(control, medium, path string) string {
+	return terminal.Passthrough(fmt.Sprintf("\x1b_G%s,f=100,t=%s;%s\x1b\\", control, medium,
+		base64.StdEncoding.EncodeToString([]byte(path))))
 }
 
-func extractPlacementDimensions(rendered string, fallbackRows int) (cols, rows int) {
-	matches := virtualPlacementRe.FindStringSubmatch(rendered)
-	if len(matches) == 3 {
-		c, err1 := strconv.Atoi(matches[1])
-		r, err2 := strconv.Atoi(matches[2])
-		if err1 == nil && err2 == nil {
-			return c, r
+// kittyChunks splits a direct transmission into commands of at most
+// kittyChunkSize bytes of payload. Only the first carries the control keys.
+// Inside tmux each command is passed through on its own.
+func kittyChunks(control, payload string) string {
+	var b strings.Builder
+	for first := true; first || payload != ""; first = false {
+		chunk := payload[:min(len(payload), kittyChunkSize)]
+		payload = payload[len(chunk):]
+		more := 0
+		if payload != "" {
+			more = 1
 		}
+		cmd := fmt.Sprintf("\x1b_Gm=%d;%s\x1b\\", more, chunk)
+		if first {
+			cmd = fmt.Sprintf("\x1b_G%s,m=%d;%s\x1b\\", control, more, chunk)
+		}
+		b.WriteString(terminal.Passthrough(cmd))
+	}
+	return b.String()
+}
+
+// directPayload returns the data of a direct transmission and the keys
+// describing its format: the PNG itself, or its pixels compressed with zlib
+// when that is smaller. PNG data is already deflated, so the PNG usually
+// wins, but an encoder that filters poorly can leave the pixels smaller.
+func directPayload(pngPath string, cfg image.Config) (string, []byte, error) {
+	data, err := os.ReadFile(pngPath)
+	if err != nil {
+		return "", nil, err
+	}
+	pixels, err := compressedPixels(data)
+	if err != nil {
+		return "", nil, err
+	}
+	if len(pixels) < len(data) {
+		return fmt.Sprintf("f=32,s=%d,v=%d,o=z", cfg.Width, cfg.Height), pixels, nil
+	}
+	return "f=100", data, nil
+}
+
+// compressedPixels decodes a PNG and returns its non-premultiplied RGBA
+// pixels compressed with zlib, the f=32,o=z payload of a transmission.
+func compressedPixels(data []byte) ([]byte, error) {
+	src, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode PNG: %w", err)
+	}
+	bounds := src.Bounds()
+	img, ok := src.(*image.NRGBA)
+	if !ok || img.Stride != 4*bounds.Dx() {
+		img = image.NewNRGBA(image.Rect(0, 0, bounds.Dx(), bounds.Dy()))
+		draw.Draw(img, img.Bounds(), src, bounds.Min, draw.Src)
+	}
+
+	var buf bytes.Buffer
+	w := zlib.NewWriter(&buf)
+	if _, err := w.Write(img.Pix[:4*bounds.Dx()*bounds.Dy()]); err != nil {
+		return nil, err
 	}
-	if fallbackRows <= 0 {
-		fallbackRows = 3
+	if err := w.Close(); err != nil {
+		return nil, err
 	}
-	return 20, fallbackRows
+	return buf.Bytes(), nil
 }
 
 // PlaceholderString returns the full Unicode placeholder grid for the given image.
@@ -175,17 +322,25 @@ func PlaceholderRow(imageID uint32, row uint16, cols int) string {
 	return b.String()
 }
 
-// DeleteImage sends a Kitty graphics command to delete the image with the given ID.
+// DeleteImage releases the image with the given ID. For Kitty this sends a
+// graphics command to delete it from the terminal.
 func DeleteImage(imageID uint32) {
-	seq := fmt.Sprintf("\x1b_Ga=d,d=i,i=%d,q=2\x1b\\", imageID)
-	stdoutMu.Lock()
-	os.Stdout.WriteString(seq)
-	stdoutMu.Unlock()
+	if ActiveProtocol().Positioned() {
+		deletePositionedImage(imageID)
+		return
+	}
+	writeGraphics(terminal.Passthrough(fmt.Sprintf("\x1b_Ga=d,d=i,i=%d,q=2\x1b\\", imageID)))
 }
 
-// DeleteAllImages sends a Kitty graphics command to delete all transmitted images.
+// DeleteAllImages releases every image. For Kitty this sends a graphics
+// command to delete all transmitted images.
 func DeleteAllImages() {
-	stdoutMu.Lock()
-	os.Stdout.WriteString("\x1b_Ga=d,d=A\x1b\\")
-	stdoutMu.Unlock()
+	if ActiveProtocol() == ProtocolText {
+		return
+	}
+	if ActiveProtocol().Positioned() {
+		deleteAllPositionedImages()
+		return
+	}
+	writeGraphics(terminal.Passthrough("\x1b_Ga=d,d=A\x1b\\"))
 }
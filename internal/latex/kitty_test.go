@@ -0,0 +1,126 @@
+package latex
+
+import (
+	"bytes"
+	"compress/zlib"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/gofont/goregular"
+	"golang.org/x/image/font/opentype"
+	"golang.org/x/image/math/fixed"
+)
+
+// writeMathLikePNG writes antialiased white text on a transparent
+// background, as TeX output is coloured, and returns its path and size.
+func writeMathLikePNG(t *testing.T, text string, sizePt float64) (string, image.Config) {
+	t.Helper()
+	ttf, err := opentype.Parse(goregular.TTF)
+	if err != nil {
+		t.Fatal(err)
+	}
+	face, err := opentype.NewFace(ttf, &opentype.FaceOptions{Size: sizePt, DPI: 72, Hinting: font.HintingFull})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer face.Close()
+
+	metrics := face.Metrics()
+	width := font.MeasureString(face, text).Ceil() + 8
+	height := (metrics.Ascent + metrics.Descent).Ceil() + 8
+	img := image.NewNRGBA(image.Rect(0, 0, width, height))
+	d := font.Drawer{
+		Dst:  img,
+		Src:  image.NewUniform(color.NRGBA{R: 255, G: 255, B: 255, A: 255}),
+		Face: face,
+		Dot:  fixed.P(4, 4+metrics.Ascent.Ceil()),
+	}
+	d.DrawString(text)
+
+	path := filepath.Join(t.TempDir(), "math.png")
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path, image.Config{Width: width, Height: height}
+}
+
+func TestDirectPayloadPicksSmaller(t *testing.T) {
+	for _, tc := range []struct {
+		name string
+		text string
+		size float64
+	}{
+		{"inline", "x^2 + y^2 = z^2", 20},
+		{"block", "f(x) = a0 + sum(an cos(nx) + bn sin(nx))", 40},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			path, cfg := writeMathLikePNG(t, tc.text, tc.size)
+			data, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			pixels, err := compressedPixels(data)
+			if err != nil {
+				t.Fatal(err)
+			}
+			format, payload, err := directPayload(path, cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Logf("%dx%d: PNG %d bytes, zlib pixels %d bytes, sent %s with %d bytes",
+				cfg.Width, cfg.Height, len(data), len(pixels), format, len(payload))
+
+			if len(payload) > len(data) || len(payload) > len(pixels) {
+				t.Errorf("sent %d bytes, but the PNG is %d and the pixels %d", len(payload), len(data), len(pixels))
+			}
+			wantFormat := "f=100"
+			if len(pixels) < len(data) {
+				wantFormat = fmt.Sprintf("f=32,s=%d,v=%d,o=z", cfg.Width, cfg.Height)
+			}
+			if format != wantFormat {
+				t.Errorf("format = %q, want %q", format, wantFormat)
+			}
+		})
+	}
+}
+
+func TestCompressedPixelsRoundTrip(t *testing.T) {
+	path, cfg := writeMathLikePNG(t, "a+b", 16)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pixels, err := compressedPixels(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r, err := zlib.NewReader(bytes.NewReader(pixels))
+	if err != nil {
+		t.Fatal(err)
+	}
+	raw, err := io.ReadAll(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(raw) != 4*cfg.Width*cfg.Height {
+		t.Fatalf("inflated %d bytes, want %d", len(raw), 4*cfg.Width*cfg.Height)
+	}
+	src, _ := png.Decode(bytes.NewReader(data))
+	want := image.NewNRGBA(src.Bounds())
+	draw.Draw(want, want.Bounds(), src, image.Point{}, draw.Src)
+	if !bytes.Equal(raw, want.Pix) {
+		t.Error("compressed pixels do not match the PNG")
+	}
+}
@@ -0,0 +1,247 @@
+package latex
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrLint is wrapped by the CompileError returned for math that failed Lint,
+// in which case no TeX engine was run.
+var ErrLint = errors.New("math has syntax errors")
+
+// knownEnvironments are the environments defined by LaTeX and the packages
+// in the built-in preamble.
+var knownEnvironments = map[string]bool{
+	"align": true, "align*": true, "alignat": true, "alignat*": true,
+	"aligned": true, "alignedat": true, "array": true, "Bmatrix": true,
+	"bmatrix": true, "cases": true, "center": true, "description": true,
+	"displaymath": true, "enumerate": true, "eqnarray": true, "eqnarray*": true,
+	"equation": true, "equation*": true, "flalign": true, "flalign*": true,
+	"flushleft": true, "flushright": true, "gather": true, "gather*": true,
+	"gathered": true, "itemize": true, "math": true, "matrix": true,
+	"minipage": true, "multline": true, "multline*": true, "picture": true,
+	"pmatrix": true, "smallmatrix": true, "split": true, "subarray": true,
+	"subequations": true, "tabular": true, "Vmatrix": true, "vmatrix": true,
+	// tikz and pgfplots
+	"axis": true, "groupplot": true, "loglogaxis": true, "pgfonlayer": true,
+	"pgfpicture": true, "polaraxis": true, "scope": true, "semilogxaxis": true,
+	"semilogyaxis": true, "tikzpicture": true,
+}
+
+// textEnvironments and textCommands contain text mode material, where $
+// starts math rather than being an error.
+var (
+	textEnvironments = map[string]bool{"tikzpicture": true, "pgfpicture": true, "minipage": true, "tabular": true}
+	textCommands     = map[string]bool{
+		"text": true, "textrm": true, "textit": true, "textbf": true, "textsf": true,
+		"texttt": true, "textup": true, "textnormal": true, "mbox": true, "hbox": true,
+		"fbox": true, "intertext": true, "shortintertext": true, "node": true,
+	}
+)
+
+var (
+	definedEnvRe = regexp.MustCompile(`\\(?:re)?new(?:environment|theorem)\*?\{([^}]+)\}|\\(?:New|Renew|Declare)DocumentEnvironment\{([^}]+)\}`)
+	packageRe    = regexp.MustCompile(`\\(?:usepackage|RequirePackage|input|usetikzlibrary|usepgfplotslibrary)\b`)
+)
+
+// Lint checks math for mistakes that are certain to make TeX fail:
+// unbalanced braces, \left without \right, mismatched \begin and \end, $
+// inside math, and environments that are not defined. definitions is the
+// preamble and macros the math is compiled with; environments they define
+// are known, and unknown environments are not reported when they load
+// packages, which may define any environment. Lines and columns are
+// relative to math.
+func Lint(math string, isInline bool, definitions string) []Diagnostic {
+	l := &linter{src: math}
+	l.run(isInline)
+
+	checkEnvs := !packageRe.MatchString(definitions)
+	defined := make(map[string]bool)
+	for _, m := range definedEnvRe.FindAllStringSubmatch(definitions, -1) {
+		defined[m[1]+m[2]] = true
+	}
+	for _, env := range l.envs {
+		if checkEnvs && !knownEnvironments[env.name] && !defined[env.name] {
+			l.report(env.pos, fmt.Sprintf("Environment %s undefined", env.name))
+		}
+	}
+	return l.diags
+}
+
+// lintError returns the CompileError for math that fails Lint, or nil.
+func lintError(math string, isInline bool, params renderParams) error {
+	diags := Lint(math, isInline, params.preamble+params.macros)
+	if len(diags) == 0 {
+		return nil
+	}
+	return &CompileError{Diagnostics: diags, Err: ErrLint}
+}
+
+// opener is an unclosed group: a brace, \left, or \begin.
+type opener struct {
+	kind string // "{", "\\left", or an environment name
+	pos  int
+	text bool // contents are in text mode
+}
+
+type envUse struct {
+	name string
+	pos  int
+}
+
+type linter struct {
+	src   string
+	stack []opener
+	envs  []envUse
+	diags []Diagnostic
+}
+
+// run scans the source once. Structural errors stop the scan, as everything
+// after them would be reported too.
+func (l *linter) run(isInline bool) {
+	src := l.src
+	pendingText := false // the next brace is a text command's argument
+	dollarSeen := false  // stray $ come in pairs; report only the first
+	for i := 0; i < len(src); i++ {
+		switch c := src[i]; c {
+		case '%':
+			for i < len(src) && src[i] != '\n' {
+				i++
+			}
+		case '\\':
+			name := controlWord(src[i+1:])
+			if name == "" {
+				i++ // control symbol such as \{ or \\
+				continue
+			}
+			start := i
+			i += len(name)
+			pendingText = false
+			switch name {
+			case "begin", "end":
+				env, n := braceArg(src[i+1:])
+				if n == 0 {
+					continue
+				}
+				i += n
+				if name == "begin" {
+					l.envs = append(l.envs, envUse{name: env, pos: start})
+					l.stack = append(l.stack, opener{kind: env, pos: start, text: textEnvironments[env]})
+				} else if !l.close(env, start) {
+					return
+				}
+			case "left":
+				l.stack = append(l.stack, opener{kind: "\\left", pos: start})
+			case "right":
+				if !l.close("\\left", start) {
+					return
+				}
+			default:
+				pendingText = textCommands[name]
+			}
+		case '{':
+			l.stack = append(l.stack, opener{kind: "{", pos: i, text: pendingText})
+			pendingText = false
+		case '}':
+			if !l.close("{", i) {
+				return
+			}
+		case '$':
+			if !l.inText() && !dollarSeen {
+				dollarSeen = true
+				mode := "display"
+				if isInline {
+					mode = "inline"
+				}
+				l.report(i, fmt.Sprintf("$ inside %s math", mode))
+			}
+		default:
+			if c != ' ' && c != '\n' && c != '\t' {
+				pendingText = false
+			}
+		}
+	}
+	if len(l.stack) > 0 {
+		o := l.stack[len(l.stack)-1]
+		l.report(o.pos, "Unclosed "+describe(o.kind))
+	}
+}
+
+// close pops the opener a closing token at pos ends. It reports an error
+// and returns false when the innermost open group is of a different kind.
+func (l *linter) close(kind string, pos int) bool {
+	closer := map[string]string{"{": "}", "\\left": "\\right"}[kind]
+	if closer == "" {
+		closer = "\\end{" + kind + "}"
+	}
+	if len(l.stack) == 0 {
+		l.report(pos, "Extra "+closer)
+		return false
+	}
+	top := l.stack[len(l.stack)-1]
+	if top.kind != kind {
+		line, _ := l.position(top.pos)
+		l.report(pos, fmt.Sprintf("%s does not close %s from line %d", closer, describe(top.kind), line+1))
+		return false
+	}
+	l.stack = l.stack[:len(l.stack)-1]
+	return true
+}
+
+func (l *linter) inText() bool {
+	for _, o := range l.stack {
+		if o.text {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *linter) report(pos int, msg string) {
+	line, col := l.position(pos)
+	l.diags = append(l.diags, Diagnostic{Message: msg, Line: line, Col: col})
+}
+
+// position converts a byte offset to a 0-based line and rune column.
+func (l *linter) position(pos int) (int, int) {
+	before := l.src[:pos]
+	lineStart := strings.LastIndexByte(before, '\n') + 1
+	return strings.Count(before, "\n"), utf8.RuneCountInString(before[lineStart:])
+}
+
+func describe(kind string) string {
+	switch kind {
+	case "{":
+		return "{"
+	case "\\left":
+		return "\\left"
+	default:
+		return "\\begin{" + kind + "}"
+	}
+}
+
+// controlWord returns the letters of the control word at the start of s.
+func controlWord(s string) string {
+	n := 0
+	for n < len(s) && (s[n] >= 'a' && s[n] <= 'z' || s[n] >= 'A' && s[n] <= 'Z') {
+		n++
+	}
+	return s[:n]
+}
+
+// braceArg returns the contents of a braced argument at the start of s,
+// after optional spaces, and the number of bytes it spans.
+func braceArg(s string) (string, int) {
+	trimmed := strings.TrimLeft(s, " ")
+	if !strings.HasPrefix(trimmed, "{") {
+		return "", 0
+	}
+	end := strings.IndexByte(trimmed, '}')
+	if end < 0 {
+		return "", 0
+	}
+	return trimmed[1:end], len(s) - len(trimmed) + end + 1
+}
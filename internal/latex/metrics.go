@@ -0,0 +1,67 @@
+package latex
+
+import (
+	"math"
+	"sync"
+)
+
+// Metrics ties the render resolution to the terminal's cell size so that one
+// baseline of text is exactly one terminal row at a scale of 1, and images
+// are transmitted at the size they are displayed.
+type Metrics struct {
+	// DPI is the resolution TeX output is rasterised at.
+	DPI int
+	// RowPx is the number of image pixels per terminal row.
+	RowPx int
+}
+
+// baselinePt is the standard LaTeX baseline skip at 10pt type.
+const baselinePt = 12
+
+// legacyMetrics is the fixed resolution used before it was derived from the
+// cell size. It stays the default so the original cache keys remain valid
+// when no cell size is known.
+var legacyMetrics = Metrics{DPI: 2500, RowPx: baselinePt * 2500 / 72}
+
+var (
+	activeMetrics   = legacyMetrics
+	activeMetricsMu sync.RWMutex
+)
+
+// MetricsFor returns the metrics for a terminal whose cells are cellHeightPx
+// pixels tall. scale enlarges math relative to the text; values of zero or
+// less mean 1.
+func MetricsFor(cellHeightPx int, scale float64) Metrics {
+	if scale <= 0 {
+		scale = 1
+	}
+	cellHeightPx = max(cellHeightPx, 1)
+	dpi := int(math.Round(float64(cellHeightPx) * 72 / baselinePt * scale))
+	return Metrics{DPI: max(dpi, 1), RowPx: cellHeightPx}
+}
+
+// SetMetrics sets the metrics used for newly rendered images. The resolution
+// is part of the cache key, so images are re-rendered for a new font size.
+func SetMetrics(m Metrics) {
+	activeMetricsMu.Lock()
+	defer activeMetricsMu.Unlock()
+	activeMetrics = m
+}
+
+// ActiveMetrics returns the metrics set by SetMetrics.
+func ActiveMetrics() Metrics {
+	activeMetricsMu.RLock()
+	defer activeMetricsMu.RUnlock()
+	return activeMetrics
+}
+
+// points converts a length in TeX points to image pixels.
+func (m Metrics) points(pt int) int {
+	return pt * m.DPI / 72
+}
+
+// rows returns how many terminal rows an image height occupies.
+func (m Metrics) rows(height int) int {
+	rows := (height + m.RowPx - 1) / m.RowPx // ceiling division
+	return max(1, rows)
+}
@@ -0,0 +1,83 @@
+package latex
+
+import (
+	"io"
+	"os"
+	"sync"
+)
+
+// Every escape sequence that transmits, places, or deletes an image goes
+// through one writer, so sequences are never interleaved with each other.
+// While the TUI runs the writer hands them to Bubble Tea, which emits them
+// between frames.
+var (
+	graphicsOut   io.Writer = os.Stdout
+	graphicsOutMu sync.Mutex
+)
+
+// SetGraphicsOutput sets the writer graphics escape sequences are sent to.
+// Each sequence is passed to a single Write call. A nil writer restores
+// standard output.
+//
+// When w has a Flush method, it is called after an image is transmitted and
+// must block until the sequences written so far will reach the terminal
+// before any message sent afterwards, so frames that display the image
+// follow its transmission.
+func SetGraphicsOutput(w io.Writer) {
+	graphicsOutMu.Lock()
+	defer graphicsOutMu.Unlock()
+	if w == nil {
+		w = os.Stdout
+	}
+	graphicsOut = w
+}
+
+// writeGraphics sends one escape sequence to the graphics output.
+func writeGraphics(seq string) {
+	if seq == "" {
+		return
+	}
+	graphicsOutMu.Lock()
+	defer graphicsOutMu.Unlock()
+	graphicsOut.Write([]byte(seq))
+}
+
+// flushGraphics waits for the graphics output to pass on what has been
+// written to it, if it buffers.
+func flushGraphics() {
+	graphicsOutMu.Lock()
+	w := graphicsOut
+	graphicsOutMu.Unlock()
+	if f, ok := w.(interface{ Flush() error }); ok {
+		f.Flush()
+	}
+}
+
+// RecordingWriter is a graphics output that keeps every sequence written to
+// it instead of sending it to a terminal, so the exact output for an image
+// can be inspected.
+type RecordingWriter struct {
+	mu   sync.Mutex
+	seqs []string
+}
+
+func (w *RecordingWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.seqs = append(w.seqs, string(p))
+	return len(p), nil
+}
+
+// Sequences returns the sequences written so far, one per Write call.
+func (w *RecordingWriter) Sequences() []string {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return append([]string(nil), w.seqs...)
+}
+
+// Reset discards the recorded sequences.
+func (w *RecordingWriter) Reset() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.seqs = nil
+}
@@ -0,0 +1,170 @@
+package latex
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// recordGraphics makes protocol and transfer active and records graphics
+// output outside tmux for the rest of the test.
+func recordGraphics(t *testing.T, protocol Protocol, transfer KittyTransfer) *RecordingWriter {
+	t.Helper()
+	prevProtocol, prevTransfer := ActiveProtocol(), ActiveKittyTransfer()
+	t.Cleanup(func() {
+		SetProtocol(prevProtocol)
+		SetKittyTransfer(prevTransfer)
+		SetGraphicsOutput(nil)
+	})
+	t.Setenv("TMUX", "")
+	SetProtocol(protocol)
+	SetKittyTransfer(transfer)
+	w := &RecordingWriter{}
+	SetGraphicsOutput(w)
+	return w
+}
+
+// fakePNG renders math with the fake renderer and returns the PNG's path.
+func fakePNG(t *testing.T, math string) string {
+	t.Helper()
+	img, err := NewFakeRenderer(t.TempDir()).Render(context.Background(), math, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img.Path
+}
+
+func assertSequences(t *testing.T, w *RecordingWriter, want ...string) {
+	t.Helper()
+	if got := w.Sequences(); !slices.Equal(got, want) {
+		t.Errorf("sequences = %q\nwant        %q", got, want)
+	}
+}
+
+func TestKittyDirectOutput(t *testing.T) {
+	w := recordGraphics(t, ProtocolKitty, KittyTransferDirect)
+	path := fakePNG(t, "x")
+
+	info, err := TransmitImage(path, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cfg, _, _, err := imageGrid(path, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	format, payload, err := directPayload(path, cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSequences(t, w, fmt.Sprintf("\x1b_Ga=T,U=1,i=%d,c=2,r=1,q=2,%s,m=0;%s\x1b\\",
+		info.ImageID, format, base64.StdEncoding.EncodeToString(payload)))
+
+	w.Reset()
+	DeleteImage(info.ImageID)
+	DeleteAllImages()
+	assertSequences(t, w,
+		fmt.Sprintf("\x1b_Ga=d,d=i,i=%d,q=2\x1b\\", info.ImageID),
+		"\x1b_Ga=d,d=A\x1b\\")
+}
+
+func TestKittyFileOutput(t *testing.T) {
+	w := recordGraphics(t, ProtocolKitty, KittyTransferFile)
+	path := fakePNG(t, "y")
+
+	info, err := TransmitPlacedImage(path, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	assertSequences(t, w, fmt.Sprintf("\x1b_Ga=t,i=%d,q=2,f=100,t=f;%s\x1b\\",
+		info.ImageID, base64.StdEncoding.EncodeToString([]byte(abs))))
+}
+
+func TestKittyChunks(t *testing.T) {
+	t.Setenv("TMUX", "")
+	payload := strings.Repeat("A", kittyChunkSize+10)
+	got := kittyChunks("a=T,i=1", payload)
+	want := "\x1b_Ga=T,i=1,m=1;" + payload[:kittyChunkSize] + "\x1b\\" +
+		"\x1b_Gm=0;" + payload[kittyChunkSize:] + "\x1b\\"
+	if got != want {
+		t.Errorf("kittyChunks split the payload wrongly:\n%q", got)
+	}
+}
+
+func TestKittyPlacementOutput(t *testing.T) {
+	w := recordGraphics(t, ProtocolKitty, KittyTransferDirect)
+	removed := Placement{ImageID: 3, X: 1, Y: 0, Rows: 1, Cols: 2}
+	offset := Placement{ImageID: 4, X: 5, Y: 2, Rows: 2, Cols: 3, OffsetY: 7}
+	fit := Placement{ImageID: 5, X: 0, Y: 4, Rows: 2, Cols: 6, Fit: true}
+
+	UpdatePlacements([]Placement{removed}, []Span{{X: 1, Y: 0, Width: 2}}, []Placement{offset, fit})
+	assertSequences(t, w, "\x1b7\x1b[0m"+
+		"\x1b_Ga=d,d=i,i=3,p=65537,q=2\x1b\\"+
+		"\x1b[3;6H\x1b_Ga=p,i=4,p=196613,Y=7,C=1,q=2\x1b\\"+
+		"\x1b[5;1H\x1b_Ga=p,i=5,p=327680,c=6,r=2,C=1,q=2\x1b\\"+
+		"\x1b8")
+}
+
+func TestPositionedOutput(t *testing.T) {
+	for _, protocol := range []Protocol{ProtocolSixel, ProtocolITerm2} {
+		t.Run(protocol.String(), func(t *testing.T) {
+			w := recordGraphics(t, protocol, KittyTransferDirect)
+			path := fakePNG(t, "z")
+
+			info, err := TransmitImage(path, 1, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			assertSequences(t, w) // Nothing is drawn until placed
+
+			positionedImagesMu.Lock()
+			img := positionedImages[info.ImageID]
+			positionedImagesMu.Unlock()
+			switch protocol {
+			case ProtocolSixel:
+				if !strings.HasPrefix(img.seq, "\x1bP") || !strings.HasSuffix(img.seq, "\x1b\\") {
+					t.Errorf("sixel image is not a DCS sequence: %q", img.seq)
+				}
+			case ProtocolITerm2:
+				data, err := os.ReadFile(path)
+				if err != nil {
+					t.Fatal(err)
+				}
+				want := fmt.Sprintf("\x1b]1337;File=inline=1;size=%d;width=2;height=1;preserveAspectRatio=1;doNotMoveCursor=1:%s\x07",
+					len(data), base64.StdEncoding.EncodeToString(data))
+				if img.seq != want {
+					t.Errorf("iTerm2 image = %q, want %q", img.seq, want)
+				}
+			}
+
+			p := Placement{ImageID: info.ImageID, X: 4, Y: 5, Rows: 1, Cols: 2}
+			UpdatePlacements([]Placement{{ImageID: 9, X: 1, Y: 2, Rows: 1, Cols: 3}}, []Span{{X: 1, Y: 2, Width: 3}}, []Placement{p})
+			assertSequences(t, w, "\x1b7\x1b[0m\x1b[3;2H\x1b[3X\x1b[6;5H"+img.seq+"\x1b8")
+
+			w.Reset()
+			DeleteImage(info.ImageID)
+			UpdatePlacements(nil, nil, []Placement{p})
+			assertSequences(t, w) // Released images are no longer drawn
+		})
+	}
+}
+
+func TestTmuxPassthroughOutput(t *testing.T) {
+	w := recordGraphics(t, ProtocolKitty, KittyTransferDirect)
+	t.Setenv("TMUX", "/tmp/tmux-1000/default,1,0")
+
+	DeleteImage(7)
+	UpdatePlacements(nil, nil, []Placement{{ImageID: 7, X: 0, Y: 0, Rows: 1, Cols: 1}})
+	assertSequences(t, w,
+		"\x1bPtmux;\x1b\x1b_Ga=d,d=i,i=7,q=2\x1b\x1b\\\x1b\\",
+		"\x1bPtmux;\x1b\x1b7\x1b\x1b[0m\x1b\x1b[1;1H\x1b\x1b_Ga=p,i=7,p=65536,Y=0,C=1,q=2\x1b\x1b\\\x1b\x1b8\x1b\\")
+}
@@ -0,0 +1,105 @@
+package latex
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/draw"
+	_ "image/gif"  // decode GIF pictures
+	_ "image/jpeg" // decode JPEG pictures
+	"image/png"
+	"os"
+	"path/filepath"
+
+	xdraw "golang.org/x/image/draw"
+	_ "golang.org/x/image/webp" // decode WebP pictures
+)
+
+// maxPicturePixels caps the size of a picture that will be decoded.
+const maxPicturePixels = 64 << 20
+
+// PreparePicture decodes the image at srcPath, scales it down to fit within
+// maxWidth by maxHeight pixels, and caches it as a PNG ready to transmit. A
+// maxHeight of zero leaves the height unbounded. The cached copy is keyed by
+// the file's path, size, and modification time, so editing the picture
+// replaces it. Rows is measured with the active metrics.
+func PreparePicture(cacheDir, srcPath string, maxWidth, maxHeight int) (Image, error) {
+	info, err := os.Stat(srcPath)
+	if err != nil {
+		return Image{}, err
+	}
+	metrics := ActiveMetrics()
+	key := fmt.Sprintf("picture\n%s\n%d %d\n%dx%d", srcPath, info.Size(), info.ModTime().UnixNano(), maxWidth, maxHeight)
+	sum := sha256.Sum256([]byte(key))
+	hashStr := hex.EncodeToString(sum[:])
+	pngPath := filepath.Join(cacheDir, hashStr+".png")
+
+	if img, err := imageFromFile(pngPath, false, metrics); err == nil {
+		touchCacheEntry(hashStr, PictureOrigin(srcPath))
+		return img, nil
+	}
+
+	lock := getCompileLock(hashStr)
+	lock.Lock()
+	defer lock.Unlock()
+
+	if img, err := imageFromFile(pngPath, false, metrics); err == nil {
+		return img, nil
+	}
+
+	f, err := os.Open(srcPath)
+	if err != nil {
+		return Image{}, err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		return Image{}, fmt.Errorf("failed to read %s: %w", filepath.Base(srcPath), err)
+	}
+	if cfg.Width*cfg.Height > maxPicturePixels {
+		return Image{}, fmt.Errorf("%s is %dx%d pixels, too large to display", filepath.Base(srcPath), cfg.Width, cfg.Height)
+	}
+	if _, err := f.Seek(0, 0); err != nil {
+		return Image{}, err
+	}
+	src, _, err := image.Decode(f)
+	if err != nil {
+		return Image{}, fmt.Errorf("failed to decode %s: %w", filepath.Base(srcPath), err)
+	}
+
+	width, height := fitWithin(cfg.Width, cfg.Height, maxWidth, maxHeight)
+	dst := image.NewNRGBA(image.Rect(0, 0, width, height))
+	if width == cfg.Width && height == cfg.Height {
+		draw.Draw(dst, dst.Bounds(), src, src.Bounds().Min, draw.Src)
+	} else {
+		xdraw.CatmullRom.Scale(dst, dst.Bounds(), src, src.Bounds(), xdraw.Src, nil)
+	}
+
+	out, err := os.Create(pngPath)
+	if err != nil {
+		return Image{}, fmt.Errorf("failed to create PNG file: %w", err)
+	}
+	if err := png.Encode(out, dst); err != nil {
+		out.Close()
+		os.Remove(pngPath)
+		return Image{}, fmt.Errorf("failed to encode PNG: %w", err)
+	}
+	out.Close()
+	addCacheEntry(hashStr, PictureOrigin(srcPath))
+	return newImage(pngPath, width, height, false, metrics), nil
+}
+
+// fitWithin scales width and height down, keeping their ratio, until they
+// fit within maxWidth and maxHeight. Bounds of zero or less are ignored.
+// Pictures are never enlarged.
+func fitWithin(width, height, maxWidth, maxHeight int) (int, int) {
+	scale := 1.0
+	if maxWidth > 0 && width > maxWidth {
+		scale = float64(maxWidth) / float64(width)
+	}
+	if maxHeight > 0 && float64(height)*scale > float64(maxHeight) {
+		scale = float64(maxHeight) / float64(height)
+	}
+	return max(int(float64(width)*scale), 1), max(int(float64(height)*scale), 1)
+}
@@ -0,0 +1,174 @@
+package latex
+
+import (
+	"context"
+	"runtime"
+	"sync"
+)
+
+// Task is a unit of render work submitted to a Pool.
+type Task struct {
+	// Key identifies the work. Submitting a task with the key of a queued or
+	// running task cancels the older one.
+	Key string
+	// Group lets related tasks be cancelled together, e.g. every span in a block.
+	Group string
+	// Pos is the task's position in the document, compared against the
+	// viewport to decide which queued task runs next.
+	Pos int
+	// Fn performs the work and should stop early when ctx is cancelled.
+	Fn func(ctx context.Context)
+}
+
+type poolTask struct {
+	Task
+	seq    uint64
+	ctx    context.Context
+	cancel context.CancelFunc
+	done   chan struct{}
+}
+
+// Pool runs render tasks on a fixed number of workers. Queued tasks inside
+// the viewport run first, then the rest by distance from it, oldest first.
+type Pool struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	queue    []*poolTask
+	tasks    map[string]*poolTask
+	seq      uint64
+	viewFrom int
+	viewTo   int
+}
+
+// NewPool starts a pool with the given number of workers. A value below one
+// uses the number of CPUs.
+func NewPool(workers int) *Pool {
+	if workers < 1 {
+		workers = runtime.NumCPU()
+	}
+	p := &Pool{
+		tasks:  make(map[string]*poolTask),
+		viewTo: -1,
+	}
+	p.cond = sync.NewCond(&p.mu)
+	for range workers {
+		go p.worker()
+	}
+	return p
+}
+
+// Run queues a task and blocks until it has finished. It returns the context
+// error when the task was cancelled before or while running, in which case
+// any result the task produced is stale and should be discarded.
+func (p *Pool) Run(ctx context.Context, task Task) error {
+	taskCtx, cancel := context.WithCancel(ctx)
+	pt := &poolTask{Task: task, ctx: taskCtx, cancel: cancel, done: make(chan struct{})}
+
+	p.mu.Lock()
+	if prev, ok := p.tasks[task.Key]; ok {
+		prev.cancel()
+	}
+	p.seq++
+	pt.seq = p.seq
+	p.tasks[task.Key] = pt
+	p.queue = append(p.queue, pt)
+	p.mu.Unlock()
+	p.cond.Signal()
+
+	select {
+	case <-pt.done:
+	case <-taskCtx.Done():
+	}
+
+	p.mu.Lock()
+	if p.tasks[task.Key] == pt {
+		delete(p.tasks, task.Key)
+	}
+	p.mu.Unlock()
+
+	err := taskCtx.Err()
+	cancel()
+	return err
+}
+
+// Cancel cancels every queued or running task in group.
+func (p *Pool) Cancel(group string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pt := range p.tasks {
+		if pt.Group == group {
+			pt.cancel()
+		}
+	}
+}
+
+// CancelGroups cancels every queued or running task whose group the cancel
+// function selects.
+func (p *Pool) CancelGroups(cancel func(group string) bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pt := range p.tasks {
+		if cancel(pt.Group) {
+			pt.cancel()
+		}
+	}
+}
+
+// CancelAll cancels every queued or running task.
+func (p *Pool) CancelAll() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, pt := range p.tasks {
+		pt.cancel()
+	}
+}
+
+// SetViewport sets the range of positions, inclusive, that are on screen.
+func (p *Pool) SetViewport(from, to int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.viewFrom, p.viewTo = from, to
+}
+
+// distance returns how far pos lies outside the viewport. Callers hold p.mu.
+func (p *Pool) distance(pos int) int {
+	switch {
+	case pos < p.viewFrom:
+		return p.viewFrom - pos
+	case pos > p.viewTo:
+		return pos - p.viewTo
+	default:
+		return 0
+	}
+}
+
+// next removes and returns the highest priority task. Callers hold p.mu.
+func (p *Pool) next() *poolTask {
+	best := 0
+	for i := 1; i < len(p.queue); i++ {
+		a, b := p.queue[i], p.queue[best]
+		da, db := p.distance(a.Pos), p.distance(b.Pos)
+		if da < db || (da == db && a.seq < b.seq) {
+			best = i
+		}
+	}
+	pt := p.queue[best]
+	p.queue = append(p.queue[:best], p.queue[best+1:]...)
+	return pt
+}
+
+func (p *Pool) worker() {
+	for {
+		p.mu.Lock()
+		for len(p.queue) == 0 {
+			p.cond.Wait()
+		}
+		pt := p.next()
+		p.mu.Unlock()
+
+		if pt.ctx.Err() == nil {
+			pt.Fn(pt.ctx)
+		}
+		close(pt.done)
+	}
+}
@@ -0,0 +1,160 @@
+package latex
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+
+	"github.com/RNAV2019/quasar/internal/terminal"
+	"github.com/blacktop/go-termimg"
+)
+
+// positionedImage is an image encoded for a protocol that draws at the cursor.
+type positionedImage struct {
+	seq  string
+	rows int
+	cols int
+}
+
+// Placement is a fully visible image laid out at a screen position in a
+// frame, with its top left cell and size in cells.
+type Placement struct {
+	ImageID uint32
+	X       int
+	Y       int
+	Rows    int
+	Cols    int
+	// OffsetY moves a Kitty image down from the top of its first row, in
+	// pixels less than a cell's height. Kitty shows the image at its own
+	// size unless Fit stretches it over its cells.
+	OffsetY int
+	Fit     bool
+}
+
+var (
+	positionedImages   = make(map[uint32]positionedImage)
+	positionedImagesMu sync.Mutex
+	nextPositionedID   uint32
+)
+
+func allocPositionedID() uint32 {
+	nextPositionedID = (nextPositionedID + 1) & 0xFFFFFF
+	if nextPositionedID == 0 {
+		nextPositionedID = 1
+	}
+	return nextPositionedID
+}
+
+// preparePositionedImage encodes a PNG for sixel or iTerm2 display and
+// registers it under a placeholder image ID. Nothing is written to the
+// terminal until the image is placed by DrawPlacements.
+func preparePositionedImage(p Protocol, pngPath string, targetRows, targetCols int) (ImageInfo, error) {
+	_, rows, cols, err := imageGrid(pngPath, targetRows, targetCols)
+	if err != nil {
+		return ImageInfo{}, err
+	}
+	cell := terminal.GetCellSize()
+
+	var seq string
+	switch p {
+	case ProtocolSixel:
+		img, err := termimg.Open(pngPath)
+		if err != nil {
+			return ImageInfo{}, err
+		}
+		img.Protocol(termimg.Sixel)
+		img.SizePixels(cols*cell.WidthPx, rows*cell.HeightPx)
+		img.Scale(termimg.ScaleFit)
+		seq, err = img.Render()
+		if err != nil {
+			return ImageInfo{}, err
+		}
+	case ProtocolITerm2:
+		data, err := os.ReadFile(pngPath)
+		if err != nil {
+			return ImageInfo{}, err
+		}
+		// PNG keeps the transparent background that JPEG would lose.
+		seq = fmt.Sprintf("\x1b]1337;File=inline=1;size=%d;width=%d;height=%d;preserveAspectRatio=1;doNotMoveCursor=1:%s\x07",
+			len(data), cols, rows, base64.StdEncoding.EncodeToString(data))
+	default:
+		return ImageInfo{}, fmt.Errorf("protocol %s is not positioned", p)
+	}
+
+	positionedImagesMu.Lock()
+	id := allocPositionedID()
+	positionedImages[id] = positionedImage{seq: seq, rows: rows, cols: cols}
+	positionedImagesMu.Unlock()
+
+	return ImageInfo{ImageID: id, Rows: rows, Cols: cols}, nil
+}
+
+func deletePositionedImage(imageID uint32) {
+	positionedImagesMu.Lock()
+	delete(positionedImages, imageID)
+	positionedImagesMu.Unlock()
+}
+
+func deleteAllPositionedImages() {
+	positionedImagesMu.Lock()
+	positionedImages = make(map[uint32]positionedImage)
+	positionedImagesMu.Unlock()
+}
+
+// Span is a run of cells on one screen row.
+type Span struct {
+	X     int
+	Y     int
+	Width int
+}
+
+// UpdatePlacements removes placements that have moved or gone and draws the
+// added ones at their screen positions. Kitty placements are deleted;
+// sixel and iTerm2 images are pixels on screen, so the spans of cells in
+// erase that still hold them are cleared instead. The cursor and its
+// attributes are saved and restored around the sequence, which tmux passes
+// through to the terminal as a whole.
+func UpdatePlacements(removed []Placement, erase []Span, added []Placement) {
+	writeGraphics(placementSequence(ActiveProtocol(), removed, erase, added))
+}
+
+func placementSequence(protocol Protocol, removed []Placement, erase []Span, added []Placement) string {
+	positionedImagesMu.Lock()
+	defer positionedImagesMu.Unlock()
+
+	kitty := protocol == ProtocolKitty
+	var b strings.Builder
+	if protocol.Positioned() {
+		for _, s := range erase {
+			fmt.Fprintf(&b, "\x1b[%d;%dH\x1b[%dX", s.Y+1, s.X+1, s.Width)
+		}
+	} else if kitty {
+		for _, p := range removed {
+			fmt.Fprintf(&b, "\x1b_Ga=d,d=i,i=%d,p=%d,q=2\x1b\\", p.ImageID, kittyPlacementID(p))
+		}
+	}
+	for _, p := range added {
+		var seq string
+		switch {
+		case kitty && p.Fit:
+			seq = fmt.Sprintf("\x1b_Ga=p,i=%d,p=%d,c=%d,r=%d,C=1,q=2\x1b\\", p.ImageID, kittyPlacementID(p), p.Cols, p.Rows)
+		case kitty:
+			seq = fmt.Sprintf("\x1b_Ga=p,i=%d,p=%d,Y=%d,C=1,q=2\x1b\\", p.ImageID, kittyPlacementID(p), p.OffsetY)
+		default:
+			img, ok := positionedImages[p.ImageID]
+			if !ok {
+				continue
+			}
+			seq = img.seq
+		}
+		fmt.Fprintf(&b, "\x1b[%d;%dH", p.Y+1, p.X+1)
+		b.WriteString(seq)
+	}
+	if b.Len() == 0 {
+		return ""
+	}
+	// Erased cells take the default background.
+	return terminal.Passthrough("\x1b7\x1b[0m" + b.String() + "\x1b8")
+}
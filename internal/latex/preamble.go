@@ -0,0 +1,75 @@
+package latex
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"strings"
+	"sync"
+)
+
+// Base job names of the precompiled format files. TikZFormat is built in
+// PDF mode for TikZ and pgfplots content, which dvipng cannot draw.
+const (
+	MultiFormat  = "quasar-math-multi"
+	InlineFormat = "quasar-math-inline"
+	TikZFormat   = "quasar-tikz"
+)
+
+var (
+	activePreamble   string
+	activePreambleMu sync.RWMutex
+)
+
+// SetPreamble sets the user LaTeX added after the built-in packages in the
+// format files and the PDF pipeline. It is part of every cache key, so
+// images rendered with a different preamble are not reused.
+func SetPreamble(preamble string) {
+	activePreambleMu.Lock()
+	defer activePreambleMu.Unlock()
+	activePreamble = normalizeTeX(preamble)
+}
+
+// ActivePreamble returns the preamble set by SetPreamble.
+func ActivePreamble() string {
+	activePreambleMu.RLock()
+	defer activePreambleMu.RUnlock()
+	return activePreamble
+}
+
+// FormatName returns the job name of the format built from base and
+// preamble. Formats with a custom preamble get a name derived from its hash,
+// so notebooks with different preambles do not rebuild each other's formats.
+func FormatName(base, preamble string) string {
+	preamble = normalizeTeX(preamble)
+	if preamble == "" {
+		return base
+	}
+	sum := sha256.Sum256([]byte(preamble))
+	return base + "-" + hex.EncodeToString(sum[:6])
+}
+
+// normalizeTeX trims surrounding whitespace and ends non-empty TeX with a
+// newline so it can be spliced into a document.
+func normalizeTeX(tex string) string {
+	tex = strings.TrimSpace(tex)
+	if tex == "" {
+		return ""
+	}
+	return tex + "\n"
+}
+
+type macrosKey struct{}
+
+// WithMacros returns a context whose renders define macros, such as
+// \newcommand definitions, immediately before the math. Macros are part of
+// the cache key, so editing them re-renders every expression that uses them.
+func WithMacros(ctx context.Context, macros string) context.Context {
+	return context.WithValue(ctx, macrosKey{}, normalizeTeX(macros))
+}
+
+// macrosFrom returns the macros attached to ctx by WithMacros.
+func macrosFrom(ctx context.Context) string {
+	macros, _ := ctx.Value(macrosKey{}).(string)
+	return macros
+}
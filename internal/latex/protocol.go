@@ -0,0 +1,131 @@
+package latex
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/blacktop/go-termimg"
+)
+
+// Protocol identifies the terminal graphics protocol used to display images.
+type Protocol int
+
+const (
+	// ProtocolKitty uses Kitty virtual placements with Unicode placeholders,
+	// and direct placements for inline math.
+	ProtocolKitty Protocol = iota
+	// ProtocolSixel draws DEC sixel bitmaps at absolute screen positions.
+	ProtocolSixel
+	// ProtocolITerm2 draws iTerm2 inline images at absolute screen positions.
+	ProtocolITerm2
+	// ProtocolText displays no images; math is rendered as Unicode text.
+	ProtocolText
+)
+
+var (
+	activeProtocol   = ProtocolKitty
+	activeProtocolMu sync.RWMutex
+)
+
+// String returns the config name of the protocol.
+func (p Protocol) String() string {
+	switch p {
+	case ProtocolSixel:
+		return "sixel"
+	case ProtocolITerm2:
+		return "iterm2"
+	case ProtocolText:
+		return "text"
+	default:
+		return "kitty"
+	}
+}
+
+// Positioned reports whether images in this protocol are drawn at a screen
+// position rather than flowing with the text as placeholder cells.
+func (p Protocol) Positioned() bool {
+	return p == ProtocolSixel || p == ProtocolITerm2
+}
+
+// ResolveProtocol maps a config value to a Protocol. "auto" or an empty value
+// detects the best protocol the terminal supports. Kitty is confirmed by
+// asking the terminal even when configured, falling back to what the
+// terminal supports otherwise.
+func ResolveProtocol(name string) (Protocol, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "auto":
+		return DetectProtocol(), nil
+	case "kitty":
+		if !QueryKittyGraphics() {
+			return fallbackProtocol(), errors.New("terminal did not confirm Kitty graphics support")
+		}
+		return ProtocolKitty, nil
+	case "sixel":
+		return ProtocolSixel, nil
+	case "iterm2", "iterm":
+		return ProtocolITerm2, nil
+	case "text", "none":
+		return ProtocolText, nil
+	default:
+		return ProtocolKitty, fmt.Errorf("unknown graphics protocol %q", name)
+	}
+}
+
+// DetectProtocol picks the best protocol the terminal supports, preferring
+// Kitty, then iTerm2, then Sixel. Kitty support is confirmed by asking the
+// terminal. When no protocol is available math is shown as text.
+func DetectProtocol() Protocol {
+	if QueryKittyGraphics() {
+		return ProtocolKitty
+	}
+	return fallbackProtocol()
+}
+
+// fallbackProtocol picks the best protocol other than Kitty.
+func fallbackProtocol() Protocol {
+	switch {
+	case termimg.ITerm2Supported():
+		return ProtocolITerm2
+	case termimg.SixelSupported():
+		return ProtocolSixel
+	default:
+		return ProtocolText
+	}
+}
+
+// SetProtocol sets the protocol used by TransmitImage and DeleteImage.
+func SetProtocol(p Protocol) {
+	activeProtocolMu.Lock()
+	defer activeProtocolMu.Unlock()
+	activeProtocol = p
+}
+
+// ActiveProtocol returns the protocol currently used to display images.
+func ActiveProtocol() Protocol {
+	activeProtocolMu.RLock()
+	defer activeProtocolMu.RUnlock()
+	return activeProtocol
+}
+
+// TransmitImage makes a PNG available for display using the active protocol.
+// For Kitty the image is sent to the terminal immediately; for positioned
+// protocols it is encoded and held until a frame places it on screen.
+func TransmitImage(pngPath string, targetRows, targetCols int) (ImageInfo, error) {
+	if p := ActiveProtocol(); p.Positioned() {
+		return preparePositionedImage(p, pngPath, targetRows, targetCols)
+	}
+	return TransmitImageForKitty(pngPath, targetRows, targetCols)
+}
+
+// TransmitPlacedImage makes a PNG available for display over the given
+// cells, placed at screen positions by UpdatePlacements under every
+// protocol. Kitty shows it at its own size or fitted to the cells, as each
+// Placement asks; positioned protocols always fit it.
+func TransmitPlacedImage(pngPath string, rows, cols int) (ImageInfo, error) {
+	if p := ActiveProtocol(); p.Positioned() {
+		return preparePositionedImage(p, pngPath, rows, cols)
+	}
+	return TransmitPlacedImageForKitty(pngPath, rows, cols)
+}
@@ -0,0 +1,51 @@
+package latex
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+const defaultRendererName = "auto"
+
+// Image describes a rendered math expression.
+type Image struct {
+	Path   string // PNG file on disk, ready to pass to TransmitImage
+	Width  int    // Width in pixels
+	Height int    // Height in pixels
+	Rows   int    // Terminal rows the image should occupy
+	// Baseline is the distance in pixels from the top of an inline image
+	// to the baseline of its math, or 0 when it is not known.
+	Baseline int
+}
+
+// Renderer compiles LaTeX math source into an image.
+type Renderer interface {
+	// Name returns the config name of the renderer.
+	Name() string
+	// Available reports whether the tools the renderer needs are installed.
+	Available() bool
+	// Render compiles math and returns the resulting image and its metrics.
+	// Cancelling ctx stops any external processes the renderer started.
+	Render(ctx context.Context, math string, isInline bool) (Image, error)
+}
+
+// NewRenderer returns the renderer selected by a config value, caching images
+// in cacheDir. An empty value selects the default pipeline. Unknown values
+// return an error together with the default renderer.
+func NewRenderer(name, cacheDir string) (Renderer, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "auto":
+		return NewDefaultRenderer(cacheDir), nil
+	case "dvi":
+		return NewDVIRenderer(cacheDir), nil
+	case "pdf", "pdflatex":
+		return NewPDFRenderer(cacheDir), nil
+	case "tectonic":
+		return NewTectonicRenderer(cacheDir), nil
+	case "lualatex":
+		return NewLuaLaTeXRenderer(cacheDir), nil
+	default:
+		return NewDefaultRenderer(cacheDir), fmt.Errorf("unknown renderer %q", name)
+	}
+}
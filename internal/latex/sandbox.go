@@ -0,0 +1,162 @@
+package latex
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// ErrTimeout is wrapped by the CompileError returned when an external tool
+// ran for longer than the render timeout and was killed.
+var ErrTimeout = errors.New("render timed out")
+
+// DefaultRenderTimeout is how long a single TeX, dvipng, or pdftoppm run may
+// take before it is killed.
+const DefaultRenderTimeout = 10 * time.Second
+
+const (
+	// maxToolOutput caps the terminal output kept from each tool run.
+	maxToolOutput = 1 << 20
+	// maxLogBytes caps how much of a TeX log is read for diagnostics.
+	maxLogBytes = 1 << 20
+	// maxOutputBytes caps the size of the DVI, PDF, and PNG files an
+	// expression may produce.
+	maxOutputBytes = 32 << 20
+	// maxImageSide caps the width and height of a rasterised expression.
+	maxImageSide = 8192
+)
+
+// texEngines are the tools that accept -no-shell-escape.
+var texEngines = map[string]bool{"pdftex": true, "pdflatex": true, "lualatex": true}
+
+var (
+	renderTimeout   = DefaultRenderTimeout
+	renderTimeoutMu sync.RWMutex
+)
+
+// SetRenderTimeout sets how long each external tool run may take. Zero or
+// less disables the limit.
+func SetRenderTimeout(d time.Duration) {
+	renderTimeoutMu.Lock()
+	defer renderTimeoutMu.Unlock()
+	renderTimeout = d
+}
+
+// ActiveRenderTimeout returns the timeout set by SetRenderTimeout.
+func ActiveRenderTimeout() time.Duration {
+	renderTimeoutMu.RLock()
+	defer renderTimeoutMu.RUnlock()
+	return renderTimeout
+}
+
+// runTool runs an external program with the render timeout and returns its
+// combined output, truncated to maxToolOutput. TeX engines run with shell
+// escape disabled and may only write files below their working directories,
+// whatever the user's texmf.cnf says. A run killed by the timeout returns a
+// CompileError wrapping ErrTimeout.
+func runTool(ctx context.Context, name string, args ...string) (string, error) {
+	timeout := ActiveRenderTimeout()
+	runCtx := ctx
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		runCtx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+
+	if texEngines[name] {
+		args = append([]string{"-no-shell-escape"}, args...)
+	}
+	cmd := exec.CommandContext(runCtx, name, args...)
+	if texEngines[name] || name == "tectonic" {
+		cmd.Env = append(os.Environ(), "shell_escape=f", "openout_any=p")
+	}
+	output := &limitedBuffer{limit: maxToolOutput}
+	cmd.Stdout, cmd.Stderr = output, output
+	// Do not wait on helpers such as mktexpk that outlive a killed engine.
+	cmd.WaitDelay = time.Second
+
+	err := cmd.Run()
+	if err != nil && ctx.Err() == nil && errors.Is(runCtx.Err(), context.DeadlineExceeded) {
+		return output.String(), timeoutError(name, timeout)
+	}
+	return output.String(), err
+}
+
+// timeoutError is the error for a tool killed after running for timeout.
+func timeoutError(name string, timeout time.Duration) error {
+	return &CompileError{
+		Diagnostics: []Diagnostic{{Message: fmt.Sprintf("Render timed out after %s", timeout), Line: -1, Col: -1}},
+		Output:      name + " was killed",
+		Err:         fmt.Errorf("%s: %w", name, ErrTimeout),
+	}
+}
+
+// readLog returns the start of a TeX log, up to maxLogBytes.
+func readLog(path string) string {
+	f, err := os.Open(path)
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	data, _ := io.ReadAll(io.LimitReader(f, maxLogBytes))
+	return string(data)
+}
+
+// checkOutputSize returns an error when a file produced for an expression
+// is larger than maxOutputBytes.
+func checkOutputSize(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if info.Size() > maxOutputBytes {
+		return fmt.Errorf("output is %d MB, over the %d MB limit", info.Size()>>20, maxOutputBytes>>20)
+	}
+	return nil
+}
+
+// checkImageSize returns an error when the PNG at path is too large to
+// decode and display.
+func checkImageSize(path string) error {
+	if err := checkOutputSize(path); err != nil {
+		return err
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cfg, err := png.DecodeConfig(f)
+	if err != nil {
+		return err
+	}
+	if cfg.Width > maxImageSide || cfg.Height > maxImageSide {
+		return fmt.Errorf("image is %dx%d pixels, over the %d pixel limit", cfg.Width, cfg.Height, maxImageSide)
+	}
+	return nil
+}
+
+// limitedBuffer keeps the first limit bytes written to it and discards the
+// rest, so a runaway tool cannot exhaust memory.
+type limitedBuffer struct {
+	buf   bytes.Buffer
+	limit int
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	if room := b.limit - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(len(p), room)])
+	}
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	return b.buf.String()
+}
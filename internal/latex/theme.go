@@ -0,0 +1,120 @@
+package latex
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Theme holds the colours math images are drawn in. Engines render in black
+// and the ink is recoloured during post-processing, so every pipeline
+// produces the same colours. Ink given an explicit colour with \color is kept.
+type Theme struct {
+	// Foreground is the colour of math by default.
+	Foreground color.NRGBA
+	// Environments overrides Foreground for expressions whose outermost
+	// environment is the key, e.g. "tikzpicture" or "align*".
+	Environments map[string]color.NRGBA
+}
+
+var white = color.NRGBA{R: 255, G: 255, B: 255, A: 255}
+
+var (
+	activeTheme   = Theme{Foreground: white}
+	activeThemeMu sync.RWMutex
+)
+
+var outerEnvRe = regexp.MustCompile(`^\\begin\{([^}]+)\}`)
+
+// SetTheme sets the colours used for newly rendered images. The ink colour is
+// part of the cache key, so changing the theme re-renders math on demand.
+func SetTheme(t Theme) {
+	activeThemeMu.Lock()
+	defer activeThemeMu.Unlock()
+	activeTheme = t
+}
+
+// ActiveTheme returns the theme set by SetTheme.
+func ActiveTheme() Theme {
+	activeThemeMu.RLock()
+	defer activeThemeMu.RUnlock()
+	return activeTheme
+}
+
+// inkFor returns the colour sanitized math is drawn in.
+func (t Theme) inkFor(processedMath string) color.NRGBA {
+	if m := outerEnvRe.FindStringSubmatch(processedMath); m != nil {
+		if c, ok := t.Environments[m[1]]; ok {
+			return c
+		}
+	}
+	return t.Foreground
+}
+
+// ParseColor parses a "#rrggbb" or "#rgb" hex colour.
+func ParseColor(s string) (color.NRGBA, error) {
+	hex := strings.TrimPrefix(strings.TrimSpace(s), "#")
+	if len(hex) == 3 {
+		hex = string([]byte{hex[0], hex[0], hex[1], hex[1], hex[2], hex[2]})
+	}
+	if len(hex) != 6 {
+		return color.NRGBA{}, fmt.Errorf("invalid colour %q: expected #rrggbb", s)
+	}
+	v, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid colour %q: expected #rrggbb", s)
+	}
+	return color.NRGBA{R: uint8(v >> 16), G: uint8(v >> 8), B: uint8(v), A: 255}, nil
+}
+
+// colorHex formats c as "#rrggbb".
+func colorHex(c color.NRGBA) string {
+	return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+}
+
+// whiteToAlpha converts an opaque image on a white background to the same
+// ink on a transparent background, recovering each pixel's coverage from its
+// distance to white so coloured ink keeps its hue.
+func whiteToAlpha(src image.Image) *image.NRGBA {
+	bounds := src.Bounds()
+	dst := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(src.At(x, y)).(color.NRGBA)
+			alpha := 255 - min(c.R, c.G, c.B)
+			if alpha == 0 {
+				continue
+			}
+			unmix := func(v uint8) uint8 {
+				return uint8((int(v) - int(255-alpha)) * 255 / int(alpha))
+			}
+			dst.SetNRGBA(x, y, color.NRGBA{R: unmix(c.R), G: unmix(c.G), B: unmix(c.B), A: alpha})
+		}
+	}
+	return dst
+}
+
+// recolorInk replaces ink in TeX's default black with ink, keeping each
+// pixel's coverage. Pixels with a visible hue were coloured by the author
+// and are left alone.
+func recolorInk(src image.Image, ink color.NRGBA) *image.NRGBA {
+	bounds := src.Bounds()
+	dst := image.NewNRGBA(bounds)
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			c := color.NRGBAModel.Convert(src.At(x, y)).(color.NRGBA)
+			if c.A == 0 {
+				continue
+			}
+			if max(c.R, c.G, c.B) < 64 && max(c.R, c.G, c.B)-min(c.R, c.G, c.B) < 16 {
+				c.R, c.G, c.B = ink.R, ink.G, ink.B
+			}
+			dst.SetNRGBA(x, y, c)
+		}
+	}
+	return dst
+}
@@ -0,0 +1,160 @@
+package latex
+
+import (
+	"encoding/base64"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// KittyTransfer is how image data reaches a Kitty terminal.
+type KittyTransfer int
+
+const (
+	// KittyTransferDirect streams the image over the pty, as the PNG or as
+	// zlib-compressed pixels, whichever is smaller.
+	// It is the only mode that works when the terminal is on another
+	// machine.
+	KittyTransferDirect KittyTransfer = iota
+	// KittyTransferFile sends the path of the cached PNG, which the terminal
+	// reads from disk.
+	KittyTransferFile
+	// KittyTransferTemp copies the PNG to a temporary file that the terminal
+	// reads and then deletes.
+	KittyTransferTemp
+)
+
+// kittyTempMarker must appear in the path of a temporary-file transfer for
+// Kitty to read and delete the file.
+const kittyTempMarker = "tty-graphics-protocol"
+
+var (
+	kittyTransfer   = KittyTransferDirect
+	kittyTransferMu sync.RWMutex
+)
+
+// String returns the config name of the transfer mode.
+func (t KittyTransfer) String() string {
+	switch t {
+	case KittyTransferFile:
+		return "file"
+	case KittyTransferTemp:
+		return "temp"
+	default:
+		return "direct"
+	}
+}
+
+// ResolveKittyTransfer maps a config value to a KittyTransfer. "auto" or an
+// empty value queries the terminal, checking that it can read images from
+// cacheDir, and falls back to direct transfer.
+func ResolveKittyTransfer(name, cacheDir string) (KittyTransfer, error) {
+	switch strings.ToLower(strings.TrimSpace(name)) {
+	case "", "auto":
+		return DetectKittyTransfer(cacheDir), nil
+	case "direct":
+		return KittyTransferDirect, nil
+	case "file":
+		return KittyTransferFile, nil
+	case "temp":
+		return KittyTransferTemp, nil
+	default:
+		return KittyTransferDirect, fmt.Errorf("unknown kitty transfer mode %q", name)
+	}
+}
+
+// DetectKittyTransfer picks the fastest transfer the terminal accepts.
+// File transfers are only tried when the terminal is local: a probe image
+// written to cacheDir is offered first by path, then as a temporary file.
+func DetectKittyTransfer(cacheDir string) KittyTransfer {
+	if remoteSession() {
+		return KittyTransferDirect
+	}
+	probe, err := writeProbeImage(cacheDir)
+	if err != nil {
+		return KittyTransferDirect
+	}
+	defer os.Remove(probe)
+	if queryKittyFile(probe, "f") {
+		return KittyTransferFile
+	}
+
+	temp, err := copyToKittyTemp(probe)
+	if err != nil {
+		return KittyTransferDirect
+	}
+	defer os.Remove(temp)
+	if queryKittyFile(temp, "t") {
+		return KittyTransferTemp
+	}
+	return KittyTransferDirect
+}
+
+// SetKittyTransfer sets how TransmitImageForKitty sends image data.
+func SetKittyTransfer(t KittyTransfer) {
+	kittyTransferMu.Lock()
+	defer kittyTransferMu.Unlock()
+	kittyTransfer = t
+}
+
+// ActiveKittyTransfer returns the transfer mode set by SetKittyTransfer.
+func ActiveKittyTransfer() KittyTransfer {
+	kittyTransferMu.RLock()
+	defer kittyTransferMu.RUnlock()
+	return kittyTransfer
+}
+
+// remoteSession reports whether quasar runs over SSH, where the terminal
+// cannot see local files.
+func remoteSession() bool {
+	for _, key := range []string{"SSH_CONNECTION", "SSH_CLIENT", "SSH_TTY"} {
+		if os.Getenv(key) != "" {
+			return true
+		}
+	}
+	return false
+}
+
+// queryKittyFile asks the terminal whether it can load the PNG at path with
+// the given transmission medium, without displaying it.
+func queryKittyFile(path, medium string) bool {
+	return kittyQuery("a=q,i=%d,f=100,t="+medium, base64.StdEncoding.EncodeToString([]byte(path)))
+}
+
+// writeProbeImage writes a one-pixel PNG to dir and returns its path.
+func writeProbeImage(dir string) (string, error) {
+	f, err := os.CreateTemp(dir, "kitty-probe-*.png")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if err := png.Encode(f, image.NewNRGBA(image.Rect(0, 0, 1, 1))); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return filepath.Abs(f.Name())
+}
+
+// copyToKittyTemp copies a PNG to a temporary file Kitty will accept for a
+// temporary-file transfer and returns its path. The terminal deletes the
+// file once it has read it.
+func copyToKittyTemp(pngPath string) (string, error) {
+	data, err := os.ReadFile(pngPath)
+	if err != nil {
+		return "", err
+	}
+	f, err := os.CreateTemp("", kittyTempMarker+"-*.png")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	if _, err := f.Write(data); err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+	return f.Name(), nil
+}
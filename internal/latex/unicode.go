@@ -0,0 +1,982 @@
+package latex
+
+import (
+	"strings"
+	"unicode"
+
+	"github.com/charmbracelet/x/ansi"
+)
+
+// textBox is a rectangular block of text with a baseline row. All lines are
+// padded to the same display width so boxes can be laid out side by side.
+type textBox struct {
+	lines    []string
+	baseline int
+}
+
+func atomBox(s string) textBox {
+	return textBox{lines: []string{s}}
+}
+
+func (b textBox) width() int {
+	if len(b.lines) == 0 {
+		return 0
+	}
+	return ansi.StringWidth(b.lines[0])
+}
+
+func (b textBox) height() int {
+	return len(b.lines)
+}
+
+func (b textBox) empty() bool {
+	return b.width() == 0 && b.height() <= 1
+}
+
+// flat returns the box content when it fits on a single line.
+func (b textBox) flat() (string, bool) {
+	if len(b.lines) == 1 {
+		return b.lines[0], true
+	}
+	if len(b.lines) == 0 {
+		return "", true
+	}
+	return "", false
+}
+
+func padRight(s string, w int) string {
+	if d := w - ansi.StringWidth(s); d > 0 {
+		return s + strings.Repeat(" ", d)
+	}
+	return s
+}
+
+func padCenter(s string, w int) string {
+	d := w - ansi.StringWidth(s)
+	if d <= 0 {
+		return s
+	}
+	return strings.Repeat(" ", d/2) + s + strings.Repeat(" ", d-d/2)
+}
+
+func padLeft(s string, w int) string {
+	if d := w - ansi.StringWidth(s); d > 0 {
+		return strings.Repeat(" ", d) + s
+	}
+	return s
+}
+
+// hcat lays boxes out left to right with their baselines aligned.
+func hcat(boxes ...textBox) textBox {
+	up, down := 0, 0
+	for _, b := range boxes {
+		if b.height() == 0 {
+			continue
+		}
+		up = max(up, b.baseline)
+		down = max(down, b.height()-1-b.baseline)
+	}
+	lines := make([]string, up+down+1)
+	for _, b := range boxes {
+		if b.height() == 0 {
+			continue
+		}
+		w := b.width()
+		offset := up - b.baseline
+		for r := range lines {
+			src := r - offset
+			if src >= 0 && src < b.height() {
+				lines[r] += padRight(b.lines[src], w)
+			} else {
+				lines[r] += strings.Repeat(" ", w)
+			}
+		}
+	}
+	return textBox{lines: lines, baseline: up}
+}
+
+// vstack stacks boxes top to bottom, centring each one horizontally. The
+// baseline is taken from the box at baselineIdx.
+func vstack(baselineIdx int, boxes ...textBox) textBox {
+	w := 0
+	for _, b := range boxes {
+		w = max(w, b.width())
+	}
+	var lines []string
+	baseline := 0
+	for i, b := range boxes {
+		if i == baselineIdx {
+			baseline = len(lines) + b.baseline
+		}
+		for _, l := range b.lines {
+			lines = append(lines, padCenter(l, w))
+		}
+	}
+	return textBox{lines: lines, baseline: baseline}
+}
+
+var unicodeSymbols = map[string]string{
+	// Greek
+	"alpha": "α", "beta": "β", "gamma": "γ", "delta": "δ", "epsilon": "ϵ", "varepsilon": "ε",
+	"zeta": "ζ", "eta": "η", "theta": "θ", "vartheta": "ϑ", "iota": "ι", "kappa": "κ",
+	"lambda": "λ", "mu": "μ", "nu": "ν", "xi": "ξ", "pi": "π", "varpi": "ϖ", "rho": "ρ",
+	"varrho": "ϱ", "sigma": "σ", "varsigma": "ς", "tau": "τ", "upsilon": "υ", "phi": "ϕ",
+	"varphi": "φ", "chi": "χ", "psi": "ψ", "omega": "ω",
+	"Gamma": "Γ", "Delta": "Δ", "Theta": "Θ", "Lambda": "Λ", "Xi": "Ξ", "Pi": "Π",
+	"Sigma": "Σ", "Upsilon": "Υ", "Phi": "Φ", "Psi": "Ψ", "Omega": "Ω",
+	// Big operators
+	"sum": "∑", "prod": "∏", "coprod": "∐", "int": "∫", "iint": "∬", "iiint": "∭",
+	"oint": "∮", "bigcup": "⋃", "bigcap": "⋂", "bigoplus": "⨁", "bigotimes": "⨂",
+	// Binary operators
+	"pm": "±", "mp": "∓", "times": "×", "div": "÷", "cdot": "⋅", "ast": "∗", "star": "⋆",
+	"circ": "∘", "bullet": "∙", "oplus": "⊕", "ominus": "⊖", "otimes": "⊗", "odot": "⊙",
+	"cup": "∪", "cap": "∩", "setminus": "∖", "wedge": "∧", "land": "∧", "vee": "∨", "lor": "∨",
+	// Relations
+	"leq": "≤", "le": "≤", "geq": "≥", "ge": "≥", "neq": "≠", "ne": "≠", "approx": "≈",
+	"equiv": "≡", "sim": "∼", "simeq": "≃", "cong": "≅", "propto": "∝", "ll": "≪", "gg": "≫",
+	"in": "∈", "notin": "∉", "ni": "∋", "subset": "⊂", "supset": "⊃", "subseteq": "⊆",
+	"supseteq": "⊇", "perp": "⊥", "parallel": "∥", "mid": "∣",
+	"to": "→", "rightarrow": "→", "leftarrow": "←", "gets": "←", "leftrightarrow": "↔",
+	"Rightarrow": "⇒", "Leftarrow": "⇐", "Leftrightarrow": "⇔", "implies": "⟹", "iff": "⟺",
+	"mapsto": "↦", "longrightarrow": "⟶", "longleftarrow": "⟵", "uparrow": "↑", "downarrow": "↓",
+	// Misc
+	"infty": "∞", "partial": "∂", "nabla": "∇", "forall": "∀", "exists": "∃", "nexists": "∄",
+	"emptyset": "∅", "varnothing": "∅", "neg": "¬", "lnot": "¬", "angle": "∠", "degree": "°",
+	"hbar": "ℏ", "ell": "ℓ", "Re": "ℜ", "Im": "ℑ", "aleph": "ℵ", "wp": "℘",
+	"ldots": "…", "dots": "…", "cdots": "⋯", "vdots": "⋮", "ddots": "⋱",
+	"langle": "⟨", "rangle": "⟩", "lfloor": "⌊", "rfloor": "⌋", "lceil": "⌈", "rceil": "⌉",
+	"prime": "′", "therefore": "∴", "because": "∵", "top": "⊤", "bot": "⊥",
+	"{": "{", "}": "}", "%": "%", "$": "$", "&": "&", "_": "_", "#": "#", "|": "‖",
+	// Spacing
+	",": " ", ":": " ", ";": " ", " ": " ", "!": "", "quad": "  ", "qquad": "    ",
+}
+
+var functionNames = map[string]bool{
+	"sin": true, "cos": true, "tan": true, "cot": true, "sec": true, "csc": true,
+	"arcsin": true, "arccos": true, "arctan": true, "sinh": true, "cosh": true, "tanh": true,
+	"log": true, "ln": true, "lg": true, "exp": true, "det": true, "dim": true, "ker": true,
+	"deg": true, "gcd": true, "arg": true, "hom": true,
+	"lim": true, "sup": true, "inf": true, "max": true, "min": true, "limsup": true, "liminf": true,
+	"Pr": true,
+}
+
+var bigOperators = map[string]bool{
+	"∑": true, "∏": true, "∐": true, "⋃": true, "⋂": true, "⨁": true, "⨂": true,
+	"lim": true, "max": true, "min": true, "sup": true, "inf": true, "limsup": true, "liminf": true,
+}
+
+var spacedSymbols = map[string]bool{
+	"=": true, "<": true, ">": true, "+": true, "−": true, "±": true, "∓": true, "×": true,
+	"÷": true, "⋅": true, "≤": true, "≥": true, "≠": true, "≈": true, "≡": true, "∼": true,
+	"≃": true, "≅": true, "∝": true, "≪": true, "≫": true, "∈": true, "∉": true, "∋": true,
+	"⊂": true, "⊃": true, "⊆": true, "⊇": true, "→": true, "←": true, "↔": true, "⇒": true,
+	"⇐": true, "⇔": true, "⟹": true, "⟺": true, "↦": true, "⟶": true, "⟵": true, "∪": true,
+	"∩": true, "∖": true, "∧": true, "∨": true, "⊕": true, "⊗": true, "∘": true, "∣": true,
+}
+
+var superscripts = map[rune]rune{
+	'0': '⁰', '1': '¹', '2': '²', '3': '³', '4': '⁴', '5': '⁵', '6': '⁶', '7': '⁷', '8': '⁸', '9': '⁹',
+	'+': '⁺', '-': '⁻', '−': '⁻', '=': '⁼', '(': '⁽', ')': '⁾',
+	'a': 'ᵃ', 'b': 'ᵇ', 'c': 'ᶜ', 'd': 'ᵈ', 'e': 'ᵉ', 'f': 'ᶠ', 'g': 'ᵍ', 'h': 'ʰ', 'i': 'ⁱ',
+	'j': 'ʲ', 'k': 'ᵏ', 'l': 'ˡ', 'm': 'ᵐ', 'n': 'ⁿ', 'o': 'ᵒ', 'p': 'ᵖ', 'r': 'ʳ', 's': 'ˢ',
+	't': 'ᵗ', 'u': 'ᵘ', 'v': 'ᵛ', 'w': 'ʷ', 'x': 'ˣ', 'y': 'ʸ', 'z': 'ᶻ',
+	'T': 'ᵀ', '′': '′', '*': '*', '∗': '*',
+}
+
+var subscripts = map[rune]rune{
+	'0': '₀', '1': '₁', '2': '₂', '3': '₃', '4': '₄', '5': '₅', '6': '₆', '7': '₇', '8': '₈', '9': '₉',
+	'+': '₊', '-': '₋', '−': '₋', '=': '₌', '(': '₍', ')': '₎',
+	'a': 'ₐ', 'e': 'ₑ', 'h': 'ₕ', 'i': 'ᵢ', 'j': 'ⱼ', 'k': 'ₖ', 'l': 'ₗ', 'm': 'ₘ', 'n': 'ₙ',
+	'o': 'ₒ', 'p': 'ₚ', 'r': 'ᵣ', 's': 'ₛ', 't': 'ₜ', 'u': 'ᵤ', 'v': 'ᵥ', 'x': 'ₓ',
+}
+
+var accents = map[string]rune{
+	"hat": '̂', "widehat": '̂', "bar": '̅', "overline": '̅',
+	"vec": '⃗', "dot": '̇', "ddot": '̈', "tilde": '̃',
+	"widetilde": '̃', "underline": '̲', "check": '̌', "breve": '̆',
+}
+
+// applyAccent adds a combining mark to s. Line accents are repeated over
+// every character; point accents go on a single character or the end.
+func applyAccent(s string, mark rune, name string) string {
+	lineAccent := name == "bar" || name == "overline" || name == "underline"
+	var b strings.Builder
+	for _, r := range s {
+		b.WriteRune(r)
+		if lineAccent {
+			b.WriteRune(mark)
+		}
+	}
+	if !lineAccent {
+		b.WriteRune(mark)
+	}
+	return b.String()
+}
+
+// mapLetters converts ASCII letters using a font offset table such as \mathbb.
+func mapLetters(s string, table map[rune]rune) string {
+	var b strings.Builder
+	for _, r := range s {
+		if m, ok := table[r]; ok {
+			b.WriteRune(m)
+		} else {
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
+}
+
+var blackboard = map[rune]rune{
+	'C': 'ℂ', 'H': 'ℍ', 'N': 'ℕ', 'P': 'ℙ', 'Q': 'ℚ', 'R': 'ℝ', 'Z': 'ℤ',
+	'A': '𝔸', 'B': '𝔹', 'D': '𝔻', 'E': '𝔼', 'F': '𝔽', 'G': '𝔾', 'I': '𝕀', 'J': '𝕁',
+	'K': '𝕂', 'L': '𝕃', 'M': '𝕄', 'O': '𝕆', 'S': '𝕊', 'T': '𝕋', 'U': '𝕌', 'V': '𝕍',
+	'W': '𝕎', 'X': '𝕏', 'Y': '𝕐', '1': '𝟙',
+}
+
+var calligraphic = map[rune]rune{
+	'A': '𝒜', 'B': 'ℬ', 'C': '𝒞', 'D': '𝒟', 'E': 'ℰ', 'F': 'ℱ', 'G': '𝒢', 'H': 'ℋ',
+	'I': 'ℐ', 'J': '𝒥', 'K': '𝒦', 'L': 'ℒ', 'M': 'ℳ', 'N': '𝒩', 'O': '𝒪', 'P': '𝒫',
+	'Q': '𝒬', 'R': 'ℛ', 'S': '𝒮', 'T': '𝒯', 'U': '𝒰', 'V': '𝒱', 'W': '𝒲', 'X': '𝒳',
+	'Y': '𝒴', 'Z': '𝒵',
+}
+
+// delimiter pieces for stretching brackets over several rows: top, middle, bottom.
+var tallDelimiters = map[string][3]string{
+	"(": {"⎛", "⎜", "⎝"}, ")": {"⎞", "⎟", "⎠"},
+	"[": {"⎡", "⎢", "⎣"}, "]": {"⎤", "⎥", "⎦"},
+	"{": {"⎧", "⎪", "⎩"}, "}": {"⎫", "⎪", "⎭"},
+	"|": {"│", "│", "│"}, "‖": {"‖", "‖", "‖"},
+	"⌈": {"⎡", "⎢", "⎢"}, "⌉": {"⎤", "⎥", "⎥"},
+	"⌊": {"⎢", "⎢", "⎣"}, "⌋": {"⎥", "⎥", "⎦"},
+}
+
+// delimiterBox draws a delimiter as tall as h rows with the given baseline.
+func delimiterBox(d string, h, baseline int) textBox {
+	if d == "" || d == "." {
+		return textBox{lines: make([]string, h), baseline: baseline}
+	}
+	pieces, ok := tallDelimiters[d]
+	if h <= 1 || !ok {
+		lines := make([]string, max(h, 1))
+		for i := range lines {
+			lines[i] = d
+		}
+		return textBox{lines: lines, baseline: baseline}
+	}
+	lines := make([]string, h)
+	for i := range lines {
+		switch i {
+		case 0:
+			lines[i] = pieces[0]
+		case h - 1:
+			lines[i] = pieces[2]
+		default:
+			lines[i] = pieces[1]
+		}
+	}
+	if d == "{" || d == "}" {
+		if h >= 3 {
+			mid := map[string]string{"{": "⎨", "}": "⎬"}[d]
+			lines[h/2] = mid
+		}
+	}
+	return textBox{lines: lines, baseline: baseline}
+}
+
+// unicodeParser converts LaTeX math into text boxes.
+type unicodeParser struct {
+	src    []rune
+	pos    int
+	inline bool
+}
+
+// ToUnicode converts a LaTeX math expression into a best-effort Unicode
+// rendering. Display math may span several lines to lay out fractions and
+// matrices; inline math always produces a single line.
+func ToUnicode(math string, isInline bool) []string {
+	if NeedsPDFPipeline(math) {
+		return []string{"⟨diagram⟩"}
+	}
+	p := &unicodeParser{src: []rune(strings.TrimSpace(math)), inline: isInline}
+	rows := p.parseRows("")
+	var box textBox
+	if len(rows) == 1 && len(rows[0]) == 1 {
+		box = rows[0][0]
+	} else {
+		box = p.layoutGrid(rows, "gather")
+	}
+	lines := make([]string, 0, box.height())
+	for _, l := range box.lines {
+		lines = append(lines, strings.TrimRight(l, " "))
+	}
+	if len(lines) == 0 {
+		return []string{""}
+	}
+	return lines
+}
+
+func (p *unicodeParser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *unicodeParser) peek() rune {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *unicodeParser) skipSpace() {
+	for !p.eof() && unicode.IsSpace(p.src[p.pos]) {
+		p.pos++
+	}
+}
+
+// readCommand reads a control sequence name after the backslash.
+func (p *unicodeParser) readCommand() string {
+	p.pos++ // backslash
+	if p.eof() {
+		return ""
+	}
+	start := p.pos
+	if unicode.IsLetter(p.src[p.pos]) {
+		for !p.eof() && unicode.IsLetter(p.src[p.pos]) {
+			p.pos++
+		}
+		name := string(p.src[start:p.pos])
+		if name == "operatorname" && p.peek() == '*' {
+			p.pos++
+		}
+		return name
+	}
+	p.pos++
+	return string(p.src[start:p.pos])
+}
+
+// peekCommand returns the control sequence at the current position without
+// consuming it.
+func (p *unicodeParser) peekCommand() string {
+	if p.peek() != '\\' {
+		return ""
+	}
+	save := p.pos
+	name := p.readCommand()
+	p.pos = save
+	return name
+}
+
+// readRawGroup returns the raw text of a {...} group, or a single character.
+func (p *unicodeParser) readRawGroup() string {
+	p.skipSpace()
+	if p.peek() != '{' {
+		if p.eof() {
+			return ""
+		}
+		r := p.src[p.pos]
+		p.pos++
+		return string(r)
+	}
+	p.pos++
+	depth := 1
+	start := p.pos
+	for !p.eof() {
+		switch p.src[p.pos] {
+		case '\\':
+			p.pos++
+		case '{':
+			depth++
+		case '}':
+			depth--
+			if depth == 0 {
+				s := string(p.src[start:p.pos])
+				p.pos++
+				return s
+			}
+		}
+		p.pos++
+	}
+	return string(p.src[start:])
+}
+
+// readOptional reads a [..] argument if present.
+func (p *unicodeParser) readOptional() (string, bool) {
+	p.skipSpace()
+	if p.peek() != '[' {
+		return "", false
+	}
+	start := p.pos + 1
+	for i := start; i < len(p.src); i++ {
+		if p.src[i] == ']' {
+			p.pos = i + 1
+			return string(p.src[start:i]), true
+		}
+	}
+	return "", false
+}
+
+// sub parses a nested expression with the same mode.
+func (p *unicodeParser) sub(src string) textBox {
+	q := &unicodeParser{src: []rune(src), inline: p.inline}
+	rows := q.parseRows("")
+	if len(rows) == 1 && len(rows[0]) == 1 {
+		return rows[0][0]
+	}
+	return q.layoutGrid(rows, "gather")
+}
+
+// parseArg parses one argument: a group, a command, or a single character.
+func (p *unicodeParser) parseArg() textBox {
+	p.skipSpace()
+	if p.peek() == '{' {
+		return p.sub(p.readRawGroup())
+	}
+	items := p.parseAtom(nil)
+	return hcat(items...)
+}
+
+// parseRows parses until the matching \end{env} (or the end of input when env
+// is empty), splitting on \\ into rows and & into cells.
+func (p *unicodeParser) parseRows(env string) [][]textBox {
+	var rows [][]textBox
+	var cells []textBox
+	var items []textBox
+
+	flushCell := func() {
+		cells = append(cells, p.joinItems(items))
+		items = nil
+	}
+	flushRow := func() {
+		flushCell()
+		rows = append(rows, cells)
+		cells = nil
+	}
+
+	for !p.eof() {
+		r := p.peek()
+		switch {
+		case r == '&':
+			p.pos++
+			flushCell()
+			continue
+		case r == '\\':
+			name := p.peekCommand()
+			if name == "\\" || name == "cr" {
+				p.readCommand()
+				p.readOptional()
+				flushRow()
+				continue
+			}
+			if name == "end" {
+				p.readCommand()
+				p.readRawGroup()
+				if env != "" {
+					flushRow()
+					return rows
+				}
+				continue
+			}
+		}
+		items = p.parseAtom(items)
+	}
+	flushRow()
+	// Drop a trailing empty row left by a final \\.
+	if n := len(rows); n > 1 && len(rows[n-1]) == 1 && rows[n-1][0].empty() {
+		rows = rows[:n-1]
+	}
+	return rows
+}
+
+// joinItems concatenates a run of atoms, spacing out relations, binary
+// operators, commas, and function names the way TeX would.
+func (p *unicodeParser) joinItems(items []textBox) textBox {
+	var out []textBox
+	for i, it := range items {
+		s, ok := it.flat()
+		switch {
+		case ok && spacedSymbols[s]:
+			isSign := s == "−" || s == "+" || s == "±"
+			if isSign && (i == 0 || isUnaryContext(items[i-1])) {
+				out = append(out, it)
+				continue
+			}
+			out = append(out, atomBox(" "), it, atomBox(" "))
+		case ok && (s == "," || functionNames[s]) && i < len(items)-1:
+			out = append(out, it)
+			if next, ok := items[i+1].flat(); !ok || !strings.HasPrefix(next, "(") || s == "," {
+				out = append(out, atomBox(" "))
+			}
+		default:
+			out = append(out, it)
+		}
+	}
+	if len(out) == 0 {
+		return atomBox("")
+	}
+	return hcat(out...)
+}
+
+// isUnaryContext reports whether a sign following prev is a unary sign.
+func isUnaryContext(prev textBox) bool {
+	s, ok := prev.flat()
+	return ok && (spacedSymbols[s] || s == "(" || s == "[" || s == "{" || s == "," || s == "")
+}
+
+// parseAtom parses the next token and appends the resulting boxes to items.
+// Scripts modify the last item in place.
+func (p *unicodeParser) parseAtom(items []textBox) []textBox {
+	r := p.peek()
+	switch {
+	case p.eof():
+		// A command or script missing its argument gets an empty one.
+		return append(items, atomBox(""))
+	case unicode.IsSpace(r):
+		p.pos++
+		return items
+	case r == '{':
+		return append(items, p.sub(p.readRawGroup()))
+	case r == '}':
+		p.pos++
+		return items
+	case r == '^' || r == '_':
+		p.pos++
+		var base textBox
+		if len(items) > 0 {
+			base = items[len(items)-1]
+			items = items[:len(items)-1]
+		} else {
+			base = atomBox("")
+		}
+		var sup, sub *textBox
+		arg := p.parseArg()
+		if r == '^' {
+			sup = &arg
+		} else {
+			sub = &arg
+		}
+		p.skipSpace()
+		if next := p.peek(); (next == '^' && sup == nil) || (next == '_' && sub == nil) {
+			p.pos++
+			arg2 := p.parseArg()
+			if next == '^' {
+				sup = &arg2
+			} else {
+				sub = &arg2
+			}
+		}
+		return append(items, p.attachScripts(base, sup, sub))
+	case r == '\'':
+		p.pos++
+		if len(items) > 0 {
+			items[len(items)-1] = hcat(items[len(items)-1], atomBox("′"))
+			return items
+		}
+		return append(items, atomBox("′"))
+	case r == '-':
+		p.pos++
+		return append(items, atomBox("−"))
+	case r == '~':
+		p.pos++
+		return append(items, atomBox(" "))
+	case r == '\\':
+		return p.parseCommand(items)
+	default:
+		p.pos++
+		return append(items, atomBox(string(r)))
+	}
+}
+
+// scriptText converts s to Unicode super- or subscript characters when every
+// rune has an equivalent.
+func scriptText(s string, table map[rune]rune) (string, bool) {
+	var b strings.Builder
+	for _, r := range s {
+		if r == ' ' {
+			continue
+		}
+		m, ok := table[r]
+		if !ok {
+			return "", false
+		}
+		b.WriteRune(m)
+	}
+	return b.String(), true
+}
+
+func wrapParens(s string) string {
+	if ansi.StringWidth(s) <= 1 {
+		return s
+	}
+	return "(" + s + ")"
+}
+
+// attachScripts attaches super/subscripts to a base box.
+func (p *unicodeParser) attachScripts(base textBox, sup, sub *textBox) textBox {
+	baseText, baseFlat := base.flat()
+	if !p.inline && baseFlat && bigOperators[baseText] {
+		parts := []textBox{}
+		idx := 0
+		if sup != nil {
+			parts = append(parts, *sup)
+			idx = 1
+		}
+		parts = append(parts, base)
+		if sub != nil {
+			parts = append(parts, *sub)
+		}
+		return vstack(idx, parts...)
+	}
+
+	supText, supOK := scriptAtom(sup, superscripts)
+	subText, subOK := scriptAtom(sub, subscripts)
+	if p.inline || (sup == nil || supOK) && (sub == nil || subOK) {
+		parts := []textBox{base}
+		if sup != nil {
+			parts = append(parts, atomBox(inlineScript(sup, supText, supOK, "^")))
+		}
+		if sub != nil {
+			parts = append(parts, atomBox(inlineScript(sub, subText, subOK, "_")))
+		}
+		return hcat(parts...)
+	}
+
+	// Display scripts that have no Unicode equivalent are raised or lowered
+	// onto their own rows, stacked in one column when both are present.
+	var column textBox
+	switch {
+	case sup != nil && sub != nil:
+		column = textBox{baseline: sup.height()}
+		column.lines = append(column.lines, sup.lines...)
+		column.lines = append(column.lines, "")
+		column.lines = append(column.lines, sub.lines...)
+		w := max(sup.width(), sub.width())
+		for i, l := range column.lines {
+			column.lines[i] = padRight(l, w)
+		}
+	case sup != nil:
+		column = *sup
+		column.baseline = sup.height()
+	default:
+		column = *sub
+		column.baseline = -1
+	}
+	return hcat(base, column)
+}
+
+// scriptAtom converts a script box to Unicode script characters if possible.
+func scriptAtom(b *textBox, table map[rune]rune) (string, bool) {
+	if b == nil {
+		return "", false
+	}
+	s, ok := b.flat()
+	if !ok {
+		return "", false
+	}
+	return scriptText(s, table)
+}
+
+// inlineScript renders a script on the baseline, falling back to ^(...) or
+// _(...) when no Unicode script form exists.
+func inlineScript(b *textBox, converted string, ok bool, marker string) string {
+	if ok {
+		return converted
+	}
+	s, flat := b.flat()
+	if !flat {
+		s = "…"
+	}
+	return marker + wrapParens(s)
+}
+
+// parseCommand handles a control sequence.
+func (p *unicodeParser) parseCommand(items []textBox) []textBox {
+	name := p.readCommand()
+
+	if sym, ok := unicodeSymbols[name]; ok {
+		return append(items, atomBox(sym))
+	}
+	if functionNames[name] {
+		return append(items, atomBox(name))
+	}
+	if mark, ok := accents[name]; ok {
+		arg := p.parseArg()
+		s, ok := arg.flat()
+		if !ok || s == "" {
+			return append(items, arg)
+		}
+		return append(items, atomBox(applyAccent(s, mark, name)))
+	}
+
+	switch name {
+	case "frac", "dfrac", "tfrac", "cfrac":
+		num := p.parseArg()
+		den := p.parseArg()
+		if p.inline || name == "tfrac" {
+			n, _ := num.flat()
+			d, _ := den.flat()
+			return append(items, atomBox(fracOperand(n)+"/"+fracOperand(d)))
+		}
+		w := max(num.width(), den.width())
+		bar := atomBox(strings.Repeat("─", w+2))
+		return append(items, vstack(1, num, bar, den))
+	case "binom":
+		n := p.parseArg()
+		k := p.parseArg()
+		if p.inline {
+			a, _ := n.flat()
+			b, _ := k.flat()
+			return append(items, atomBox("C("+a+", "+b+")"))
+		}
+		inner := vstack(0, n, k)
+		inner.baseline = 0
+		if inner.height() == 2 {
+			inner.baseline = 1
+		}
+		h := inner.height()
+		return append(items, hcat(delimiterBox("(", h, inner.baseline), inner, delimiterBox(")", h, inner.baseline)))
+	case "sqrt":
+		index, hasIndex := p.readOptional()
+		arg := p.parseArg()
+		prefix := "√"
+		if hasIndex {
+			if u, ok := scriptText(index, superscripts); ok {
+				prefix = u + "√"
+			}
+		}
+		if s, ok := arg.flat(); ok {
+			if ansi.StringWidth(s) > 1 {
+				s = "(" + s + ")"
+			}
+			return append(items, atomBox(prefix+s))
+		}
+		return append(items, hcat(atomBox(prefix), delimiterBox("(", arg.height(), arg.baseline), arg,
+			delimiterBox(")", arg.height(), arg.baseline)))
+	case "text", "textrm", "textit", "textbf", "mbox", "mathrm", "mathit", "mathbf", "mathsf",
+		"mathtt", "boldsymbol", "bm", "operatorname", "operatorname*":
+		raw := p.readRawGroup()
+		if strings.HasPrefix(name, "text") || name == "mbox" {
+			return append(items, atomBox(raw))
+		}
+		return append(items, p.sub(raw))
+	case "mathbb":
+		return append(items, atomBox(mapLetters(p.readRawGroup(), blackboard)))
+	case "mathcal", "mathscr":
+		return append(items, atomBox(mapLetters(p.readRawGroup(), calligraphic)))
+	case "left", "bigl", "Bigl", "biggl", "Biggl", "big", "Big", "bigg", "Bigg":
+		if name != "left" {
+			return append(items, atomBox(p.readDelimiter()))
+		}
+		open := p.readDelimiter()
+		inner, closing := p.parseUntilRight()
+		if p.inline {
+			s, _ := inner.flat()
+			return append(items, atomBox(open+s+closing))
+		}
+		h := inner.height()
+		return append(items, hcat(delimiterBox(open, h, inner.baseline), inner, delimiterBox(closing, h, inner.baseline)))
+	case "right", "bigr", "Bigr", "biggr", "Biggr":
+		return append(items, atomBox(p.readDelimiter()))
+	case "begin":
+		env := p.readRawGroup()
+		if strings.HasPrefix(env, "array") || env == "tabular" {
+			p.readRawGroup()
+		}
+		if env == "alignat" || env == "alignat*" {
+			p.readRawGroup()
+		}
+		rows := p.parseRows(env)
+		return append(items, p.layoutGrid(rows, env))
+	case "label", "nonumber", "notag", "displaystyle", "textstyle", "scriptstyle", "limits",
+		"nolimits", "phantom", "hphantom", "vphantom":
+		if name == "label" || strings.HasSuffix(name, "phantom") {
+			p.readRawGroup()
+		}
+		return items
+	case "tag":
+		return append(items, atomBox("  ("+p.readRawGroup()+")"))
+	case "not":
+		next := p.parseArg()
+		s, _ := next.flat()
+		return append(items, atomBox(s+"̸"))
+	case "overset", "stackrel":
+		top := p.parseArg()
+		base := p.parseArg()
+		if p.inline {
+			return append(items, base)
+		}
+		return append(items, vstack(1, top, base))
+	case "underset":
+		bottom := p.parseArg()
+		base := p.parseArg()
+		if p.inline {
+			return append(items, base)
+		}
+		return append(items, vstack(0, base, bottom))
+	}
+
+	return append(items, atomBox("\\"+name))
+}
+
+func fracOperand(s string) string {
+	for _, r := range s {
+		if !unicode.IsLetter(r) && !unicode.IsNumber(r) && r != '.' {
+			return "(" + s + ")"
+		}
+	}
+	return s
+}
+
+// readDelimiter reads the delimiter token following \left or \right.
+func (p *unicodeParser) readDelimiter() string {
+	p.skipSpace()
+	if p.eof() {
+		return ""
+	}
+	if p.peek() == '\\' {
+		name := p.readCommand()
+		if sym, ok := unicodeSymbols[name]; ok {
+			return sym
+		}
+		switch name {
+		case "vert":
+			return "|"
+		case "Vert":
+			return "‖"
+		}
+		return ""
+	}
+	r := p.src[p.pos]
+	p.pos++
+	if r == '.' {
+		return ""
+	}
+	return string(r)
+}
+
+// parseUntilRight parses the body of \left ... \right and returns the inner
+// box along with the closing delimiter.
+func (p *unicodeParser) parseUntilRight() (textBox, string) {
+	var items []textBox
+	depth := 0
+	for !p.eof() {
+		if p.peek() == '\\' {
+			switch p.peekCommand() {
+			case "left":
+				depth++
+			case "right":
+				if depth == 0 {
+					p.readCommand()
+					return p.joinItems(items), p.readDelimiter()
+				}
+				depth--
+			}
+		}
+		items = p.parseAtom(items)
+	}
+	return p.joinItems(items), ""
+}
+
+// layoutGrid lays out rows of cells for matrix and alignment environments.
+func (p *unicodeParser) layoutGrid(rows [][]textBox, env string) textBox {
+	env = strings.TrimSuffix(env, "*")
+	isMatrix := strings.HasSuffix(env, "matrix") || env == "array" || env == "cases"
+	isAlign := env == "align" || env == "aligned" || env == "alignat" || env == "split" || env == "eqnarray"
+
+	if p.inline {
+		var rowStrs []string
+		for _, row := range rows {
+			var cells []string
+			for _, c := range row {
+				s, _ := c.flat()
+				cells = append(cells, strings.TrimSpace(s))
+			}
+			sep := " "
+			if isAlign {
+				sep = ""
+			}
+			rowStrs = append(rowStrs, strings.Join(cells, sep))
+		}
+		joined := strings.Join(rowStrs, "; ")
+		open, closing := matrixDelimiters(env)
+		if open == "" && closing == "" && isMatrix {
+			open, closing = "[", "]"
+		}
+		return atomBox(open + joined + closing)
+	}
+
+	ncols := 0
+	for _, row := range rows {
+		ncols = max(ncols, len(row))
+	}
+	colWidths := make([]int, ncols)
+	for _, row := range rows {
+		for i, c := range row {
+			colWidths[i] = max(colWidths[i], c.width())
+		}
+	}
+
+	var rowBoxes []textBox
+	for _, row := range rows {
+		var parts []textBox
+		for i := range ncols {
+			cell := atomBox("")
+			if i < len(row) {
+				cell = row[i]
+			}
+			aligned := textBox{baseline: cell.baseline}
+			for _, l := range cell.lines {
+				switch {
+				case env == "cases" || isAlign && i%2 == 1:
+					l = padRight(l, colWidths[i])
+				case isAlign:
+					l = padLeft(l, colWidths[i])
+				default:
+					l = padCenter(l, colWidths[i])
+				}
+				aligned.lines = append(aligned.lines, l)
+			}
+			if i > 0 && (!isAlign || i%2 == 0) {
+				parts = append(parts, atomBox("  "))
+			}
+			parts = append(parts, aligned)
+		}
+		rowBoxes = append(rowBoxes, hcat(parts...))
+	}
+
+	var lines []string
+	for _, rb := range rowBoxes {
+		lines = append(lines, rb.lines...)
+	}
+	w := 0
+	for _, l := range lines {
+		w = max(w, ansi.StringWidth(l))
+	}
+	for i, l := range lines {
+		lines[i] = padRight(l, w)
+	}
+	grid := textBox{lines: lines, baseline: (len(lines) - 1) / 2}
+
+	open, closing := matrixDelimiters(env)
+	if open == "" && closing == "" {
+		return grid
+	}
+	h := grid.height()
+	return hcat(delimiterBox(open, h, grid.baseline), atomBox(" "), grid, atomBox(" "), delimiterBox(closing, h, grid.baseline))
+}
+
+func matrixDelimiters(env string) (string, string) {
+	switch env {
+	case "pmatrix":
+		return "(", ")"
+	case "bmatrix":
+		return "[", "]"
+	case "Bmatrix":
+		return "{", "}"
+	case "vmatrix":
+		return "|", "|"
+	case "Vmatrix":
+		return "‖", "‖"
+	case "cases":
+		return "{", ""
+	}
+	return "", ""
+}
@@ -24,6 +24,11 @@ var (
 	ColorRed    = lipgloss.Color("#F38BA8")
 	ColorYellow = lipgloss.Color("#F9E2AF")
 
+	// Rendered math uses the Mocha text colour on dark terminals and the
+	// Latte text colour on light ones.
+	ColorMathDark  = ColorText
+	ColorMathLight = lipgloss.Color("#4C4F69")
+
 	ColorNormalMode  = ColorBlue
 	ColorInsertMode  = ColorGreen
 	ColorSelectMode  = ColorPurple
@@ -106,6 +111,8 @@ var (
 	CurrentLineStyle  = lipgloss.NewStyle().Foreground(lipgloss.Color("#FF5F87")).Bold(true)
 	TabHighlightStyle = lipgloss.NewStyle().Background(ColorOverlay)
 	SelectionStyle    = lipgloss.NewStyle().Background(lipgloss.Color("#5c5c8a"))
+	MathTextStyle     = lipgloss.NewStyle().Foreground(ColorText)
+	ErrorLineStyle    = lipgloss.NewStyle().Underline(true).UnderlineStyle(lipgloss.UnderlineCurly).UnderlineColor(ColorRed)
 
 	MathGutterIndicator  = lipgloss.NewStyle().Foreground(lipgloss.Color("69")).Render("│")
 	TextGutterIndicator  = lipgloss.NewStyle().Foreground(lipgloss.Color("240")).Render("│")
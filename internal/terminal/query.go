@@ -0,0 +1,88 @@
+package terminal
+
+import (
+	"errors"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+	"golang.org/x/term"
+)
+
+// ErrNoReply is returned by Query when the terminal does not finish its
+// reply before the timeout.
+var ErrNoReply = errors.New("terminal did not reply")
+
+// Query writes a query to the controlling terminal and returns what it
+// replies, reading until complete reports the reply is whole or timeout
+// passes. The terminal is in raw mode meanwhile, so the reply is neither
+// echoed nor left behind for the next program to read.
+func Query(query string, timeout time.Duration, complete func(reply string) bool) (string, error) {
+	tty, err := os.OpenFile("/dev/tty", os.O_RDWR, 0)
+	if err != nil {
+		return "", err
+	}
+	defer tty.Close()
+	fd := int(tty.Fd())
+	state, err := term.MakeRaw(fd)
+	if err != nil {
+		return "", err
+	}
+	defer term.Restore(fd, state)
+
+	if _, err := tty.WriteString(query); err != nil {
+		return "", err
+	}
+
+	var reply strings.Builder
+	buf := make([]byte, 1024)
+	deadline := time.Now().Add(timeout)
+	for !complete(reply.String()) {
+		wait := time.Until(deadline)
+		if wait <= 0 {
+			return reply.String(), ErrNoReply
+		}
+		// select rather than poll, which macOS does not support on ttys.
+		var fds unix.FdSet
+		fds.Set(fd)
+		tv := unix.NsecToTimeval(wait.Nanoseconds())
+		n, err := unix.Select(fd+1, &fds, nil, nil, &tv)
+		if errors.Is(err, unix.EINTR) {
+			continue
+		}
+		if err != nil {
+			return reply.String(), err
+		}
+		if n == 0 {
+			continue
+		}
+		n, err = tty.Read(buf)
+		if err != nil {
+			return reply.String(), err
+		}
+		reply.Write(buf[:n])
+	}
+	return reply.String(), nil
+}
+
+// InTmux reports whether quasar runs inside tmux.
+func InTmux() bool {
+	return os.Getenv("TMUX") != ""
+}
+
+// Passthrough wraps an escape sequence so tmux forwards it to the terminal
+// it runs in rather than interpreting it. Outside tmux it is returned as is.
+func Passthrough(seq string) string {
+	if !InTmux() {
+		return seq
+	}
+	return "\x1bPtmux;" + strings.ReplaceAll(seq, "\x1b", "\x1b\x1b") + "\x1b\\"
+}
+
+// EnableTmuxPassthrough allows the current tmux pane to forward wrapped
+// sequences, which tmux blocks by default.
+func EnableTmuxPassthrough() error {
+	return exec.Command("tmux", "set", "-p", "allow-passthrough", "on").Run()
+}
@@ -2,6 +2,7 @@
 package autocomplete
 
 import (
+	"image"
 	"sort"
 	"strings"
 
@@ -30,6 +31,7 @@ var Commands = []SlashCommand{
 	{Trigger: "inlinecode", Label: "Inline Code", Snippet: "``", CursorPos: 1},
 	{Trigger: "inlinemath", Label: "Inline Math", Snippet: "$$", CursorPos: 1},
 	{Trigger: "math", Label: "Math Block", Snippet: "$$\n\n$$", CursorPos: 3},
+	{Trigger: "dot", Label: "Graphviz Diagram", Snippet: "```dot\n\n```", CursorPos: 7},
 	{Trigger: "bold", Label: "Bold", Snippet: "****", CursorPos: 2},
 	{Trigger: "italic", Label: "Italic", Snippet: "**", CursorPos: 1},
 	{Trigger: "strikethrough", Label: "Strikethrough", Snippet: "~~~~", CursorPos: 2},
@@ -186,6 +188,22 @@ func (a Box) Render(view string) string {
 		return view
 	}
 
+	bgLayer := lipgloss.NewLayer(view)
+	dialogLayer := lipgloss.NewLayer(a.box()).X(a.x).Y(a.y).Z(2)
+	compositor := lipgloss.NewCompositor(bgLayer, dialogLayer)
+	return compositor.Render()
+}
+
+// Bounds returns the area of the screen the box covers when rendered.
+func (a Box) Bounds() image.Rectangle {
+	if !a.active || len(a.matches) == 0 {
+		return image.Rectangle{}
+	}
+	box := a.box()
+	return image.Rect(a.x, a.y, a.x+lipgloss.Width(box), a.y+lipgloss.Height(box))
+}
+
+func (a Box) box() string {
 	style := styles.DefaultDialogStyle()
 	selectedStyle := lipgloss.NewStyle().
 		Foreground(style.KeyColor).
@@ -227,15 +245,10 @@ func (a Box) Render(view string) string {
 	content := strings.Join(lines, "\n")
 
 	const fixedWidth = 28
-	box := lipgloss.NewStyle().
+	return lipgloss.NewStyle().
 		Border(lipgloss.RoundedBorder()).
 		BorderForeground(style.BorderColor).
 		Padding(0, 1).
 		Width(fixedWidth).
 		Render(content)
-
-	bgLayer := lipgloss.NewLayer(view)
-	dialogLayer := lipgloss.NewLayer(box).X(a.x).Y(a.y).Z(2)
-	compositor := lipgloss.NewCompositor(bgLayer, dialogLayer)
-	return compositor.Render()
 }
@@ -58,6 +58,10 @@ func (m *Model) executeCommand() bool {
 		m.CmdInput.SetValue("")
 		m.CmdInput.Blur()
 		return false
+	case "images":
+		images, refs := m.images.Live()
+		m.StatusMessage = fmt.Sprintf("%d images in terminal, %d placements", images, refs)
+		return false
 	case "delete", "del":
 		if m.CurrentFile == "" {
 			m.StatusMessage = "No file open to delete"
@@ -119,11 +123,15 @@ func (m *Model) confirmAutocomplete() {
 	runes := []rune(line)
 
 	newLine := string(runes[:m.slashStartCol]) + string(runes[m.Editor.Cursor.Col:])
-	block.Lines[m.Editor.Cursor.LineIdx] = newLine
+	m.Editor.SetLine(m.Editor.Cursor.BlockIdx, m.Editor.Cursor.LineIdx, newLine)
 	m.Editor.Cursor.Col = m.slashStartCol
 
-	if cmd.Trigger == "math" {
-		m.insertMathBlock()
+	if cmd.Trigger == "math" || cmd.Trigger == "dot" {
+		if cmd.Trigger == "math" {
+			m.insertMathBlock()
+		} else {
+			m.insertDiagramBlock()
+		}
 		m.Autocomplete.Close()
 		block.IsDirty = true
 		return
@@ -1,6 +1,7 @@
 package dialog
 
 import (
+	"image"
 	"strings"
 
 	"charm.land/bubbles/v2/textinput"
@@ -10,8 +11,8 @@ import (
 )
 
 // RenderCommandBar renders the command line dialog and returns the updated
-// view and cursor configuration.
-func RenderCommandBar(cmdInput textinput.Model, view string, dim Dimensions) (string, tea.Cursor) {
+// view, cursor configuration, and the area the dialog covers.
+func RenderCommandBar(cmdInput textinput.Model, view string, dim Dimensions) (string, tea.Cursor, image.Rectangle) {
 	dialogWidth := 40
 	dialogX := (dim.Width - dialogWidth) / 2
 	dialogY := 1
@@ -60,5 +61,5 @@ func RenderCommandBar(cmdInput textinput.Model, view string, dim Dimensions) (st
 		}
 	}
 
-	return view, cursorConfig
+	return view, cursorConfig, boxBounds(dialogBox, dialogX, dialogY)
 }
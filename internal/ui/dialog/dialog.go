@@ -2,6 +2,7 @@
 package dialog
 
 import (
+	"image"
 	"strings"
 
 	tea "charm.land/bubbletea/v2"
@@ -41,8 +42,9 @@ func (d *BaseDialog) Deactivate() {
 	d.Active = false
 }
 
-// centerDialog properly centers a rendered dialog box on the screen.
-func centerDialog(view, dialogBox string, dim Dimensions) string {
+// centerDialog properly centers a rendered dialog box on the screen and
+// returns the area it covers.
+func centerDialog(view, dialogBox string, dim Dimensions) (string, image.Rectangle) {
 	dialogWidth := lipgloss.Width(dialogBox)
 	dialogX := (dim.Width - dialogWidth) / 2
 	dialogY := 2
@@ -50,7 +52,12 @@ func centerDialog(view, dialogBox string, dim Dimensions) string {
 	bgLayer := lipgloss.NewLayer(view)
 	dialogLayer := lipgloss.NewLayer(dialogBox).X(dialogX).Y(dialogY).Z(1)
 	compositor := lipgloss.NewCompositor(bgLayer, dialogLayer)
-	return compositor.Render()
+	return compositor.Render(), boxBounds(dialogBox, dialogX, dialogY)
+}
+
+// boxBounds returns the area covered by a dialog box drawn at x, y.
+func boxBounds(dialogBox string, x, y int) image.Rectangle {
+	return image.Rect(x, y, x+lipgloss.Width(dialogBox), y+lipgloss.Height(dialogBox))
 }
 
 // ConfirmDialog is a simple yes/no confirmation dialog.
@@ -107,10 +114,11 @@ func (d *ConfirmDialog) MoveRight() {
 	d.focused = 1
 }
 
-// Render renders the confirm dialog centered on the view.
-func (d ConfirmDialog) Render(view string, dim Dimensions) (string, tea.Cursor) {
+// Render renders the confirm dialog centered on the view and returns the
+// area it covers.
+func (d ConfirmDialog) Render(view string, dim Dimensions) (string, tea.Cursor, image.Rectangle) {
 	if !d.Active {
-		return view, tea.Cursor{}
+		return view, tea.Cursor{}, image.Rectangle{}
 	}
 
 	var lines []string
@@ -160,5 +168,6 @@ func (d ConfirmDialog) Render(view string, dim Dimensions) (string, tea.Cursor)
 		Padding(0, 2).
 		Render(content)
 
-	return centerDialog(view, dialogBox, dim), tea.Cursor{}
+	view, bounds := centerDialog(view, dialogBox, dim)
+	return view, tea.Cursor{}, bounds
 }
@@ -1,6 +1,7 @@
 package dialog
 
 import (
+	"image"
 	"strings"
 
 	tea "charm.land/bubbletea/v2"
@@ -21,10 +22,11 @@ func NewErrorDialog() ErrorDialog {
 	}
 }
 
-// Render renders the error dialog centered on the view.
-func (d ErrorDialog) Render(view string, dim Dimensions) (string, tea.Cursor) {
+// Render renders the error dialog centered on the view and returns the
+// area it covers.
+func (d ErrorDialog) Render(view string, dim Dimensions) (string, tea.Cursor, image.Rectangle) {
 	if !d.Active {
-		return view, tea.Cursor{}
+		return view, tea.Cursor{}, image.Rectangle{}
 	}
 
 	style := styles.DefaultDialogStyle()
@@ -73,7 +75,8 @@ func (d ErrorDialog) Render(view string, dim Dimensions) (string, tea.Cursor) {
 		Padding(0, 2).
 		Render(content)
 
-	return centerDialog(view, dialogBox, dim), tea.Cursor{}
+	view, bounds := centerDialog(view, dialogBox, dim)
+	return view, tea.Cursor{}, bounds
 }
 
 // WrapText wraps text to fit within the given width.
@@ -1,6 +1,7 @@
 package dialog
 
 import (
+	"image"
 	"strings"
 
 	tea "charm.land/bubbletea/v2"
@@ -20,10 +21,11 @@ func NewHelpDialog() HelpDialog {
 	}
 }
 
-// Render renders the help dialog centered on the view.
-func (d HelpDialog) Render(view string, dim Dimensions) (string, tea.Cursor) {
+// Render renders the help dialog centered on the view and returns the
+// area it covers.
+func (d HelpDialog) Render(view string, dim Dimensions) (string, tea.Cursor, image.Rectangle) {
 	if !d.Active {
-		return view, tea.Cursor{}
+		return view, tea.Cursor{}, image.Rectangle{}
 	}
 
 	style := styles.DefaultDialogStyle()
@@ -53,6 +55,7 @@ func (d HelpDialog) Render(view string, dim Dimensions) (string, tea.Cursor) {
 	leftLines = append(leftLines, makeLine("h/j/k/l", "move left/down/up/right"))
 	leftLines = append(leftLines, makeLine("gh", "go to start of line"))
 	leftLines = append(leftLines, makeLine("gl", "go to end of line"))
+	leftLines = append(leftLines, makeLine("gd", "go to referenced equation"))
 	leftLines = append(leftLines, makeLine("space+f", "toggle file tree"))
 	leftLines = append(leftLines, makeLine("space+/", "focus file tree"))
 	leftLines = append(leftLines, "")
@@ -151,5 +154,6 @@ func (d HelpDialog) Render(view string, dim Dimensions) (string, tea.Cursor) {
 		Padding(0, 2).
 		Render(content)
 
-	return centerDialog(view, dialogBox, dim), tea.Cursor{}
+	view, bounds := centerDialog(view, dialogBox, dim)
+	return view, tea.Cursor{}, bounds
 }
@@ -1,6 +1,7 @@
 package dialog
 
 import (
+	"image"
 	"strings"
 
 	"charm.land/bubbles/v2/textinput"
@@ -90,10 +91,11 @@ func (d *InputDialog) Update(msg tea.Msg) {
 	d.TextInput, _ = d.TextInput.Update(msg)
 }
 
-// Render renders the input dialog centered on the view.
-func (d InputDialog) Render(view string, dim Dimensions) (string, tea.Cursor) {
+// Render renders the input dialog centered on the view and returns the
+// area it covers.
+func (d InputDialog) Render(view string, dim Dimensions) (string, tea.Cursor, image.Rectangle) {
 	if !d.Active {
-		return view, tea.Cursor{}
+		return view, tea.Cursor{}, image.Rectangle{}
 	}
 
 	titleStyled := lipgloss.NewStyle().
@@ -149,5 +151,5 @@ func (d InputDialog) Render(view string, dim Dimensions) (string, tea.Cursor) {
 		}
 	}
 
-	return view, cursorConfig
+	return view, cursorConfig, boxBounds(dialogBox, dialogX, dialogY)
 }
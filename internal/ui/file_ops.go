@@ -6,8 +6,9 @@ import (
 	"path/filepath"
 	"strings"
 
+	"github.com/RNAV2019/quasar/internal/config"
 	"github.com/RNAV2019/quasar/internal/editor"
-	"github.com/RNAV2019/quasar/internal/latex"
+	"github.com/RNAV2019/quasar/internal/errors"
 	"github.com/RNAV2019/quasar/internal/notebook"
 )
 
@@ -15,18 +16,26 @@ import (
 func (m *Model) loadFile(path string) error {
 	m.fileGeneration++
 	m.PendingRenders = 0
+	m.renderPool.CancelAll()
 
 	for _, block := range m.Editor.Blocks {
-		if block.ImageID != 0 {
-			latex.DeleteImage(block.ImageID)
+		m.images.Release(block.ImageID)
+	}
+	for _, renders := range m.InlineRenders {
+		for _, render := range renders {
+			m.images.Release(render.ImageID)
 		}
 	}
-	for _, render := range m.InlineRenders {
-		if render.ImageID != 0 {
-			latex.DeleteImage(render.ImageID)
+	m.InlineRenders = make(map[int]map[SpanPos]InlineMathRender)
+	m.releaseRetired()
+	for _, renders := range m.Pictures {
+		for _, render := range renders {
+			m.images.Release(render.ImageID)
 		}
 	}
-	m.InlineRenders = make(map[string]InlineMathRender)
+	m.Pictures = make(map[int]map[int]PictureRender)
+	m.evicted = evictionState{}
+	m.clearPreview()
 
 	model, err := editor.LoadFromFile(path)
 	if err != nil {
@@ -40,9 +49,18 @@ func (m *Model) loadFile(path string) error {
 	m.updateEditorSize()
 	m.CurrentFile = path
 
+	if m.NotebookPath != "" {
+		if macros, err := config.LoadMacros(m.NotebookPath); err != nil {
+			errors.AddError(err.Error(), "config")
+		} else {
+			m.notebookMacros = macros
+		}
+	}
+	m.renderMacros = editor.NoteMacros(m.Editor.Blocks, m.notebookMacros)
+
 	hasMath := false
 	for _, block := range m.Editor.Blocks {
-		if block.Type == editor.MathBlock {
+		if block.Type != editor.TextBlock {
 			hasMath = true
 			break
 		}
@@ -0,0 +1,221 @@
+package ui
+
+import (
+	"image"
+	"slices"
+	"strings"
+	"sync"
+
+	tea "charm.land/bubbletea/v2"
+	"charm.land/lipgloss/v2"
+	"github.com/RNAV2019/quasar/internal/latex"
+)
+
+// frame is a rendered view and the positioned images laid out in it.
+type frame struct {
+	view       tea.View
+	placements []latex.Placement
+}
+
+// frameImages lays out the images of a frame as it is rendered. Kitty draws
+// block images from their placeholder cells, while sixel and iTerm2 images,
+// and inline math under every protocol, are drawn at screen positions over
+// blank cells, so those are recorded here.
+type frameImages struct {
+	positioned bool
+	bounds     image.Rectangle // Area images may be placed in
+	placements []latex.Placement
+}
+
+func newFrameImages(width, height int) *frameImages {
+	return &frameImages{
+		positioned: latex.ActiveProtocol().Positioned(),
+		bounds:     image.Rect(0, 0, width, height),
+	}
+}
+
+// cells returns the text standing in for one row of an image.
+func (f *frameImages) cells(imageID uint32, row, cols int) string {
+	if f.positioned {
+		return strings.Repeat(" ", cols)
+	}
+	return latex.PlaceholderRow(imageID, uint16(row), cols)
+}
+
+// place records an image shown through cells from imgs.cells, whose top row
+// is rendered at x, y.
+func (f *frameImages) place(imageID uint32, x, y, rows, cols int) {
+	if f.positioned {
+		f.add(latex.Placement{ImageID: imageID, X: x, Y: y, Rows: rows, Cols: cols})
+	}
+}
+
+// add records a placement. Images not wholly inside the bounds stay blank,
+// as the terminal cannot clip them.
+func (f *frameImages) add(p latex.Placement) {
+	if placementRect(p).In(f.bounds) {
+		f.placements = append(f.placements, p)
+	}
+}
+
+// cover drops the images an overlay drawn over area hides.
+func (f *frameImages) cover(area image.Rectangle) {
+	f.placements = slices.DeleteFunc(f.placements, func(p latex.Placement) bool {
+		return placementRect(p).Overlaps(area)
+	})
+}
+
+func placementRect(p latex.Placement) image.Rectangle {
+	return image.Rect(p.X, p.Y, p.X+p.Cols, p.Y+p.Rows)
+}
+
+// placementState tracks the layout of positioned images waiting to be drawn
+// and the layout on screen.
+type placementState struct {
+	pending []latex.Placement
+	drawn   []latex.Placement
+}
+
+// flushPlacements draws the images laid out in the last frame. Sixel and
+// iTerm2 images wait until their layout has been stable for a full tick,
+// which guarantees the frame holding their blank cells has been flushed and
+// will not paint over them; Kitty keeps images apart from the text and
+// places them at once. Images already on screen are left alone. Cells of
+// sixel and iTerm2 images that moved or went away are erased where the frame
+// leaves them blank; the rest were overwritten when the frame was drawn.
+func (m *Model) flushPlacements() {
+	ps := &m.placements
+	current := m.frame.placements
+	positioned := latex.ActiveProtocol().Positioned()
+	if slices.Equal(current, ps.drawn) || (positioned && !slices.Equal(current, ps.pending)) {
+		ps.pending = current
+		return
+	}
+
+	var stale []latex.Placement
+	for _, p := range ps.drawn {
+		if !slices.Contains(current, p) {
+			stale = append(stale, p)
+		}
+	}
+	var added []latex.Placement
+	for _, p := range current {
+		if !slices.Contains(ps.drawn, p) {
+			added = append(added, p)
+		}
+	}
+	var erase []latex.Span
+	if positioned {
+		erase = m.blankSpans(stale)
+	}
+	latex.UpdatePlacements(stale, erase, added)
+	ps.drawn, ps.pending = current, current
+}
+
+// blankSpans returns the runs of cells within the given placements that the
+// last frame leaves blank.
+func (m Model) blankSpans(placements []latex.Placement) []latex.Span {
+	if len(placements) == 0 {
+		return nil
+	}
+	canvas := lipgloss.NewCanvas(m.width, m.height)
+	canvas.Compose(lipgloss.NewLayer(m.frame.view.Content))
+
+	var spans []latex.Span
+	for _, p := range placements {
+		area := placementRect(p).Intersect(canvas.Bounds())
+		for y := area.Min.Y; y < area.Max.Y; y++ {
+			start := -1
+			for x := area.Min.X; x <= area.Max.X; x++ {
+				blank := false
+				if x < area.Max.X {
+					cell := canvas.CellAt(x, y)
+					blank = cell != nil && cell.Content == " " && cell.Style.IsZero()
+				}
+				if blank && start < 0 {
+					start = x
+				} else if !blank && start >= 0 {
+					spans = append(spans, latex.Span{X: start, Y: y, Width: x - start})
+					start = -1
+				}
+			}
+		}
+	}
+	return spans
+}
+
+// GraphicsQueue is the graphics output used while the TUI runs. It hands
+// each escape sequence to the Bubble Tea program as raw output, which the
+// program writes between frames, so image commands can no longer land in
+// the middle of a frame. Writes never block, as images are released from
+// Update; a single goroutine delivers sequences in the order written.
+type GraphicsQueue struct {
+	mu      sync.Mutex
+	cond    *sync.Cond
+	pending []string
+	sending bool
+	closed  bool
+	send    func(tea.Msg)
+}
+
+// NewGraphicsQueue returns a queue delivering sequences with send, usually
+// the Send method of the program. Close stops it.
+func NewGraphicsQueue(send func(tea.Msg)) *GraphicsQueue {
+	q := &GraphicsQueue{send: send}
+	q.cond = sync.NewCond(&q.mu)
+	go q.run()
+	return q
+}
+
+// Write queues one escape sequence.
+func (q *GraphicsQueue) Write(p []byte) (int, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if !q.closed {
+		q.pending = append(q.pending, string(p))
+		q.cond.Broadcast()
+	}
+	return len(p), nil
+}
+
+// Flush blocks until every sequence written so far has been handed to the
+// program, so messages sent afterwards are processed after them. It must
+// not be called from Update, which the program would need to return first.
+func (q *GraphicsQueue) Flush() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for (len(q.pending) > 0 || q.sending) && !q.closed {
+		q.cond.Wait()
+	}
+	return nil
+}
+
+// Close discards queued sequences and stops delivery.
+func (q *GraphicsQueue) Close() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.closed = true
+	q.pending = nil
+	q.cond.Broadcast()
+}
+
+func (q *GraphicsQueue) run() {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	for {
+		for len(q.pending) == 0 && !q.closed {
+			q.cond.Wait()
+		}
+		if q.closed {
+			return
+		}
+		seq := strings.Join(q.pending, "")
+		q.pending = nil
+		q.sending = true
+		q.mu.Unlock()
+		q.send(tea.RawMsg{Msg: seq})
+		q.mu.Lock()
+		q.sending = false
+		q.cond.Broadcast()
+	}
+}
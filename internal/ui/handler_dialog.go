@@ -322,19 +322,7 @@ func (m *Model) renameMarkdownFile(oldPath, newPath, newName string) error {
 	metadata.Title = title
 
 	// Rebuild the file content with updated front matter
-	var newLines []string
-	newLines = append(newLines, "---")
-	if metadata.Title != "" {
-		newLines = append(newLines, fmt.Sprintf("title: %s", metadata.Title))
-	}
-	if metadata.Date != "" {
-		newLines = append(newLines, fmt.Sprintf("date: %s", metadata.Date))
-	}
-	if metadata.Tag != "" {
-		newLines = append(newLines, fmt.Sprintf("tag: %s", metadata.Tag))
-	}
-	newLines = append(newLines, "---")
-	newLines = append(newLines, remainingLines...)
+	newLines := append(metadata.Lines(), remainingLines...)
 
 	// Write to new path
 	newContent := strings.Join(newLines, "\n")
@@ -412,19 +400,7 @@ func (m *Model) updateFileTag(filePath, newTag string) error {
 	metadata.Tag = newTag
 
 	// Rebuild file content
-	var newLines []string
-	newLines = append(newLines, "---")
-	if metadata.Title != "" {
-		newLines = append(newLines, fmt.Sprintf("title: %s", metadata.Title))
-	}
-	if metadata.Date != "" {
-		newLines = append(newLines, fmt.Sprintf("date: %s", metadata.Date))
-	}
-	if metadata.Tag != "" {
-		newLines = append(newLines, fmt.Sprintf("tag: %s", metadata.Tag))
-	}
-	newLines = append(newLines, "---")
-	newLines = append(newLines, remainingLines...)
+	newLines := append(metadata.Lines(), remainingLines...)
 
 	newContent := strings.Join(newLines, "\n")
 	return os.WriteFile(filePath, []byte(newContent), 0644)
@@ -48,6 +48,9 @@ func (m *Model) handleNormalMode(msg tea.KeyPressMsg) (cmds []tea.Cmd) {
 		case "l":
 			m.Editor.MoveToEndOfLine()
 			m.KeyPreview = "gl"
+		case "d":
+			m.goToEquation()
+			m.KeyPreview = "gd"
 		default:
 			m.KeyPreview = keyStr
 		}
@@ -204,6 +207,28 @@ func (m *Model) handleNormalMode(msg tea.KeyPressMsg) (cmds []tea.Cmd) {
 	return cmds
 }
 
+// goToEquation moves the cursor to the equation labelled by the reference
+// under the cursor.
+func (m *Model) goToEquation() {
+	cursor := m.Editor.Cursor
+	if cursor.BlockIdx >= len(m.Editor.Blocks) || cursor.LineIdx >= len(m.Editor.Blocks[cursor.BlockIdx].Lines) {
+		return
+	}
+	runes := []rune(m.Editor.Blocks[cursor.BlockIdx].Lines[cursor.LineIdx])
+	col := len(string(runes[:min(cursor.Col, len(runes))]))
+	label, ok := editor.RefAt(string(runes), col)
+	if !ok {
+		m.StatusMessage = "No equation reference under cursor"
+		return
+	}
+	eq, ok := m.ParsedDoc.Equation(label)
+	if !ok {
+		m.StatusMessage = fmt.Sprintf("No equation labelled %s", label)
+		return
+	}
+	m.Editor.MoveTo(editor.Position{BlockIdx: eq.BlockIdx, LineIdx: eq.LineIdx})
+}
+
 // handleFileTree processes key events when the file tree is focused.
 func (m *Model) handleFileTree(msg tea.KeyPressMsg) (cmds []tea.Cmd) {
 	keyStr := msg.String()
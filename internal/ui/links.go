@@ -13,11 +13,7 @@ var linkRegex = regexp.MustCompile(`!?\[([^\]]*)\]\(([^)]+)\)`)
 // getLinkAtPosition returns the URL if a link is at the given screen position.
 func (m Model) getLinkAtPosition(x, y int) string {
 	gutterWidth := 0
-	totalLines := 0
-	for _, block := range m.Editor.Blocks {
-		totalLines += len(block.Lines)
-	}
-	if totalLines > 0 {
+	if totalLines := m.Editor.GetLineCount(); totalLines > 0 {
 		gutterWidth = len(fmt.Sprint(totalLines))
 	}
 
@@ -36,11 +32,7 @@ func (m Model) getLinkAtPosition(x, y int) string {
 	relX := x - contentStartX
 	relY := y - contentStartY
 
-	offsetAbsLine := 0
-	for i := 0; i < m.Editor.Offset.BlockIdx && i < len(m.Editor.Blocks); i++ {
-		offsetAbsLine += len(m.Editor.Blocks[i].Lines)
-	}
-	offsetAbsLine += m.Editor.Offset.LineIdx
+	offsetAbsLine := m.Editor.AbsLine(m.Editor.Offset)
 
 	absLine := relY + offsetAbsLine
 
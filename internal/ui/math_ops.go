@@ -1,21 +1,39 @@
 package ui
 
 import (
+	"context"
 	"fmt"
+	"math"
+	"strconv"
 	"strings"
 
 	tea "charm.land/bubbletea/v2"
 	"github.com/RNAV2019/quasar/internal/editor"
 	"github.com/RNAV2019/quasar/internal/latex"
+	"github.com/RNAV2019/quasar/internal/terminal"
+	"github.com/charmbracelet/x/ansi"
 )
 
 // processDirtyBlocks compiles math blocks and inline math that need rendering.
 func (m *Model) processDirtyBlocks() tea.Cmd {
+	m.refreshMacros()
+	m.updateParsedDoc()
+
 	var cmds []tea.Cmd
+	renderer := m.Renderer
+	diagrams := m.DiagramRenderer
+	pool := m.renderPool
+	images := m.images
+	textOnly := m.textOnly()
+	cell, rowPx := m.CellSize, latex.ActiveMetrics().RowPx
+	renderCtx := latex.WithMacros(context.Background(), m.renderMacros)
+	var requests []latex.Request
+	from, to := m.renderRange()
 
 	for i := range m.Editor.Blocks {
 		block := &m.Editor.Blocks[i]
-		if !block.IsDirty {
+		// Blocks away from the viewport stay dirty until scrolled near.
+		if !block.IsDirty || i < from || i > to {
 			continue
 		}
 
@@ -28,19 +46,16 @@ func (m *Model) processDirtyBlocks() tea.Cmd {
 			block.IsLoading = true
 			m.PendingRenders++
 			blockIdx := i
-			lines := make([]string, len(block.Lines))
-			copy(lines, block.Lines)
+			content := editor.MathBlockContent(block.Lines)
+			isMacros := editor.IsMacroBlock(block.Lines)
+			if !isMacros {
+				content = m.ParsedDoc.MathSource(content)
+			}
 			gen := m.fileGeneration
+			if !textOnly && !isMacros && strings.TrimSpace(content) != "" {
+				requests = append(requests, latex.Request{Math: content})
+			}
 			cmds = append(cmds, func() tea.Msg {
-				contentLines := lines
-				if len(contentLines) >= 2 && contentLines[0] == "$$" && contentLines[len(contentLines)-1] == "$$" {
-					contentLines = contentLines[1 : len(contentLines)-1]
-				}
-				start := 0
-				for start < len(contentLines) && strings.TrimSpace(contentLines[start]) == "" {
-					start++
-				}
-				content := strings.Join(contentLines[start:], "\n")
 				if strings.TrimSpace(content) == "" {
 					return BlockProcessedMsg{
 						BlockIdx: blockIdx, ImageID: 0, ImageCols: 0,
@@ -48,11 +63,33 @@ func (m *Model) processDirtyBlocks() tea.Cmd {
 						Generation: gen,
 					}
 				}
-				path, err := latex.CompileToPNG(content, m.Config.CacheDir, false)
+				if isMacros {
+					// Macro definitions produce no output; show their source.
+					textLines := strings.Split(content, "\n")
+					return BlockProcessedMsg{
+						BlockIdx: blockIdx, ImageHeight: len(textLines),
+						TextLines: textLines, Generation: gen,
+					}
+				}
+				if textOnly {
+					textLines := latex.ToUnicode(content, false)
+					return BlockProcessedMsg{
+						BlockIdx: blockIdx, ImageHeight: len(textLines),
+						TextLines: textLines, Source: content, Generation: gen,
+					}
+				}
+				var img latex.Image
+				var err error
+				task := latex.Task{
+					Key: fmt.Sprintf("%d", blockIdx), Group: fmt.Sprintf("%d", blockIdx), Pos: blockIdx,
+					Fn: func(ctx context.Context) { img, err = renderer.Render(ctx, content, false) },
+				}
+				if pool.Run(renderCtx, task) != nil {
+					return BlockProcessedMsg{BlockIdx: blockIdx, Canceled: true, Generation: gen}
+				}
 				var info latex.ImageInfo
 				if err == nil {
-					targetRows := latex.CalculateTargetRows(path)
-					info, err = latex.TransmitImageForKitty(path, targetRows, 0)
+					info, err = images.Acquire(img.Path, img.Rows, 0)
 				}
 				return BlockProcessedMsg{
 					BlockIdx: blockIdx, ImageID: info.ImageID, ImageCols: info.Cols,
@@ -61,6 +98,48 @@ func (m *Model) processDirtyBlocks() tea.Cmd {
 				}
 			})
 
+		case editor.DiagramBlock:
+			if m.Editor.Cursor.BlockIdx == i {
+				continue
+			}
+			block.IsDirty = false
+			block.IsLoading = true
+			m.PendingRenders++
+			blockIdx := i
+			content := editor.DiagramBlockContent(block.Lines)
+			gen := m.fileGeneration
+			cmds = append(cmds, func() tea.Msg {
+				if strings.TrimSpace(content) == "" {
+					return BlockProcessedMsg{BlockIdx: blockIdx, Generation: gen}
+				}
+				if latex.ActiveProtocol() == latex.ProtocolText {
+					// Diagrams have no text rendering; show their source.
+					textLines := strings.Split(content, "\n")
+					return BlockProcessedMsg{
+						BlockIdx: blockIdx, ImageHeight: len(textLines),
+						TextLines: textLines, Generation: gen,
+					}
+				}
+				var img latex.Image
+				var err error
+				task := latex.Task{
+					Key: fmt.Sprintf("%d", blockIdx), Group: fmt.Sprintf("%d", blockIdx), Pos: blockIdx,
+					Fn: func(ctx context.Context) { img, err = diagrams.Render(ctx, content, false) },
+				}
+				if pool.Run(renderCtx, task) != nil {
+					return BlockProcessedMsg{BlockIdx: blockIdx, Canceled: true, Generation: gen}
+				}
+				var info latex.ImageInfo
+				if err == nil {
+					info, err = images.Acquire(img.Path, img.Rows, 0)
+				}
+				return BlockProcessedMsg{
+					BlockIdx: blockIdx, ImageID: info.ImageID, ImageCols: info.Cols,
+					ImageHeight: info.Rows, Error: err,
+					Generation: gen,
+				}
+			})
+
 		case editor.TextBlock:
 			anyProcessed := false
 			for lineIdx, line := range block.Lines {
@@ -77,48 +156,427 @@ func (m *Model) processDirtyBlocks() tea.Cmd {
 					matches = filtered
 				}
 
-				prefix := fmt.Sprintf("%d-%d-", i, lineIdx)
-				for key, render := range m.InlineRenders {
-					if strings.HasPrefix(key, prefix) {
-						if render.ImageID != 0 {
-							latex.DeleteImage(render.ImageID)
-						}
-						delete(m.InlineRenders, key)
-					}
+				if cmd := m.processPicture(i, lineIdx, line); cmd != nil {
+					cmds = append(cmds, cmd)
+					anyProcessed = true
 				}
 
+				// Math still on the line keeps its render until the new one
+				// replaces it. Renders of math that moved or went away are
+				// retired, keeping their images until the new renders have
+				// acquired any they share.
+				starts := make(map[int]bool, len(matches))
+				for _, match := range matches {
+					starts[match[0]] = true
+				}
+				m.retireInlineRenders(i, func(pos SpanPos, _ InlineMathRender) bool {
+					return pos.Line == lineIdx && !starts[pos.Col]
+				})
+
 				for _, match := range matches {
 					m.PendingRenders++
 					blockIdx := i
 					lIdx := lineIdx
 					start, end := match[0], match[1]
-					content := line[start+1 : end-1]
+					content := m.ParsedDoc.MathSource(line[start+1 : end-1])
 					gen := m.fileGeneration
+					if !textOnly {
+						requests = append(requests, latex.Request{Math: content, IsInline: true})
+					}
 					cmds = append(cmds, func() tea.Msg {
-						path, err := latex.CompileToPNG(content, m.Config.CacheDir, true)
+						if textOnly {
+							text := strings.Join(latex.ToUnicode(content, true), " ")
+							return InlineMathProcessedMsg{
+								BlockIdx: blockIdx, LineIdx: lIdx, StartCol: start, EndCol: end,
+								ImageCols: ansi.StringWidth(text), ImageHeight: 1,
+								Text: text, Generation: gen,
+							}
+						}
+						var img latex.Image
+						var err error
+						task := latex.Task{
+							Key:   fmt.Sprintf("%d-%d-%d", blockIdx, lIdx, start),
+							Group: fmt.Sprintf("%d", blockIdx),
+							Pos:   blockIdx,
+							Fn:    func(ctx context.Context) { img, err = renderer.Render(ctx, content, true) },
+						}
+						if pool.Run(renderCtx, task) != nil {
+							return InlineMathProcessedMsg{
+								BlockIdx: blockIdx, LineIdx: lIdx, StartCol: start, EndCol: end,
+								Canceled: true, Generation: gen,
+							}
+						}
 						var info latex.ImageInfo
+						var layout inlineLayout
 						if err == nil {
-							info, err = latex.TransmitImageForKitty(path, 1, 0)
+							layout = layoutInline(img, cell, rowPx)
+							info, err = images.AcquirePlaced(img.Path, layout.rows, layout.cols)
 						}
 						return InlineMathProcessedMsg{
 							BlockIdx: blockIdx, LineIdx: lIdx, StartCol: start, EndCol: end,
-							ImageID: info.ImageID, ImageCols: info.Cols,
-							ImageHeight: info.Rows, Error: err, Generation: gen,
+							ImageID: info.ImageID, ImageCols: info.Cols, ImageHeight: info.Rows,
+							TextRow: layout.textRow, OffsetY: layout.offsetY, Fit: layout.fit,
+							Error: err, Generation: gen,
 						}
 					})
 					anyProcessed = true
 				}
 			}
+			m.releaseRemovedPictures(i, len(block.Lines))
 			if m.Editor.Cursor.BlockIdx != i || anyProcessed {
 				block.IsDirty = false
 			}
 		}
 	}
+	// The first screen may hold no math even when the rest of the note does.
+	if m.PendingRenders == 0 {
+		m.DocumentLoading = false
+	}
+	if batcher, ok := renderer.(latex.BatchRenderer); ok && len(requests) > 1 {
+		return renderBatch(renderCtx, pool, batcher, requests, cmds)
+	}
 	return tea.Batch(cmds...)
 }
 
+// cellBaseline is the fraction of a terminal cell's height above the
+// baseline of its text, typical of monospace fonts.
+const cellBaseline = 0.8
+
+// maxInlineRows is the most rows a line grows to for its inline math.
+const maxInlineRows = 2
+
+// inlineLayout is how an inline math image sits on its line.
+type inlineLayout struct {
+	rows    int // Rows covered, from the one above the text if any
+	cols    int
+	textRow int // Row holding the text the math is aligned with
+	offsetY int // Pixels from the top of the first row to the image
+	fit     bool
+}
+
+// layoutInline places an inline math image so its baseline sits on the text
+// baseline of its line. The image is shown at its own size, rendered at
+// rowPx pixels per row, and grows its line by a row above or below when it
+// is taller than the text. Math that cannot sit on the baseline within
+// maxInlineRows rows, or whose baseline is unknown, is centred instead, and
+// scaled down when it is taller than maxInlineRows rows.
+func layoutInline(img latex.Image, cell terminal.CellSize, rowPx int) inlineLayout {
+	scale := float64(cell.HeightPx) / float64(max(rowPx, 1))
+	width := int(math.Ceil(float64(img.Width) * scale))
+	height := int(math.Ceil(float64(img.Height) * scale))
+	cols := max(ceilDiv(width, cell.WidthPx), 1)
+
+	if img.Baseline > 0 {
+		above := int(math.Round(float64(img.Baseline) * scale))
+		below := height - above
+		cellAbove := int(float64(cell.HeightPx) * cellBaseline)
+		cellBelow := cell.HeightPx - cellAbove
+		up := ceilDiv(max(above-cellAbove, 0), cell.HeightPx)
+		down := ceilDiv(max(below-cellBelow, 0), cell.HeightPx)
+		if 1+up+down <= maxInlineRows {
+			return inlineLayout{rows: 1 + up + down, cols: cols, textRow: up, offsetY: up*cell.HeightPx + cellAbove - above}
+		}
+	}
+
+	// Otherwise the math is centred on the rows it covers, ending on the
+	// text row.
+	rows := max(ceilDiv(height, cell.HeightPx), 1)
+	if rows <= maxInlineRows {
+		return inlineLayout{rows: rows, cols: cols, textRow: rows - 1, offsetY: (rows*cell.HeightPx - height) / 2}
+	}
+	rows = maxInlineRows
+	cols = max(ceilDiv(width*rows*cell.HeightPx, height*cell.WidthPx), 1)
+	return inlineLayout{rows: rows, cols: cols, textRow: rows - 1, fit: true}
+}
+
+func ceilDiv(a, b int) int {
+	return (a + b - 1) / b
+}
+
+// renderBatch returns a command that compiles every request in a single TeX
+// run before starting cmds, which then find their images already cached.
+func renderBatch(ctx context.Context, pool *latex.Pool, batcher latex.BatchRenderer, requests []latex.Request, cmds []tea.Cmd) tea.Cmd {
+	return func() tea.Msg {
+		pool.Run(ctx, latex.Task{
+			Key: "batch", Group: "batch",
+			Fn: func(ctx context.Context) { batcher.RenderBatch(ctx, requests) },
+		})
+		return tea.BatchMsg(cmds)
+	}
+}
+
+// updateRenderMetrics matches the render resolution to the current cell
+// size. When the font size has changed every block is marked dirty so the
+// next tick re-renders math at the new size.
+func (m *Model) updateRenderMetrics() {
+	metrics := latex.MetricsFor(m.CellSize.HeightPx, m.Config.Settings.MathScale)
+	if metrics == latex.ActiveMetrics() {
+		return
+	}
+	latex.SetMetrics(metrics)
+	for i := range m.Editor.Blocks {
+		m.Editor.Blocks[i].IsDirty = true
+	}
+}
+
+// refreshMacros recomputes the macros of the current note and marks every
+// block dirty when they change, as any expression may use them. While a
+// macro block or the front matter is being typed in, the previous macros
+// are kept so half-written definitions do not re-render the whole note.
+func (m *Model) refreshMacros() {
+	if m.mode == Insert && m.editingMacros() {
+		return
+	}
+	macros := editor.NoteMacros(m.Editor.Blocks, m.notebookMacros)
+	if macros == m.renderMacros {
+		return
+	}
+	m.renderMacros = macros
+	for i := range m.Editor.Blocks {
+		m.Editor.Blocks[i].IsDirty = true
+	}
+}
+
+// editingMacros reports whether the cursor is in a macro block or in the
+// front matter.
+func (m *Model) editingMacros() bool {
+	idx := m.Editor.Cursor.BlockIdx
+	if idx >= len(m.Editor.Blocks) {
+		return false
+	}
+	block := m.Editor.Blocks[idx]
+	if block.Type == editor.MathBlock {
+		return editor.IsMacroBlock(block.Lines)
+	}
+	if idx != 0 || len(block.Lines) == 0 || block.Lines[0] != "---" {
+		return false
+	}
+	for i := 1; i < len(block.Lines); i++ {
+		if block.Lines[i] == "---" {
+			return m.Editor.Cursor.LineIdx <= i
+		}
+	}
+	return true
+}
+
+// blockDiagnostic returns a one-line message for a block's render error and
+// the line within the block it points at, or -1 when unknown.
+func blockDiagnostic(block editor.Block, err error) (string, int) {
+	diags := latex.Diagnostics(err)
+	if len(diags) == 0 {
+		msg, _, _ := strings.Cut(err.Error(), "\n")
+		return msg, -1
+	}
+	line := -1
+	if diags[0].Line >= 0 {
+		start, end := editor.MathContentBounds(block.Lines)
+		if block.Type == editor.DiagramBlock {
+			start, end = editor.DiagramContentBounds(block.Lines)
+		}
+		line = min(start+diags[0].Line, max(end-1, start))
+	}
+	return diags[0].Summary(), line
+}
+
+// cancelEditedRenders cancels in-flight renders for blocks that have been
+// edited since they were submitted, as their results would be stale. Only
+// blocks with renders in flight are looked at.
+func (m *Model) cancelEditedRenders() {
+	if m.PendingRenders == 0 {
+		return
+	}
+	blocks := m.Editor.Blocks
+	m.renderPool.CancelGroups(func(group string) bool {
+		i, err := strconv.Atoi(group)
+		return err == nil && i < len(blocks) && blocks[i].IsDirty
+	})
+}
+
+// renderRange returns the blocks whose math is rendered: those in the
+// viewport and within a screen of it. While a document is loading only the
+// viewport is rendered, so the first screenful appears as soon as possible.
+func (m *Model) renderRange() (int, int) {
+	if m.DocumentLoading {
+		return m.blockRangeAround(0)
+	}
+	return m.blockRangeAround(m.Editor.Height)
+}
+
+// hasDirtyInRange reports whether any block in the render range needs
+// rendering.
+func (m *Model) hasDirtyInRange() bool {
+	from, to := m.renderRange()
+	for i := from; i <= to && i < len(m.Editor.Blocks); i++ {
+		if m.Editor.Blocks[i].IsDirty {
+			return true
+		}
+	}
+	return false
+}
+
+// evictionState records what evictOffscreenImages last looked at, so it only
+// runs again once the viewport, the blocks, or the images have changed.
+type evictionState struct {
+	from, to int
+	blocks   int
+	valid    bool
+}
+
+// invalidateEviction makes the next evictOffscreenImages run, after an
+// image arrives that may lie off screen.
+func (m *Model) invalidateEviction() {
+	m.evicted.valid = false
+}
+
+// evictOffscreenImages frees the terminal images of blocks more than two
+// screens from the viewport and marks the blocks dirty, so their images are
+// transmitted again from the render cache when they are scrolled back near.
+func (m *Model) evictOffscreenImages() {
+	from, to := m.blockRangeAround(2 * max(m.Editor.Height, 1))
+	state := evictionState{from: from, to: to, blocks: len(m.Editor.Blocks), valid: true}
+	if m.evicted == state {
+		return
+	}
+	m.evicted = state
+
+	offscreen := func(i int) bool { return (i < from || i > to) && i < len(m.Editor.Blocks) }
+	for i := range m.Editor.Blocks {
+		block := &m.Editor.Blocks[i]
+		if offscreen(i) && block.ImageID != 0 && !block.IsLoading {
+			// ImageHeight is kept so scrolling measures the block as before.
+			m.images.Release(block.ImageID)
+			block.ImageID = 0
+			block.IsDirty = true
+		}
+	}
+	for i := range m.InlineRenders {
+		if offscreen(i) && m.releaseInlineRenders(i, func(_ SpanPos, render InlineMathRender) bool { return render.ImageID != 0 }) {
+			m.Editor.Blocks[i].IsDirty = true
+		}
+	}
+	for i, pictures := range m.Pictures {
+		if !offscreen(i) {
+			continue
+		}
+		for lineIdx, render := range pictures {
+			if render.ImageID != 0 {
+				m.releasePicture(i, lineIdx)
+				m.Editor.Blocks[i].IsDirty = true
+			}
+		}
+	}
+}
+
+// releaseInlineRenders frees the inline math renders of a block that match,
+// and reports whether any had an image.
+func (m *Model) releaseInlineRenders(blockIdx int, match func(SpanPos, InlineMathRender) bool) bool {
+	renders := m.InlineRenders[blockIdx]
+	released := false
+	for pos, render := range renders {
+		if match(pos, render) {
+			released = released || render.ImageID != 0
+			m.images.Release(render.ImageID)
+			delete(renders, pos)
+		}
+	}
+	if len(renders) == 0 {
+		delete(m.InlineRenders, blockIdx)
+	}
+	return released
+}
+
+// retireInlineRenders removes the inline renders of a block that match,
+// holding their images until releaseRetired.
+func (m *Model) retireInlineRenders(blockIdx int, match func(SpanPos, InlineMathRender) bool) {
+	renders := m.InlineRenders[blockIdx]
+	for pos, render := range renders {
+		if match(pos, render) {
+			if render.ImageID != 0 {
+				m.retiredImages = append(m.retiredImages, render.ImageID)
+			}
+			delete(renders, pos)
+		}
+	}
+	if len(renders) == 0 {
+		delete(m.InlineRenders, blockIdx)
+	}
+}
+
+// releaseRetired releases the images of retired renders once no render is
+// pending, so that math rendered again has already acquired its image.
+func (m *Model) releaseRetired() {
+	if m.PendingRenders > 0 {
+		return
+	}
+	for _, id := range m.retiredImages {
+		m.images.Release(id)
+	}
+	m.retiredImages = nil
+}
+
+// blockRangeAround returns the indices of the first and last blocks within
+// margin rows of the editor viewport.
+func (m *Model) blockRangeAround(margin int) (int, int) {
+	first, last := m.visibleBlockRange()
+	blockRows := func(i int) int {
+		return max(len(m.Editor.Blocks[i].Lines), m.Editor.Blocks[i].ImageHeight)
+	}
+	for rows := m.Editor.Offset.LineIdx; first > 0 && rows < margin; {
+		first--
+		rows += blockRows(first)
+	}
+	for rows := 0; last < len(m.Editor.Blocks)-1 && rows < margin; {
+		last++
+		rows += blockRows(last)
+	}
+	return first, last
+}
+
+// visibleBlockRange returns the indices of the first and last blocks that
+// fit in the editor viewport.
+func (m *Model) visibleBlockRange() (int, int) {
+	first := m.Editor.Offset.BlockIdx
+	last := first
+	rows := -m.Editor.Offset.LineIdx
+	for i := first; i < len(m.Editor.Blocks); i++ {
+		last = i
+		block := m.Editor.Blocks[i]
+		rows += max(len(block.Lines), block.ImageHeight)
+		if rows >= m.Editor.Height {
+			break
+		}
+	}
+	return first, last
+}
+
+// textOnly reports whether math must be rendered as Unicode text, either
+// because no image protocol is in use or because the renderer's tools are
+// not installed.
+func (m *Model) textOnly() bool {
+	return latex.ActiveProtocol() == latex.ProtocolText || m.Renderer == nil || !m.Renderer.Available()
+}
+
 // insertMathBlock creates a properly structured math block at cursor position.
 func (m *Model) insertMathBlock() {
+	m.insertBlock(editor.Block{
+		Type:    editor.MathBlock,
+		Lines:   []string{"$$", "", "$$"},
+		IsDirty: true,
+	})
+}
+
+// insertDiagramBlock creates an empty Graphviz block at cursor position.
+func (m *Model) insertDiagramBlock() {
+	m.insertBlock(editor.Block{
+		Type:    editor.DiagramBlock,
+		Lines:   []string{"```dot", "", editor.DiagramFenceClose},
+		IsDirty: true,
+	})
+}
+
+// insertBlock splits the text block at the cursor around newBlock and puts
+// the cursor on newBlock's first content line.
+func (m *Model) insertBlock(newBlock editor.Block) {
 	blockIdx := m.Editor.Cursor.BlockIdx
 	lineIdx := m.Editor.Cursor.LineIdx
 	col := m.Editor.Cursor.Col
@@ -142,12 +600,6 @@ func (m *Model) insertMathBlock() {
 	}
 	rightBlockLines = append(rightBlockLines, block.Lines[lineIdx+1:]...)
 
-	mathBlock := editor.Block{
-		Type:    editor.MathBlock,
-		Lines:   []string{"$$", "", "$$"},
-		IsDirty: true,
-	}
-
 	var newBlocks []editor.Block
 
 	for _, block := range m.Editor.Blocks[:blockIdx] {
@@ -162,7 +614,8 @@ func (m *Model) insertMathBlock() {
 		})
 	}
 
-	newBlocks = append(newBlocks, mathBlock)
+	insertedIdx := len(newBlocks)
+	newBlocks = append(newBlocks, newBlock)
 
 	if len(rightBlockLines) > 0 {
 		newBlocks = append(newBlocks, editor.Block{
@@ -182,14 +635,8 @@ func (m *Model) insertMathBlock() {
 		}
 	}
 
-	m.Editor.Blocks = newBlocks
-
-	for i, b := range m.Editor.Blocks {
-		if b.Type == editor.MathBlock && len(b.Lines) == 3 && b.Lines[0] == "$$" && b.Lines[2] == "$$" {
-			m.Editor.Cursor.BlockIdx = i
-			m.Editor.Cursor.LineIdx = 1
-			m.Editor.Cursor.Col = 0
-			break
-		}
-	}
+	m.Editor.SetBlocks(newBlocks)
+	m.Editor.Cursor.BlockIdx = insertedIdx
+	m.Editor.Cursor.LineIdx = 1
+	m.Editor.Cursor.Col = 0
 }
@@ -3,7 +3,6 @@
 package ui
 
 import (
-	"regexp"
 	"strings"
 	"time"
 
@@ -11,6 +10,8 @@ import (
 	tea "charm.land/bubbletea/v2"
 	"github.com/RNAV2019/quasar/internal/config"
 	"github.com/RNAV2019/quasar/internal/editor"
+	"github.com/RNAV2019/quasar/internal/errors"
+	"github.com/RNAV2019/quasar/internal/latex"
 	"github.com/RNAV2019/quasar/internal/terminal"
 	"github.com/RNAV2019/quasar/internal/ui/autocomplete"
 	"github.com/RNAV2019/quasar/internal/ui/dialog"
@@ -54,7 +55,11 @@ type Model struct {
 	Time               time.Time
 	Editor             editor.Model
 	Config             *config.Config
-	InlineRenders      map[string]InlineMathRender
+	Renderer           latex.Renderer
+	DiagramRenderer    latex.Renderer
+	InlineRenders      map[int]map[SpanPos]InlineMathRender // Keyed by block, then span
+	retiredImages      []uint32                             // Images of replaced inline renders, held until renders settle
+	Pictures           map[int]map[int]PictureRender        // Keyed by block, then line
 	PendingRenders     int
 	TotalRenders       int // Total renders needed for current document
 	CompiledMath       []string
@@ -80,6 +85,14 @@ type Model struct {
 	Dirty              bool
 	DocumentLoading    bool   // True while initial document images are being compiled
 	fileGeneration     uint64 // Increments on each file load to discard stale render results
+	frame              frame // Rendered by Update for View
+	placements         placementState
+	evicted            evictionState
+	renderPool         *latex.Pool
+	images             *latex.ImageManager // Terminal images shared by identical math
+	notebookMacros     string // Contents of the notebook's macros.tex
+	renderMacros       string // Macros the current note's math is rendered with
+	preview            mathPreview // Live render of the math block being edited
 
 	Undo            *editor.UndoManager
 	PendingOp       string
@@ -99,7 +112,9 @@ type BlockProcessedMsg struct {
 	ImageID     uint32
 	ImageCols   int
 	ImageHeight int
+	TextLines   []string
 	Error       error
+	Canceled    bool // The render was superseded and its result discarded
 	Source      string
 	Generation  uint64
 }
@@ -113,20 +128,71 @@ type InlineMathProcessedMsg struct {
 	ImageID     uint32
 	ImageCols   int
 	ImageHeight int
+	TextRow     int // Row of the image on the baseline of the text
+	OffsetY     int // Pixels from the top of the image's first row
+	Fit         bool
+	Text        string
 	Error       error
+	Canceled    bool // The render was superseded and its result discarded
 	Generation  uint64
 }
 
+// SpanPos is where an inline math span starts within its block.
+type SpanPos struct {
+	Line int
+	Col  int
+}
+
 // InlineMathRender holds the rendered image data for an inline math expression.
 type InlineMathRender struct {
 	ImageID     uint32
 	ImageCols   int
-	ImageHeight int
-	Length      int // Width in columns for placeholder
+	ImageHeight int    // Rows the image covers, which its line grows to
+	TextRow     int    // Row of the image on the baseline of the text
+	OffsetY     int    // Pixels from the top of the image's first row
+	Fit         bool   // Stretched over its cells rather than at its own size
+	Text        string // Unicode rendering used when images are unavailable
+	Length      int    // Width in columns for placeholder
 	TextLength  int // Original text length for hover detection
 }
 
-var inlineMathRe = regexp.MustCompile(`\$[^\$]*\$`)
+// PictureRender holds the image shown in place of a line that is a markdown
+// image link.
+type PictureRender struct {
+	ImageID     uint32 // Zero when the picture could not be shown
+	ImageCols   int
+	ImageHeight int
+	Line        string // Source line the picture was rendered from
+	MaxWidth    int    // Pixel width the picture was fitted to
+}
+
+// PictureProcessedMsg is sent when a picture has been scaled and transmitted.
+type PictureProcessedMsg struct {
+	BlockIdx    int
+	LineIdx     int
+	Line        string
+	MaxWidth    int
+	ImageID     uint32
+	ImageCols   int
+	ImageHeight int
+	Error       error
+	Generation  uint64
+}
+
+// PreviewRenderedMsg is sent when the preview of the math block being edited
+// finishes rendering.
+type PreviewRenderedMsg struct {
+	BlockIdx    int
+	Source      string
+	ImageID     uint32
+	ImageCols   int
+	ImageHeight int
+	Error       error
+	Canceled    bool // The render was superseded and its result discarded
+	Generation  uint64
+}
+
+var inlineMathRe = editor.MathSpanRe
 
 // InitialModel creates the default Model with the given configuration.
 func InitialModel(cfg *config.Config) Model {
@@ -163,13 +229,21 @@ func InitialModel(cfg *config.Config) Model {
 		}
 	}
 
+	renderer, err := latex.NewRenderer(cfg.Settings.Renderer, cfg.CacheDir)
+	if err != nil {
+		errors.AddError(err.Error(), "config")
+	}
+
 	m := Model{
 		mode:                Normal,
 		Time:                time.Now(),
 		Editor:              editor.NewModel(),
 		Config:              cfg,
+		Renderer:            renderer,
+		DiagramRenderer:     latex.NewGraphvizRenderer(cfg.CacheDir),
 		CellSize:            terminal.GetCellSize(),
-		InlineRenders:       make(map[string]InlineMathRender),
+		InlineRenders:       make(map[int]map[SpanPos]InlineMathRender),
+		Pictures:            make(map[int]map[int]PictureRender),
 		CmdInput:            ti,
 		FileTree:            filetree.New(cfg.NotesDir),
 		ShowFileTree:        false,
@@ -186,6 +260,8 @@ func InitialModel(cfg *config.Config) Model {
 		YankBuffer:          "",
 		YankWasLineWise:     false,
 		CopyBuffer:          "",
+		renderPool:          latex.NewPool(cfg.Settings.RenderWorkers),
+		images:              latex.NewImageManager(),
 	}
 	m.ParsedDoc = editor.ParseDocument(m.Editor.Blocks)
 	return m
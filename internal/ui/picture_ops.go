@@ -0,0 +1,135 @@
+package ui
+
+import (
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	tea "charm.land/bubbletea/v2"
+	"github.com/RNAV2019/quasar/internal/editor"
+	"github.com/RNAV2019/quasar/internal/latex"
+)
+
+// processPicture returns a command that displays the picture linked from a
+// line, or nil when the line links none or its picture is already shown.
+// Pictures are recorded even when they fail so the same line is not retried.
+func (m *Model) processPicture(blockIdx, lineIdx int, line string) tea.Cmd {
+	link, ok := editor.ParseImageLink(line)
+	if !ok || !link.IsLocal() || latex.ActiveProtocol() == latex.ProtocolText {
+		m.releasePicture(blockIdx, lineIdx)
+		return nil
+	}
+
+	maxWidth, maxHeight := m.pictureBounds(link)
+	if old, ok := m.Pictures[blockIdx][lineIdx]; ok {
+		if old.Line == line && old.MaxWidth == maxWidth {
+			return nil
+		}
+		m.releasePicture(blockIdx, lineIdx)
+	}
+
+	// The entry marks the picture as in progress until its image arrives.
+	if m.Pictures[blockIdx] == nil {
+		m.Pictures[blockIdx] = make(map[int]PictureRender)
+	}
+	m.Pictures[blockIdx][lineIdx] = PictureRender{Line: line, MaxWidth: maxWidth}
+	m.PendingRenders++
+	path, pathErr := m.picturePath(link.Path)
+	cacheDir := m.Config.CacheDir
+	images := m.images
+	gen := m.fileGeneration
+	return func() tea.Msg {
+		msg := PictureProcessedMsg{
+			BlockIdx: blockIdx, LineIdx: lineIdx, Line: line,
+			MaxWidth: maxWidth, Generation: gen,
+		}
+		if pathErr != nil {
+			msg.Error = pathErr
+			return msg
+		}
+		img, err := latex.PreparePicture(cacheDir, path, maxWidth, maxHeight)
+		var info latex.ImageInfo
+		if err == nil {
+			info, err = images.Acquire(img.Path, img.Rows, 0)
+		}
+		msg.ImageID, msg.ImageCols, msg.ImageHeight, msg.Error = info.ImageID, info.Cols, info.Rows, err
+		return msg
+	}
+}
+
+// releaseRemovedPictures frees the pictures of lines past the end of a block.
+func (m *Model) releaseRemovedPictures(blockIdx, lineCount int) {
+	for lineIdx := range m.Pictures[blockIdx] {
+		if lineIdx >= lineCount {
+			m.releasePicture(blockIdx, lineIdx)
+		}
+	}
+}
+
+// releasePicture frees the picture shown for a line, if any.
+func (m *Model) releasePicture(blockIdx, lineIdx int) {
+	pictures := m.Pictures[blockIdx]
+	if render, ok := pictures[lineIdx]; ok {
+		m.images.Release(render.ImageID)
+		delete(pictures, lineIdx)
+		if len(pictures) == 0 {
+			delete(m.Pictures, blockIdx)
+		}
+	}
+}
+
+// pictureBounds returns the pixel size a picture is fitted to: the editor
+// width, or the width the link asks for, and the height it asks for or one
+// screen.
+func (m *Model) pictureBounds(link editor.ImageLink) (int, int) {
+	cols := m.calculateContentWidth()
+	if link.WidthPercent {
+		cols = cols * min(link.Width, 100) / 100
+	} else if link.Width > 0 {
+		cols = min(link.Width, cols)
+	}
+	rows := max(m.Editor.Height, 1)
+	if link.Height > 0 {
+		rows = link.Height
+	}
+	return max(cols, 1) * m.CellSize.WidthPx, rows * m.CellSize.HeightPx
+}
+
+// picturePath resolves a link relative to the current note and checks that
+// it stays inside the notebook, or the notes directory outside a notebook.
+func (m *Model) picturePath(link string) (string, error) {
+	root := m.NotebookPath
+	if root == "" {
+		root = m.Config.NotesDir
+	}
+	path := link
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(m.CurrentFile), path)
+	}
+	resolved, err := filepath.EvalSymlinks(path)
+	if err != nil {
+		return "", fmt.Errorf("image %s: %w", link, err)
+	}
+	if realRoot, err := filepath.EvalSymlinks(root); err == nil {
+		root = realRoot
+	}
+	rel, err := filepath.Rel(root, resolved)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", fmt.Errorf("image %s is outside the notebook", link)
+	}
+	return resolved, nil
+}
+
+// pictureRows returns the rows that display the picture linked from a line
+// and the image laid out in them, or nil when it has none to show.
+func (m Model) pictureRows(imgs *frameImages, blockIdx, lineIdx int, line string) ([]string, []lineImage) {
+	render, ok := m.Pictures[blockIdx][lineIdx]
+	if !ok || render.ImageID == 0 || render.Line != line {
+		return nil, nil
+	}
+	rows := make([]string, render.ImageHeight)
+	for i := range rows {
+		rows[i] = imgs.cells(render.ImageID, i, render.ImageCols)
+	}
+	return rows, []lineImage{{imageID: render.ImageID, rows: render.ImageHeight, cols: render.ImageCols}}
+}
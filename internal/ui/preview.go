@@ -0,0 +1,178 @@
+package ui
+
+import (
+	"context"
+	"image"
+	"strings"
+	"time"
+
+	tea "charm.land/bubbletea/v2"
+	"charm.land/lipgloss/v2"
+	"github.com/RNAV2019/quasar/internal/editor"
+	"github.com/RNAV2019/quasar/internal/latex"
+	"github.com/RNAV2019/quasar/internal/styles"
+	"github.com/charmbracelet/x/ansi"
+)
+
+// previewDelay is how long the source of the math block being edited must
+// stay unchanged before its preview is re-rendered.
+const previewDelay = 300 * time.Millisecond
+
+// previewGroup is the render pool key and group of preview renders.
+const previewGroup = "preview"
+
+// mathPreview is the floating render of the math block under the cursor,
+// which processDirtyBlocks leaves as source while it is being edited.
+type mathPreview struct {
+	blockIdx  int
+	typed     string    // Source as last seen while typing
+	typedAt   time.Time // When typed last changed
+	requested string    // Source of the render in flight or last finished
+	imageID   uint32
+	cols      int
+	rows      int
+	textLines []string
+	err       string // Error of the current source; the last good render stays shown
+}
+
+// updatePreview debounces edits to the math block under the cursor and
+// returns a command rendering its source once typing pauses. The preview is
+// cleared when the cursor leaves the block or Insert mode.
+func (m *Model) updatePreview() tea.Cmd {
+	blockIdx := m.Editor.Cursor.BlockIdx
+	if m.mode != Insert || blockIdx >= len(m.Editor.Blocks) {
+		m.clearPreview()
+		return nil
+	}
+	block := m.Editor.Blocks[blockIdx]
+	if block.Type != editor.MathBlock || editor.IsMacroBlock(block.Lines) {
+		m.clearPreview()
+		return nil
+	}
+	if m.preview.blockIdx != blockIdx {
+		m.clearPreview()
+		m.preview.blockIdx = blockIdx
+	}
+
+	source := m.ParsedDoc.MathSource(editor.MathBlockContent(block.Lines))
+	if source != m.preview.typed {
+		m.preview.typed, m.preview.typedAt = source, m.Time
+		return nil
+	}
+	if source == m.preview.requested || m.Time.Sub(m.preview.typedAt) < previewDelay {
+		return nil
+	}
+	m.preview.requested = source
+
+	if strings.TrimSpace(source) == "" {
+		m.images.Release(m.preview.imageID)
+		m.preview.imageID, m.preview.cols, m.preview.rows = 0, 0, 0
+		m.preview.textLines, m.preview.err = nil, ""
+		return nil
+	}
+	if m.textOnly() {
+		m.preview.textLines = latex.ToUnicode(source, false)
+		m.preview.rows = len(m.preview.textLines)
+		return nil
+	}
+
+	renderer := m.Renderer
+	pool := m.renderPool
+	images := m.images
+	gen := m.fileGeneration
+	renderCtx := latex.WithMacros(context.Background(), m.renderMacros)
+	pool.Cancel(previewGroup)
+	return func() tea.Msg {
+		var img latex.Image
+		var err error
+		task := latex.Task{
+			Key: previewGroup, Group: previewGroup, Pos: blockIdx,
+			Fn: func(ctx context.Context) { img, err = renderer.Render(ctx, source, false) },
+		}
+		if pool.Run(renderCtx, task) != nil {
+			return PreviewRenderedMsg{BlockIdx: blockIdx, Source: source, Canceled: true, Generation: gen}
+		}
+		var info latex.ImageInfo
+		if err == nil {
+			info, err = images.Acquire(img.Path, img.Rows, 0)
+		}
+		return PreviewRenderedMsg{
+			BlockIdx: blockIdx, Source: source, ImageID: info.ImageID,
+			ImageCols: info.Cols, ImageHeight: info.Rows, Error: err,
+			Generation: gen,
+		}
+	}
+}
+
+// applyPreview records a finished preview render. Results for source that
+// has since been edited are discarded, and a failed render keeps the
+// previous image on screen beside its error.
+func (m *Model) applyPreview(msg PreviewRenderedMsg) {
+	if msg.Generation != m.fileGeneration || msg.BlockIdx != m.preview.blockIdx ||
+		msg.Source != m.preview.requested || msg.Canceled {
+		m.images.Release(msg.ImageID)
+		return
+	}
+	if msg.Error != nil {
+		if msg.BlockIdx < len(m.Editor.Blocks) {
+			m.preview.err, _ = blockDiagnostic(m.Editor.Blocks[msg.BlockIdx], msg.Error)
+		}
+		return
+	}
+	m.images.Release(m.preview.imageID)
+	m.preview.imageID = msg.ImageID
+	m.preview.cols, m.preview.rows = msg.ImageCols, msg.ImageHeight
+	m.preview.textLines, m.preview.err = nil, ""
+}
+
+// clearPreview hides the preview and frees its image.
+func (m *Model) clearPreview() {
+	m.renderPool.Cancel(previewGroup)
+	m.images.Release(m.preview.imageID)
+	m.preview = mathPreview{}
+}
+
+// renderPreviewOverlay draws the preview in a box just above the block
+// being edited, or below it when there is no room above. top and bottom are
+// the screen rows of the block, x the column its text starts at.
+func (m Model) renderPreviewOverlay(imgs *frameImages, view string, top, bottom, x, maxWidth, height int) string {
+	p := m.preview
+	if p.imageID == 0 && len(p.textLines) == 0 && p.err == "" {
+		return view
+	}
+
+	var lines []string
+	for i := range p.rows {
+		if p.imageID != 0 {
+			lines = append(lines, imgs.cells(p.imageID, i, p.cols))
+		} else if i < len(p.textLines) {
+			lines = append(lines, styles.MathTextStyle.Render(p.textLines[i]))
+		}
+	}
+	if p.err != "" {
+		lines = append(lines, lipgloss.NewStyle().Foreground(styles.ColorRed).Render(ansi.Truncate(p.err, max(maxWidth-4, 1), "…")))
+	}
+
+	style := styles.DefaultDialogStyle()
+	box := lipgloss.NewStyle().
+		Border(lipgloss.RoundedBorder()).
+		BorderForeground(style.BorderColor).
+		Padding(0, 1).
+		Render(strings.Join(lines, "\n"))
+
+	boxHeight := lipgloss.Height(box)
+	y := top - boxHeight
+	if y < 0 {
+		y = min(bottom+1, max(height-boxHeight, 0))
+	}
+
+	// Align the contents of the box with the text of the block.
+	boxX := max(x-2, 0)
+	imgs.cover(image.Rect(boxX, y, boxX+lipgloss.Width(box), y+boxHeight))
+	if p.imageID != 0 {
+		imgs.place(p.imageID, boxX+2, y+1, p.rows, p.cols)
+	}
+	bgLayer := lipgloss.NewLayer(view)
+	previewLayer := lipgloss.NewLayer(box).X(boxX).Y(y).Z(1)
+	return lipgloss.NewCompositor(bgLayer, previewLayer).Render()
+}
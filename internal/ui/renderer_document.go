@@ -2,6 +2,7 @@ package ui
 
 import (
 	"fmt"
+	"image"
 	"slices"
 	"strings"
 
@@ -204,7 +205,7 @@ func (m Model) renderTextBlockWithGlamour(blockIdx int, block editor.Block) rend
 		}
 
 		// Single line
-		out, err := markdownRender.Render(line)
+		out, err := markdownRender.Render(m.ParsedDoc.ResolveRefs(line))
 		if err != nil {
 			rendered[i] = []string{line}
 			i++
@@ -286,8 +287,9 @@ func (m Model) renderLoadingState(contentHeight int, statusLine string) string {
 	return layout.Render(m.layoutParams(contentHeight, contentStr, statusLine))
 }
 
-// renderDialogOverlay renders whichever dialog is active on top of the view.
-func (m Model) renderDialogOverlay(view string) (string, tea.Cursor) {
+// renderDialogOverlay renders whichever dialog is active on top of the view
+// and returns the area it covers.
+func (m Model) renderDialogOverlay(view string) (string, tea.Cursor, image.Rectangle) {
 	dim := dialog.Dimensions{Width: m.width, Height: m.height}
 	switch m.mode {
 	case Command:
@@ -307,12 +309,13 @@ func (m Model) renderDialogOverlay(view string) (string, tea.Cursor) {
 	case FileTreeRename:
 		return m.RenameDialog.Render(view, dim)
 	default:
-		return view, tea.Cursor{}
+		return view, tea.Cursor{}, image.Rectangle{}
 	}
 }
 
-// calculateCursor computes the cursor position from the visual line map.
-func (m Model) calculateCursor(visualLineMap map[int][]int, offsetAbsLine, gutterWidth, fileTreeOffset int) (int, int) {
+// calculateCursor computes the cursor position from the visual line map and
+// the row of the cursor line that holds its text.
+func (m Model) calculateCursor(visualLineMap map[int][]int, offsetAbsLine, cursorTextRow, gutterWidth, fileTreeOffset int) (int, int) {
 	cursorBlockIdx := m.Editor.Cursor.BlockIdx
 	cursorLineIdx := m.Editor.Cursor.LineIdx
 	cursorCol := m.Editor.Cursor.Col
@@ -359,7 +362,7 @@ func (m Model) calculateCursor(visualLineMap map[int][]int, offsetAbsLine, gutte
 		cursorY += cursorLineIdx
 	}
 
-	cursorY -= offsetAbsLine
+	cursorY += cursorTextRow - offsetAbsLine
 	if cursorY < 0 {
 		cursorY = 0
 	}
@@ -382,11 +385,20 @@ func (m Model) calculateCursor(visualLineMap map[int][]int, offsetAbsLine, gutte
 	return cursorX, cursorY
 }
 
-// View renders the complete TUI frame including content, dialogs, and cursor.
+// View returns the frame rendered by the last Update.
 func (m Model) View() tea.View {
 	if m.width == 0 {
 		return tea.NewView("loading...")
 	}
+	return m.frame.view
+}
+
+// render renders the complete TUI frame including content, dialogs, cursor,
+// and the layout of its positioned images.
+func (m Model) render() frame {
+	if m.width == 0 {
+		return frame{}
+	}
 
 	statusLine := m.RenderStatusline()
 	renderContentHeight := max(m.height-1, 0)
@@ -396,7 +408,7 @@ func (m Model) View() tea.View {
 		view := m.renderEmptyState(renderContentHeight, statusLine)
 
 		var cursorConfig tea.Cursor
-		view, cursorConfig = m.renderDialogOverlay(view)
+		view, cursorConfig, _ = m.renderDialogOverlay(view)
 
 		if m.Autocomplete.IsActive() {
 			m.Autocomplete.SetPosition(2, 3)
@@ -410,16 +422,15 @@ func (m Model) View() tea.View {
 		} else {
 			v.Cursor = nil
 		}
-		return v
+		return frame{view: v}
 	}
 
 	// Handle document loading state
 	if m.DocumentLoading {
-		view := m.renderLoadingState(renderContentHeight, statusLine)
-		v := tea.NewView(view)
+		v := tea.NewView(m.renderLoadingState(renderContentHeight, statusLine))
 		v.AltScreen = true
 		v.Cursor = nil
-		return v
+		return frame{view: v}
 	}
 
 	fileTreeOffset := 0
@@ -427,24 +438,19 @@ func (m Model) View() tea.View {
 		fileTreeOffset = m.FileTree.Width + 1
 	}
 
-	totalLines := 0
-	for _, block := range m.Editor.Blocks {
-		totalLines += len(block.Lines)
-	}
-	gutterWidth := len(fmt.Sprint(totalLines))
+	gutterWidth := len(fmt.Sprint(m.Editor.GetLineCount()))
 	contentWidth := max(m.width-5-gutterWidth-fileTreeOffset, 1)
+	textX := 2 + gutterWidth + 3 + fileTreeOffset
+	imgs := newFrameImages(m.width, renderContentHeight)
 
 	// Calculate absolute offset line number
-	offsetAbsLine := 0
-	for i := 0; i < m.Editor.Offset.BlockIdx && i < len(m.Editor.Blocks); i++ {
-		offsetAbsLine += len(m.Editor.Blocks[i].Lines)
-	}
-	offsetAbsLine += m.Editor.Offset.LineIdx
+	offsetAbsLine := m.Editor.AbsLine(m.Editor.Offset)
 
 	var contentBuilder strings.Builder
 	globalLineIdx := 0
 	visualLinesRendered := 0
 	visualLineMap := make(map[int][]int)
+	cursorTextRow := 0
 
 	for blockIdx, block := range m.Editor.Blocks {
 		isBlockActive := blockIdx == m.Editor.Cursor.BlockIdx
@@ -453,7 +459,7 @@ func (m Model) View() tea.View {
 		var indicator string
 		if block.HasError {
 			indicator = styles.ErrorGutterIndicator
-		} else if block.Type == editor.MathBlock {
+		} else if block.Type != editor.TextBlock {
 			indicator = styles.MathGutterIndicator
 		} else {
 			indicator = styles.TextGutterIndicator
@@ -461,7 +467,7 @@ func (m Model) View() tea.View {
 
 		height := len(block.Lines)
 
-		if !isBlockActive && block.Type == editor.MathBlock && block.ImageID != 0 {
+		if !isBlockActive && block.Type != editor.TextBlock && (block.ImageID != 0 || len(block.TextLines) > 0) {
 			displayHeight := block.ImageHeight
 			if displayHeight < height {
 				displayHeight = height
@@ -470,8 +476,10 @@ func (m Model) View() tea.View {
 			for i := range displayHeight {
 				visualLineMap[blockIdx][i] = 1
 			}
-			// Vertically center the image within the display height
+			// Vertically center the image or text within the display height
 			topPad := (displayHeight - block.ImageHeight) / 2
+			tag := m.ParsedDoc.EquationTag(blockIdx)
+			tagRow := topPad + (block.ImageHeight-1)/2
 			for i := range displayHeight {
 				if globalLineIdx < offsetAbsLine {
 					globalLineIdx++
@@ -486,14 +494,31 @@ func (m Model) View() tea.View {
 				lineNumStr := fmt.Sprintf(" %*d ", gutterWidth, lineNum)
 				contentBuilder.WriteString(indicator)
 				contentBuilder.WriteString(styles.GutterStyle.Render(lineNumStr))
+				width := 0
 				if i >= topPad && i < topPad+block.ImageHeight {
-					contentBuilder.WriteString(latex.PlaceholderRow(block.ImageID, uint16(i-topPad), block.ImageCols))
+					if block.ImageID != 0 {
+						if i == topPad {
+							imgs.place(block.ImageID, textX, visualLinesRendered, block.ImageHeight, block.ImageCols)
+						}
+						contentBuilder.WriteString(imgs.cells(block.ImageID, i-topPad, block.ImageCols))
+						width = block.ImageCols
+					} else {
+						contentBuilder.WriteString(styles.MathTextStyle.Render(block.TextLines[i-topPad]))
+						width = ansi.StringWidth(block.TextLines[i-topPad])
+					}
+				}
+				// Equation numbers are right-aligned beside the math, as in print
+				if tag != "" && i == tagRow {
+					if gap := contentWidth - width - ansi.StringWidth(tag); gap >= 2 {
+						contentBuilder.WriteString(strings.Repeat(" ", gap))
+						contentBuilder.WriteString(styles.DimStyle.Render(tag))
+					}
 				}
 				contentBuilder.WriteString("\n")
 				globalLineIdx++
 				visualLinesRendered++
 			}
-		} else if !isBlockActive && block.Type == editor.MathBlock && block.IsLoading {
+		} else if !isBlockActive && block.Type != editor.TextBlock && block.IsLoading {
 			visualLineMap[blockIdx] = make([]int, height)
 			for i := range height {
 				visualLineMap[blockIdx][i] = 1
@@ -526,8 +551,20 @@ func (m Model) View() tea.View {
 				hasInlineMath := rendered.inlineMathChecker != nil && rendered.inlineMathChecker(lineIdx)
 
 				var visualLines []string
-				if isCursorLine || hasInlineMath {
-					visualLines = []string{editor.ExpandTabs(m.applyInlinePlaceholders(blockIdx, lineIdx, lineStr))}
+				var lineImages []lineImage
+				textRow := 0
+				// Pictures replace their link except on the cursor line
+				if picture, images := m.pictureRows(imgs, blockIdx, lineIdx, lineStr); picture != nil && !isCursorLine {
+					visualLines, lineImages = picture, images
+				} else if isCursorLine || hasInlineMath {
+					line, images := m.applyInlinePlaceholders(blockIdx, lineIdx, lineStr)
+					var rows int
+					rows, textRow = lineSpan(images)
+					visualLines, lineImages = make([]string, rows), images
+					visualLines[textRow] = editor.ExpandTabs(line)
+					if isCursorLine {
+						cursorTextRow = textRow
+					}
 				} else if lineIdx >= rendered.contentStartIdx && rendered.lines[lineIdx] != nil && len(rendered.lines[lineIdx]) > 0 {
 					visualLines = rendered.lines[lineIdx]
 				} else {
@@ -553,12 +590,13 @@ func (m Model) View() tea.View {
 					lineNumStr := fmt.Sprintf(" %*d ", gutterWidth, lineNum)
 
 					var styledGutter string
-					if vIdx == 0 {
+					if vIdx == textRow {
 						if isBlockActive && lineIdx == m.Editor.Cursor.LineIdx {
 							styledGutter = styles.CurrentLineStyle.Render(lineNumStr)
 						} else {
 							styledGutter = styles.GutterStyle.Render(lineNumStr)
 						}
+						imgs.placeLine(lineImages, textX, visualLinesRendered)
 					} else {
 						styledGutter = styles.GutterStyle.Render(strings.Repeat(" ", gutterWidth+2))
 					}
@@ -572,52 +610,66 @@ func (m Model) View() tea.View {
 			}
 		} else {
 			visualLineMap[blockIdx] = make([]int, height)
-			for i := range height {
-				visualLineMap[blockIdx][i] = 1
-			}
+			shouldBlank := !(m.mode == Insert && isBlockActive)
 			for lineIdx, lineStr := range block.Lines {
-				if globalLineIdx < offsetAbsLine {
-					globalLineIdx++
-					continue
-				}
-				if visualLinesRendered >= renderContentHeight {
-					globalLineIdx++
-					continue
-				}
-
-				shouldBlank := !(m.mode == Insert && isBlockActive)
-
 				isOnTab := m.mode == Normal && isBlockActive && lineIdx == m.Editor.Cursor.LineIdx &&
 					m.Editor.Cursor.Col < len([]rune(lineStr)) && len([]rune(lineStr)) > 0 &&
 					[]rune(lineStr)[m.Editor.Cursor.Col] == '\t'
 
+				var lineImages []lineImage
 				if shouldBlank && block.Type == editor.TextBlock {
-					lineStr = m.applyInlinePlaceholders(blockIdx, lineIdx, lineStr)
+					lineStr, lineImages = m.applyInlinePlaceholders(blockIdx, lineIdx, lineStr)
 				}
+				rows, textRow := lineSpan(lineImages)
+				visualLineMap[blockIdx][lineIdx] = rows
 
-				if isOnTab {
-					lineStr = renderLineWithTabHighlight(lineStr, m.Editor.Cursor.Col, styles.TabHighlightStyle)
-				} else {
-					lineStr = editor.ExpandTabs(lineStr)
-				}
+				for vIdx := range rows {
+					if globalLineIdx < offsetAbsLine {
+						globalLineIdx++
+						continue
+					}
+					if visualLinesRendered >= renderContentHeight {
+						globalLineIdx++
+						continue
+					}
+					if vIdx != textRow {
+						contentBuilder.WriteString(indicator)
+						contentBuilder.WriteString(styles.GutterStyle.Render(strings.Repeat(" ", gutterWidth+2)))
+						contentBuilder.WriteString("\n")
+						globalLineIdx++
+						visualLinesRendered++
+						continue
+					}
+					imgs.placeLine(lineImages, textX, visualLinesRendered)
 
-				lineStr = m.applySelectionHighlighting(lineStr, blockIdx, lineIdx)
+					if isOnTab {
+						lineStr = renderLineWithTabHighlight(lineStr, m.Editor.Cursor.Col, styles.TabHighlightStyle)
+					} else {
+						lineStr = editor.ExpandTabs(lineStr)
+					}
 
-				lineNum := globalLineIdx + 1
-				lineNumStr := fmt.Sprintf(" %*d ", gutterWidth, lineNum)
+					lineStr = m.applySelectionHighlighting(lineStr, blockIdx, lineIdx)
 
-				var styledGutter string
-				if isBlockActive && lineIdx == m.Editor.Cursor.LineIdx {
-					styledGutter = styles.CurrentLineStyle.Render(lineNumStr)
-				} else {
-					styledGutter = styles.GutterStyle.Render(lineNumStr)
+					if block.HasError && lineIdx == block.ErrorLine && !m.Editor.Selection.Active {
+						lineStr = styles.ErrorLineStyle.Render(lineStr)
+					}
+
+					lineNum := globalLineIdx + 1
+					lineNumStr := fmt.Sprintf(" %*d ", gutterWidth, lineNum)
+
+					var styledGutter string
+					if isBlockActive && lineIdx == m.Editor.Cursor.LineIdx {
+						styledGutter = styles.CurrentLineStyle.Render(lineNumStr)
+					} else {
+						styledGutter = styles.GutterStyle.Render(lineNumStr)
+					}
+					contentBuilder.WriteString(indicator)
+					contentBuilder.WriteString(styledGutter)
+					contentBuilder.WriteString(truncateLine(lineStr, contentWidth))
+					contentBuilder.WriteString("\n")
+					globalLineIdx++
+					visualLinesRendered++
 				}
-				contentBuilder.WriteString(indicator)
-				contentBuilder.WriteString(styledGutter)
-				contentBuilder.WriteString(truncateLine(lineStr, contentWidth))
-				contentBuilder.WriteString("\n")
-				globalLineIdx++
-				visualLinesRendered++
 			}
 		}
 	}
@@ -631,10 +683,12 @@ func (m Model) View() tea.View {
 
 	view := layout.Render(m.layoutParams(renderContentHeight, contentStr, statusLine))
 
-	cursorX, cursorY := m.calculateCursor(visualLineMap, offsetAbsLine, gutterWidth, fileTreeOffset)
+	cursorX, cursorY := m.calculateCursor(visualLineMap, offsetAbsLine, cursorTextRow, gutterWidth, fileTreeOffset)
 
 	var cursorConfig tea.Cursor
-	view, cursorConfig = m.renderDialogOverlay(view)
+	var dialogBounds image.Rectangle
+	view, cursorConfig, dialogBounds = m.renderDialogOverlay(view)
+	imgs.cover(dialogBounds)
 
 	// For non-dialog modes, set editor cursor
 	if cursorConfig.Shape == 0 {
@@ -654,9 +708,23 @@ func (m Model) View() tea.View {
 		}
 	}
 
+	if m.mode == Insert {
+		lines := visualLineMap[m.Editor.Cursor.BlockIdx]
+		top := cursorY
+		for i := 0; i < m.Editor.Cursor.LineIdx && i < len(lines); i++ {
+			top -= lines[i]
+		}
+		bottom := top - 1
+		for _, n := range lines {
+			bottom += n
+		}
+		view = m.renderPreviewOverlay(imgs, view, top, bottom, textX, contentWidth, renderContentHeight)
+	}
+
 	if m.Autocomplete.IsActive() {
 		m.Autocomplete.SetPosition(cursorX, cursorY+1)
 		view = m.Autocomplete.Render(view)
+		imgs.cover(m.Autocomplete.Bounds())
 	}
 
 	v := tea.NewView(view)
@@ -668,7 +736,7 @@ func (m Model) View() tea.View {
 	} else {
 		v.Cursor = &cursorConfig
 	}
-	return v
+	return frame{view: v, placements: imgs.placements}
 }
 
 // truncateLine truncates a line to fit within maxChars, preserving ANSI escape codes.
@@ -679,9 +747,55 @@ func truncateLine(line string, maxChars int) string {
 	return ansi.Truncate(line, maxChars, "")
 }
 
-func (m Model) applyInlinePlaceholders(blockIdx, lineIdx int, lineStr string) string {
+// lineImage is an image laid out in a rendered line. Its top row lies row
+// rows below the row holding the line's text, or above it when negative,
+// and starts at column x of the text.
+type lineImage struct {
+	imageID uint32
+	x       int
+	row     int
+	rows    int
+	cols    int
+	offsetY int
+	fit     bool
+	inline  bool // Placed at its position under every protocol
+}
+
+// lineSpan returns the rows a line takes with its images and which of them
+// holds its text.
+func lineSpan(images []lineImage) (rows, textRow int) {
+	below := 0
+	for _, img := range images {
+		textRow = max(textRow, -img.row)
+		below = max(below, img.row+img.rows-1)
+	}
+	return textRow + 1 + below, textRow
+}
+
+// placeLine records the images of a line whose text is rendered on screen
+// row y, starting at column x.
+func (f *frameImages) placeLine(images []lineImage, x, y int) {
+	for _, img := range images {
+		if img.inline || f.positioned {
+			f.add(latex.Placement{
+				ImageID: img.imageID,
+				X:       x + img.x,
+				Y:       y + img.row,
+				Rows:    img.rows,
+				Cols:    img.cols,
+				OffsetY: img.offsetY,
+				Fit:     img.fit,
+			})
+		}
+	}
+}
+
+// applyInlinePlaceholders replaces the inline math of a line with its
+// renders and returns the images laid out in it. Images are left as blank
+// cells, drawn over by their placements.
+func (m Model) applyInlinePlaceholders(blockIdx, lineIdx int, lineStr string) (string, []lineImage) {
 	if blockIdx >= len(m.Editor.Blocks) {
-		return lineStr
+		return lineStr, nil
 	}
 
 	type inlineMatch struct {
@@ -693,12 +807,17 @@ func (m Model) applyInlinePlaceholders(blockIdx, lineIdx int, lineStr string) st
 	var matches []inlineMatch
 	isBlockActive := blockIdx == m.Editor.Cursor.BlockIdx
 
-	for key, render := range m.InlineRenders {
-		var bIdx, lIdx, startCol int
-		fmt.Sscanf(key, "%d-%d-%d", &bIdx, &lIdx, &startCol)
-		if bIdx != blockIdx || lIdx != lineIdx {
+	// References show their numbers except on the line being edited
+	text := m.ParsedDoc.ResolveRefs
+	if isBlockActive && lineIdx == m.Editor.Cursor.LineIdx {
+		text = func(s string) string { return s }
+	}
+
+	for pos, render := range m.InlineRenders[blockIdx] {
+		if pos.Line != lineIdx {
 			continue
 		}
+		startCol := pos.Col
 
 		hovered := m.mode == Normal && isBlockActive && lineIdx == m.Editor.Cursor.LineIdx &&
 			m.Editor.Cursor.Col >= startCol && m.Editor.Cursor.Col < startCol+render.TextLength
@@ -707,7 +826,7 @@ func (m Model) applyInlinePlaceholders(blockIdx, lineIdx int, lineStr string) st
 	}
 
 	if len(matches) == 0 {
-		return lineStr
+		return text(lineStr), nil
 	}
 
 	slices.SortFunc(matches, func(a, b inlineMatch) int {
@@ -716,27 +835,41 @@ func (m Model) applyInlinePlaceholders(blockIdx, lineIdx int, lineStr string) st
 
 	runes := []rune(lineStr)
 	var result strings.Builder
+	var images []lineImage
 	pos := 0
 
 	for _, match := range matches {
 		if match.startCol > pos {
-			result.WriteString(string(runes[pos:match.startCol]))
+			result.WriteString(text(string(runes[pos:match.startCol])))
 		}
 
 		if match.hovered {
 			end := min(match.startCol+match.render.TextLength, len(runes))
 			result.WriteString(string(runes[match.startCol:end]))
+		} else if match.render.Text != "" {
+			result.WriteString(styles.MathTextStyle.Render(match.render.Text))
 		} else {
-			result.WriteString(latex.PlaceholderRow(match.render.ImageID, 0, match.render.Length))
+			x := ansi.StringWidth(editor.ExpandTabs(result.String()))
+			images = append(images, lineImage{
+				imageID: match.render.ImageID,
+				x:       x,
+				row:     -match.render.TextRow,
+				rows:    match.render.ImageHeight,
+				cols:    match.render.Length,
+				offsetY: match.render.OffsetY,
+				fit:     match.render.Fit,
+				inline:  true,
+			})
+			result.WriteString(strings.Repeat(" ", match.render.Length))
 		}
 		pos = match.startCol + match.render.TextLength
 	}
 
 	if pos < len(runes) {
-		result.WriteString(string(runes[pos:]))
+		result.WriteString(text(string(runes[pos:])))
 	}
 
-	return result.String()
+	return result.String(), images
 }
 
 // renderLineWithTabHighlight expands tabs and highlights the tab at cursor position.
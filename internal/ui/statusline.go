@@ -68,6 +68,29 @@ func (m Model) getFilename() string {
 	return "untitled.md"
 }
 
+// statusError returns a one-line message for the block error to show in the
+// statusline, preferring the block under the cursor.
+func (m Model) statusError() string {
+	var message string
+	absLine := 0
+	for i, block := range m.Editor.Blocks {
+		if block.HasError && block.ErrorMessage != "" {
+			msg := block.ErrorMessage
+			if block.ErrorLine >= 0 {
+				msg = fmt.Sprintf("Line %d: %s", absLine+block.ErrorLine+1, msg)
+			}
+			if message == "" || i == m.Editor.Cursor.BlockIdx {
+				message = msg
+			}
+			if i >= m.Editor.Cursor.BlockIdx {
+				break
+			}
+		}
+		absLine += len(block.Lines)
+	}
+	return message
+}
+
 // RenderStatusline renders the mode indicator, filename, position, and clock.
 func (m Model) RenderStatusline() string {
 	modeStyle := m.getModeStyle()
@@ -99,13 +122,7 @@ func (m Model) RenderStatusline() string {
 		cursorCol = m.Editor.Cursor.Col + 1
 	}
 
-	var statusError string
-	for _, block := range m.Editor.Blocks {
-		if block.HasError && block.ErrorMessage != "" {
-			statusError = block.ErrorMessage
-			break
-		}
-	}
+	statusError := m.statusError()
 
 	// Key preview (shown in non-insert modes when there's a pending key)
 	var renderedKeyPreview string
@@ -12,9 +12,20 @@ import (
 	"github.com/atotto/clipboard"
 )
 
-// updateParsedDoc re-parses the document when blocks change.
+// updateParsedDoc re-parses the blocks that changed since the last parse.
+// When the equation numbering changes, blocks that reference equations are
+// marked dirty so their math is rendered with the new numbers.
 func (m *Model) updateParsedDoc() {
-	m.ParsedDoc = editor.ParseDocument(m.Editor.Blocks)
+	old := m.ParsedDoc
+	m.ParsedDoc = editor.ReparseDocument(old, m.Editor.Blocks)
+	if old == nil || old.SameNumbering(m.ParsedDoc) {
+		return
+	}
+	for i := range m.Editor.Blocks {
+		if editor.HasRefs(m.Editor.Blocks[i].Lines) {
+			m.Editor.Blocks[i].IsDirty = true
+		}
+	}
 }
 
 // updateEditorSize adjusts the editor size based on file tree visibility.
@@ -28,11 +39,7 @@ func (m *Model) updateEditorSize() {
 
 // calculateContentWidth returns the available width for content in terminal columns.
 func (m *Model) calculateContentWidth() int {
-	totalLines := 0
-	for _, block := range m.Editor.Blocks {
-		totalLines += len(block.Lines)
-	}
-	gutterWidth := len(fmt.Sprint(totalLines))
+	gutterWidth := len(fmt.Sprint(m.Editor.GetLineCount()))
 
 	fileTreeOffset := 0
 	if m.ShowFileTree {
@@ -42,8 +49,20 @@ func (m *Model) calculateContentWidth() int {
 	return max(m.width-5-gutterWidth-fileTreeOffset, 40)
 }
 
-// Update handles all incoming messages and returns the updated model.
+// Update handles all incoming messages and returns the updated model with
+// its frame rendered, so the images laid out in it are known before the next
+// message.
 func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
+	next, cmd := m.update(msg)
+	m = next.(Model)
+	m.frame = m.render()
+	if !latex.ActiveProtocol().Positioned() {
+		m.flushPlacements()
+	}
+	return m, cmd
+}
+
+func (m Model) update(msg tea.Msg) (tea.Model, tea.Cmd) {
 	var cmds []tea.Cmd
 
 	switch msg := msg.(type) {
@@ -102,30 +121,41 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 		m.height = msg.Height
 		m.CellSize = terminal.GetCellSize()
 		m.updateEditorSize()
+		m.updateRenderMetrics()
+		// The terminal is repainted on resize, wiping sixel and iTerm2
+		// images. Kitty placements outlive the repaint and are dropped.
+		if !latex.ActiveProtocol().Positioned() {
+			latex.UpdatePlacements(m.placements.drawn, nil, nil)
+		}
+		m.placements = placementState{}
 
 	case BlockProcessedMsg:
 		if msg.Generation != m.fileGeneration {
-			if msg.ImageID != 0 {
-				latex.DeleteImage(msg.ImageID)
-			}
+			m.images.Release(msg.ImageID)
 			break
 		}
 		m.PendingRenders--
+		m.invalidateEviction()
 		if msg.Source != "" {
 			m.CompiledMath = append(m.CompiledMath, msg.Source)
 		}
-		if msg.BlockIdx < len(m.Editor.Blocks) {
+		if msg.Canceled {
+			if msg.BlockIdx < len(m.Editor.Blocks) {
+				m.Editor.Blocks[msg.BlockIdx].IsLoading = false
+			}
+		} else if msg.BlockIdx < len(m.Editor.Blocks) {
 			block := &m.Editor.Blocks[msg.BlockIdx]
 			block.IsLoading = false
-			if block.ImageID != 0 && block.ImageID != msg.ImageID {
-				latex.DeleteImage(block.ImageID)
-			}
+			// The new image holds its own reference, even if it is the same one.
+			m.images.Release(block.ImageID)
 			block.ImageID = msg.ImageID
 			block.ImageCols = msg.ImageCols
 			block.ImageHeight = msg.ImageHeight
+			block.TextLines = msg.TextLines
 			block.HasError = msg.Error != nil
+			block.ErrorLine = -1
 			if msg.Error != nil {
-				block.ErrorMessage = msg.Error.Error()
+				block.ErrorMessage, block.ErrorLine = blockDiagnostic(*block, msg.Error)
 				errors.AddError(msg.Error.Error(), "latex")
 			} else {
 				block.ErrorMessage = ""
@@ -135,22 +165,38 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.DocumentLoading = false
 		}
 
+	case PreviewRenderedMsg:
+		m.applyPreview(msg)
+
 	case InlineMathProcessedMsg:
 		if msg.Generation != m.fileGeneration {
-			if msg.ImageID != 0 {
-				latex.DeleteImage(msg.ImageID)
-			}
+			m.images.Release(msg.ImageID)
 			break
 		}
 		m.PendingRenders--
-		if msg.Error != nil {
+		m.invalidateEviction()
+		switch {
+		case msg.Canceled:
+			// Superseded by a newer render; nothing to record.
+		case msg.Error != nil:
 			errors.AddError(msg.Error.Error(), "latex")
-		} else if msg.BlockIdx < len(m.Editor.Blocks) {
-			key := fmt.Sprintf("%d-%d-%d", msg.BlockIdx, msg.LineIdx, msg.StartCol)
-			m.InlineRenders[key] = InlineMathRender{
+		case msg.BlockIdx < len(m.Editor.Blocks):
+			key := SpanPos{Line: msg.LineIdx, Col: msg.StartCol}
+			renders := m.InlineRenders[msg.BlockIdx]
+			if renders == nil {
+				renders = make(map[SpanPos]InlineMathRender)
+				m.InlineRenders[msg.BlockIdx] = renders
+			} else if old, ok := renders[key]; ok {
+				m.images.Release(old.ImageID)
+			}
+			renders[key] = InlineMathRender{
 				ImageID:     msg.ImageID,
 				ImageCols:   msg.ImageCols,
 				ImageHeight: msg.ImageHeight,
+				TextRow:     msg.TextRow,
+				OffsetY:     msg.OffsetY,
+				Fit:         msg.Fit,
+				Text:        msg.Text,
 				Length:      msg.ImageCols,
 				TextLength:  msg.EndCol - msg.StartCol,
 			}
@@ -159,17 +205,43 @@ func (m Model) Update(msg tea.Msg) (tea.Model, tea.Cmd) {
 			m.DocumentLoading = false
 		}
 
+	case PictureProcessedMsg:
+		if msg.Generation != m.fileGeneration {
+			m.images.Release(msg.ImageID)
+			break
+		}
+		m.PendingRenders--
+		m.invalidateEviction()
+		if msg.Error != nil {
+			errors.AddError(msg.Error.Error(), "image")
+		}
+		// Keep the result only if the line has not changed since it was sent.
+		if cur, ok := m.Pictures[msg.BlockIdx][msg.LineIdx]; ok && cur.ImageID == 0 && cur.Line == msg.Line && cur.MaxWidth == msg.MaxWidth {
+			m.Pictures[msg.BlockIdx][msg.LineIdx] = PictureRender{
+				ImageID:     msg.ImageID,
+				ImageCols:   msg.ImageCols,
+				ImageHeight: msg.ImageHeight,
+				Line:        msg.Line,
+				MaxWidth:    msg.MaxWidth,
+			}
+		} else {
+			m.images.Release(msg.ImageID)
+		}
+		if m.PendingRenders == 0 && m.DocumentLoading {
+			m.DocumentLoading = false
+		}
+
 	case TickMsg:
 		m.Time = time.Time(msg)
-		if m.PendingRenders == 0 {
-			for _, b := range m.Editor.Blocks {
-				if b.IsDirty {
-					m.updateParsedDoc()
-					cmds = append(cmds, m.processDirtyBlocks())
-					break
-				}
-			}
+		m.cancelEditedRenders()
+		m.renderPool.SetViewport(m.visibleBlockRange())
+		m.evictOffscreenImages()
+		m.releaseRetired()
+		if m.PendingRenders == 0 && m.hasDirtyInRange() {
+			cmds = append(cmds, m.processDirtyBlocks())
 		}
+		m.flushPlacements()
+		cmds = append(cmds, m.updatePreview())
 		return m, tea.Batch(doTick(), tea.Batch(cmds...))
 
 	case tea.MouseClickMsg: